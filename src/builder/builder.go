@@ -1,8 +1,7 @@
 package builder
 
 import (
-	"bytes"
-	"crypto/rsa"
+	"crypto"
 	"crypto/x509"
 	"errors"
 	"fmt"
@@ -10,11 +9,14 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
 
+	"events"
 	"helpers"
+	"logger"
+	"swupd"
 )
 
 // A Builder contains all configurable fields required to perform a full mix
@@ -35,8 +37,39 @@ type Builder struct {
 	Yumconf     string
 	Yumtemplate string
 
+	// Key and certificate configuration, see NewKeyPair and NewCertTemplate
+	KeyAlgorithm     string
+	KeySize          string
+	CertValidity     string
+	CertOrganization string
+	CertCommonName   string
+
+	// Signing backend configuration, see NewSigner
+	SigningBackend string
+	SigningKey     string
+	SigningCommand string
+	PKCS11Module   string
+	PKCS11Token    string
+	PKCS11KeyLabel string
+	PKCS11KeyID    string
+	PKCS11Pin      string
+
+	// Publish backend configuration, see NewPublisher
+	PublishBackend string
+	PublishDest    string
+	S3Endpoint     string
+	S3Region       string
+	S3AccessKey    string
+	S3SecretKey    string
+
+	// Config is the parsed builder.conf the fields were read from
+	Config *Config
+
 	Signing int
 	Bump    int
+
+	// report collects the steps of the build of Mixver
+	report *BuildReport
 }
 
 // New will return a new instance of Builder with some predetermined sane
@@ -52,122 +85,211 @@ func New() *Builder {
 }
 
 // NewFromConfig creates a new Builder with the given Configuration.
-func NewFromConfig(conf string) *Builder {
+func NewFromConfig(conf string) (*Builder, error) {
 	b := New()
-	b.LoadBuilderConf(conf)
-	b.ReadBuilderConf()
-	b.ReadVersions()
-	return b
+	if err := b.LoadBuilderConf(conf); err != nil {
+		return nil, err
+	}
+	if err := b.ReadBuilderConf(); err != nil {
+		return nil, err
+	}
+	if err := b.ReadVersions(); err != nil {
+		return nil, err
+	}
+	return b, nil
 }
 
 // LoadBuilderConf will read the builder configuration from the command line if
 // it was provided, otherwise it will fall back to reading the configuration from
-// the local builder.conf file.
-func (b *Builder) LoadBuilderConf(builderconf string) {
-	local, err := os.Getwd()
-	if err != nil {
-		helpers.PrintError(err)
-		os.Exit(1)
-	}
-
+// the local builder.conf file. ErrNoBuilderConf is returned if there is none.
+func (b *Builder) LoadBuilderConf(builderconf string) error {
 	// If builderconf is set via cmd line, use that one
 	if len(builderconf) > 0 {
 		b.Buildconf = builderconf
-		return
+		return nil
+	}
+
+	local, err := os.Getwd()
+	if err != nil {
+		return err
 	}
 
 	// Check if there's a local builder.conf if one wasn't supplied
 	localpath := local + "/builder.conf"
-	if _, err := os.Stat(localpath); err == nil {
-		b.Buildconf = localpath
-	} else {
-		helpers.PrintError(err)
-		fmt.Println("ERROR: Cannot find any builder.conf to use!")
-		os.Exit(1)
+	if _, err := os.Stat(localpath); err != nil {
+		return ErrNoBuilderConf
 	}
+	b.Buildconf = localpath
+	return nil
 }
 
 // ReadBuilderConf will populate the configuration data from the builder
 // configuration file, which is mandatory information for performing a mix.
-func (b *Builder) ReadBuilderConf() {
-	lines, err := helpers.ReadFileAndSplit(b.Buildconf)
+// Unknown or duplicate keys are reported as warnings.
+func (b *Builder) ReadBuilderConf() error {
+	conf, err := ReadConfig(b.Buildconf)
 	if err != nil {
-		fmt.Println("ERROR: Failed to read buildconf")
-		os.Exit(1)
-	}
-
-	// Map the builder values to the regex here to make it easier to assign
-	fields := []struct {
-		re   string
-		dest *string
-	}{
-		{`^BUNDLE_DIR\s*=\s*`, &b.Bundledir},
-		{`^CERT\s*=\s*`, &b.Cert},
-		{`^CLEARVER\s*=\s*`, &b.Clearver},
-		{`^FORMAT\s*=\s*`, &b.Format},
-		{`^MIXVER\s*=\s*`, &b.Mixver},
-		{`^REPODIR\s*=\s*`, &b.Repodir},
-		{`^RPMDIR\s*=\s*`, &b.Rpmdir},
-		{`^SERVER_STATE_DIR\s*=\s*`, &b.Statedir},
-		{`^VERSIONS_PATH\s*=\s*`, &b.Versiondir},
-		{`^YUM_CONF\s*=\s*`, &b.Yumconf},
-	}
-
-	for _, h := range fields {
-		r := regexp.MustCompile(h.re)
-		for _, i := range lines {
-			if m := r.FindIndex([]byte(i)); m != nil {
-				*h.dest = i[m[1]:]
-			}
-		}
+		return err
+	}
+	for _, w := range conf.Warnings {
+		events.Warning("%s", w)
+	}
+
+	b.Config = conf
+	for _, k := range configKeys {
+		*k.dest(b) = conf.Get(k.Name)
+	}
+	return nil
+}
+
+// LogPath returns the log file of the build of version
+func (b *Builder) LogPath(version string) string {
+	return filepath.Join(b.Statedir, "logs", version+".log")
+}
+
+// OpenBuildLog starts keeping the full log of the build of version, along
+// with the output of the programs run, in LogPath
+func (b *Builder) OpenBuildLog(version string) error {
+	if err := logger.OpenFile(b.LogPath(version)); err != nil {
+		return fmt.Errorf("failed to open build log: %v", err)
 	}
+	logger.Debug("Logging the build of version %s to %s", version, b.LogPath(version))
+	return nil
 }
 
 // ReadVersions will initialise the mix versions (mix and clearlinux) from
-// the configuration files in the version directory.
-func (b *Builder) ReadVersions() {
-	ver, err := ioutil.ReadFile(b.Versiondir + "/.mixversion")
+// the configuration files in the version directory. ErrNotInitialized is
+// returned if they do not exist.
+func (b *Builder) ReadVersions() error {
+	ver, err := readVersionFile(b.Versiondir + "/.mixversion")
 	if err != nil {
-		helpers.PrintError(err)
-		os.Exit(1)
+		return err
 	}
-	b.Mixver = strings.TrimSpace(string(ver))
-	b.Mixver = strings.Replace(b.Mixver, "\n", "", -1)
+	b.Mixver = ver
 
-	ver, err = ioutil.ReadFile(b.Versiondir + "/.clearversion")
+	ver, err = readVersionFile(b.Versiondir + "/.clearversion")
 	if err != nil {
-		helpers.PrintError(err)
-		os.Exit(1)
+		return err
 	}
-	b.Clearver = strings.TrimSpace(string(ver))
-	b.Clearver = strings.Replace(b.Clearver, "\n", "", -1)
+	b.Clearver = ver
+	return nil
+}
+
+// readVersionFile returns the version stored in the file at path
+func readVersionFile(path string) (string, error) {
+	ver, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("%w: %s does not exist", ErrNotInitialized, path)
+	} else if err != nil {
+		return "", err
+	}
+	return strings.Replace(strings.TrimSpace(string(ver)), "\n", "", -1), nil
 }
 
 // SignManifestMOM will sign the Manifest.Mom file in in place based on the Mix
-// version read from builder.conf.
-// Shelling out to openssl because signing and pkcs7 stuff is not well supported
-// in Go yet.. but the command works well and is how things worked previously
-func (b *Builder) SignManifestMOM() {
+// version read from builder.conf. The signature is a detached PKCS#7
+// signature in DER form, written to Manifest.MoM.sig. It is checked against
+// the certificate before being written, so that a misconfigured signing
+// backend is caught before clients reject the update.
+func (b *Builder) SignManifestMOM() error {
 	manifestMOM := b.Statedir + "/www/" + b.Mixver + "/Manifest.MoM"
 	manifestMOMsig := manifestMOM + ".sig"
-	cmd := exec.Command("openssl", "smime", "-sign", "-binary", "-in", manifestMOM,
-		"-signer", b.Cert, "-inkey", filepath.Dir(b.Cert)+"/private.pem",
-		"-outform", "DER", "-out", manifestMOMsig)
-
-	// OpenSSL gives us useful info here so capture it if needed
-	var out bytes.Buffer
-	cmd.Stderr = &out
-	err := cmd.Run()
+
+	b.WarnCertExpiry()
+	signer, err := b.NewSigner()
+	if err != nil {
+		return err
+	}
+	cert, err := helpers.ReadCertificate(b.Cert)
+	if err != nil {
+		return fmt.Errorf("failed to read certificate: %v", err)
+	}
+	content, err := ioutil.ReadFile(manifestMOM)
 	if err != nil {
-		fmt.Println("ERROR: Failed to sign Manifest.MoM!")
-		fmt.Printf("%s\n", out.String())
+		return err
+	}
+
+	sig, err := signer.Sign(content)
+	if err != nil {
+		return fmt.Errorf("failed to sign Manifest.MoM: %v", err)
+	}
+	if err = helpers.VerifyPKCS7(content, sig, cert); err != nil {
+		return fmt.Errorf("signature of Manifest.MoM does not match %s: %v", b.Cert, err)
+	}
+	if err = ioutil.WriteFile(manifestMOMsig, sig, 0644); err != nil {
+		return err
+	}
+	events.Info("Signed Manifest.MoM")
+	return nil
+}
+
+// VerifyManifestMOM checks the signature of the Manifest.MoM of version
+// against the certificate configured in builder.conf.
+func (b *Builder) VerifyManifestMOM(version string) error {
+	manifestMOM := b.Statedir + "/www/" + version + "/Manifest.MoM"
+
+	cert, err := helpers.ReadCertificate(b.Cert)
+	if err != nil {
+		return fmt.Errorf("failed to read certificate: %v", err)
+	}
+	content, err := ioutil.ReadFile(manifestMOM)
+	if err != nil {
+		return err
+	}
+	sig, err := ioutil.ReadFile(manifestMOM + ".sig")
+	if err != nil {
+		return err
+	}
+	if err = helpers.VerifyPKCS7(content, sig, cert); err != nil {
+		return fmt.Errorf("invalid signature for %s: %v", manifestMOM, err)
+	}
+	return nil
+}
+
+// VerifyContent checks that the manifests, fullfiles and packs of version are
+// consistent with each other, reporting every problem found. Errors are
+// printed, the returned error wraps ErrInvalidContent when there are
+// problems.
+func (b *Builder) VerifyContent(version string) error {
+	ver, err := strconv.ParseUint(version, 10, 32)
+	if err != nil {
+		err = fmt.Errorf("invalid version %q: %v", version, err)
 		helpers.PrintError(err)
+		return err
 	}
-	fmt.Println("Signed Manifest.MoM")
+
+	step := events.StartStep("verify-content", "Verifying the content of version "+version)
+	info, err := swupd.VerifyContent(b.Statedir, uint32(ver), runtime.NumCPU())
+	if err != nil {
+		step.Fail(err)
+		return err
+	}
+	for _, p := range info.Problems {
+		events.Emit(&events.Event{Type: events.TypeError, Step: step.Name, Message: p, Code: events.ErrorCode(ErrInvalidContent)})
+	}
+	// The size of directories on the build system is counted in the
+	// contentsize but is not part of the content.
+	if info.BoundedSizes > 0 {
+		events.Info("The contentsize of %d manifests with directories is only checked as an upper bound of the size of their files", info.BoundedSizes)
+	}
+	step.Finish(fmt.Sprintf("Checked %d manifests, %d fullfiles and %d packs", info.Manifests, info.Fullfiles, info.Packs),
+		map[string]interface{}{
+			"manifests":     info.Manifests,
+			"fullfiles":     info.Fullfiles,
+			"packs":         info.Packs,
+			"bounded_sizes": info.BoundedSizes,
+			"problems":      len(info.Problems),
+		})
+	if len(info.Problems) > 0 {
+		err = fmt.Errorf("%w: %d problems found in version %s", ErrInvalidContent, len(info.Problems), version)
+		helpers.PrintError(err)
+		return err
+	}
+	return nil
 }
 
 // UpdateRepo will fetch the clr-bundles for our configured Clear Linux version
-func (b *Builder) UpdateRepo(ver string, allbundles bool) {
+func (b *Builder) UpdateRepo(ver string, allbundles bool) error {
 	// Make the folder to store all clr-bundles version
 	if _, err := os.Stat("clr-bundles"); err != nil {
 		os.Mkdir("clr-bundles", 0777)
@@ -175,65 +297,69 @@ func (b *Builder) UpdateRepo(ver string, allbundles bool) {
 
 	repo := "clr-bundles/clr-bundles-" + ver + ".tar.gz"
 	if _, err := os.Stat(repo); err == nil {
-		fmt.Println("Already downloaded " + repo)
-		return
+		events.Info("Already downloaded %s", repo)
+		return nil
 	}
 
 	URL := "https://github.com/clearlinux/clr-bundles/archive/" + ver + ".tar.gz"
 	err := helpers.Download(repo, URL)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "ERROR: Failed to download clr-bundles, make sure the version is valid: %s\n", err)
-		os.Exit(1)
+		return fmt.Errorf("failed to download clr-bundles, make sure the version is valid: %v", err)
 	}
 
 	// FIXME: Maybe use Go's tar or compress packages to do this
-	_, err = exec.Command("tar", "-xzf", repo, "-C", "clr-bundles/").Output()
+	if out, err := exec.Command("tar", "-xzf", repo, "-C", "clr-bundles/").CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to extract %s: %v: %s", repo, err, out)
+	}
 	bundles := b.Bundledir
 	if _, err := os.Stat(bundles); os.IsNotExist(err) {
 		clrbundles := "clr-bundles/clr-bundles-" + ver + "/bundles/"
 		os.Mkdir(bundles, 0777)
 		// Copy all bundles over into mix-bundles if -all passed
+		var names []string
 		if allbundles == true {
-			files, err := ioutil.ReadDir("clr-bundles/clr-bundles-" + ver + "/bundles/")
+			files, err := ioutil.ReadDir(clrbundles)
 			if err != nil {
-				helpers.PrintError(err)
-				os.Exit(1)
+				return err
 			}
 			for _, file := range files {
-				helpers.CopyFile(bundles+"/"+file.Name(), clrbundles+file.Name())
+				names = append(names, file.Name())
 			}
 		} else {
 			// Install only a minimal set of bundles
-			fmt.Println("Adding os-core, os-core-update, kernel-native, bootloader to mix-bundles...")
-			helpers.CopyFile(bundles+"/os-core", clrbundles+"os-core")
-			helpers.CopyFile(bundles+"/os-core-update", clrbundles+"os-core-update")
-			helpers.CopyFile(bundles+"/kernel-native", clrbundles+"kernel-native")
-			helpers.CopyFile(bundles+"/bootloader", clrbundles+"bootloader")
+			events.Info("Adding os-core, os-core-update, kernel-native, bootloader to mix-bundles...")
+			names = []string{"os-core", "os-core-update", "kernel-native", "bootloader"}
+		}
+		for _, name := range names {
+			if err = helpers.CopyFile(bundles+"/"+name, clrbundles+name); err != nil {
+				return err
+			}
 		}
 
-		// Save current dir so we can get back to it
-		curr, err := os.Getwd()
-		if err != nil {
-			helpers.PrintError(err)
-			os.Exit(1)
+		if err = helpers.Git("-C", bundles, "init"); err != nil {
+			return err
+		}
+		if err = helpers.Git("-C", bundles, "add", "."); err != nil {
+			return err
 		}
-		os.Chdir(b.Bundledir)
-		helpers.Git("init")
-		helpers.Git("add", ".")
 		commitMsg := fmt.Sprintf("Initial Mix Version %s from Clear Version %s", b.Mixver, b.Clearver)
-		helpers.Git("commit", "-m", commitMsg)
-		os.Chdir(curr)
+		if err = helpers.Git("-C", bundles, "commit", "-m", commitMsg); err != nil {
+			return err
+		}
 	}
 
-	fmt.Println("Downloaded " + repo)
+	events.Info("Downloaded %s", repo)
+	return nil
 }
 
 // AddBundles will copy the specified clr-bundles from the configured Clear
-// Linux version to the mix-bundles directory
+// Linux version to the mix-bundles directory and returns the number of
+// bundles added. ErrBundleNotFound is returned for bundles that do not exist
+// in the Clear Linux version.
 // bundles: array slice of bundle names
 // force: override bundle in mix-dir when present
 // git: automatically git commit with bundles added
-func (b *Builder) AddBundles(bundles []string, force bool, git bool) int {
+func (b *Builder) AddBundles(bundles []string, force bool, git bool) (int, error) {
 	var bundleAddCount int
 
 	bundledir := b.Bundledir
@@ -243,158 +369,173 @@ func (b *Builder) AddBundles(bundles []string, force bool, git bool) int {
 
 	// Check if mix bundles dir exists
 	if _, err := os.Stat(bundledir); os.IsNotExist(err) {
-		helpers.PrintError(errors.New("Mix bundles directory does not exist. Run mixer init-mix."))
-		os.Exit(1)
+		return 0, fmt.Errorf("%w: mix bundles directory %s does not exist", ErrNotInitialized, bundledir)
 	}
 
 	clrbundledir := "clr-bundles/clr-bundles-" + b.Clearver + "/bundles/"
 
 	// Check if CLR bundles exist, download if not
 	if _, err := os.Stat(clrbundledir); os.IsNotExist(err) {
-		b.UpdateRepo(b.Clearver, false)
+		if err = b.UpdateRepo(b.Clearver, false); err != nil {
+			return 0, err
+		}
 	}
 
 	var includes []string
 	for _, bundle := range bundles {
 		// Check if bundle exists in clrbundledir
 		if _, err := os.Stat(clrbundledir + bundle); os.IsNotExist(err) {
-			helpers.PrintError(errors.New("Bundle " + bundle + " does not exist in CLR version " + b.Clearver))
-			os.Exit(1)
+			return bundleAddCount, fmt.Errorf("%w: %s does not exist in CLR version %s", ErrBundleNotFound, bundle, b.Clearver)
 		}
 		// Check if bundle exists in mix bundles dir
 		if _, err := os.Stat(bundledir + bundle); os.IsNotExist(err) || force {
 			// Parse bundle to get all includes
 			if ib, err := helpers.GetIncludedBundles(clrbundledir + bundle); err != nil {
-				helpers.PrintError(errors.New("Cannot parse bundle " + bundle + " from CLR version " + b.Clearver))
-				os.Exit(1)
+				return bundleAddCount, fmt.Errorf("cannot parse bundle %s from CLR version %s: %v", bundle, b.Clearver, err)
 			} else if len(ib) > 0 {
 				includes = append(includes, ib...)
 			}
 
-			fmt.Printf("Adding bundle %q\n", bundle)
-			helpers.CopyFile(bundledir+bundle, clrbundledir+bundle)
+			events.BundleAdded(bundle)
+			if err = helpers.CopyFile(bundledir+bundle, clrbundledir+bundle); err != nil {
+				return bundleAddCount, err
+			}
 			bundleAddCount++
 		} else {
-			fmt.Printf("Warning: bundle %q already exists; skipping.\n", bundle)
+			events.Warning("bundle %q already exists; skipping.", bundle)
 		}
 	}
 	// Recurse on included bundles
 	if len(includes) > 0 {
-		bundleAddCount += b.AddBundles(includes, force, false)
+		count, err := b.AddBundles(includes, force, false)
+		bundleAddCount += count
+		if err != nil {
+			return bundleAddCount, err
+		}
 	}
 
 	if git && bundleAddCount > 0 {
-		// Save current dir so we can get back to it
-		curr, err := os.Getwd()
-		if err != nil {
-			helpers.PrintError(err)
-			os.Exit(1)
+		events.Info("Adding git commit")
+		if err := helpers.Git("-C", bundledir, "add", "."); err != nil {
+			return bundleAddCount, err
 		}
-		fmt.Println("Adding git commit")
-		os.Chdir(bundledir)
-		helpers.Git("add", ".")
 		commitMsg := fmt.Sprintf("Added bundles from Clear Version %s\n\nBundles added: %v", b.Clearver, bundles)
-		helpers.Git("commit", "-m", commitMsg)
-		os.Chdir(curr)
+		if err := helpers.Git("-C", bundledir, "commit", "-m", commitMsg); err != nil {
+			return bundleAddCount, err
+		}
 	}
-	return bundleAddCount
+	return bundleAddCount, nil
 }
 
 // InitMix will initialise a new swupd-client consumable "mix" with the given
 // based Clear Linux version and specified mix version.
 func (b *Builder) InitMix(clearver string, mixver string, all bool) error {
 	if clearver == "0" || mixver == "0" {
-		fmt.Println("ERROR: Please supply -clearver and -mixver")
-		os.Exit(1)
+		return errors.New("please supply -clearver and -mixver")
 	}
 	err := ioutil.WriteFile(b.Versiondir+"/.clearversion", []byte(clearver), 0644)
 	if err != nil {
-		helpers.PrintError(err)
-		os.Exit(1)
+		return err
 	}
 	b.Mixver = mixver
 
 	err = ioutil.WriteFile(b.Versiondir+"/.mixversion", []byte(mixver), 0644)
 	if err != nil {
-		helpers.PrintError(err)
-		os.Exit(1)
+		return err
 	}
 	b.Clearver = clearver
 
-	b.UpdateRepo(clearver, all)
-
-	return nil
+	return b.UpdateRepo(clearver, all)
 }
 
 // UpdatMixVer automatically bumps the mixversion file +10 to prepare for the next build
 // without requiring user intervention. This makes the flow slightly more automatable.
-func (b *Builder) UpdateMixVer() {
+func (b *Builder) UpdateMixVer() error {
 	mixver, _ := strconv.Atoi(b.Mixver)
-	err := ioutil.WriteFile(b.Versiondir+"/.mixversion", []byte(strconv.Itoa(mixver+10)), 0644)
-	if err != nil {
-		helpers.PrintError(err)
-		os.Exit(1)
-	}
+	return ioutil.WriteFile(b.Versiondir+"/.mixversion", []byte(strconv.Itoa(mixver+10)), 0644)
 }
 
 // BuildChroots will attempt to construct the chroots required by populating roots
 // using the m4 bundle configurations in conjunction with the YUM configuration file,
 // installing all required named packages into the roots.
-func (b *Builder) BuildChroots(template *x509.Certificate, privkey *rsa.PrivateKey, signflag bool) error {
+func (b *Builder) BuildChroots(template *x509.Certificate, privkey crypto.Signer, signflag bool) error {
 	// Generate the yum config file if it does not exist.
 	// This takes the template and adds the relevant local rpm repo path if needed
-	fmt.Println("Building chroots..")
+	b.startReport()
+	step := events.StartStep("build-chroots", "Building chroots..")
 	if _, err := os.Stat(b.Yumconf); os.IsNotExist(err) {
 		outfile, err := os.Create(b.Yumconf)
 		if err != nil {
-			helpers.PrintError(err)
-			panic(err)
+			step.Fail(err)
+			return err
 		}
-		defer outfile.Close()
+		var cmd *exec.Cmd
 		if b.Repodir == "" {
-			cmd := exec.Command("m4", b.Yumtemplate)
-			cmd.Stdout = outfile
-			cmd.Run()
-
+			cmd = exec.Command("m4", b.Yumtemplate)
 		} else {
-			cmd := exec.Command("m4", "-D", "MIXER_REPO", "-D", "MIXER_REPOPATH="+b.Repodir, b.Yumtemplate)
-			cmd.Stdout = outfile
-			cmd.Run()
+			cmd = exec.Command("m4", "-D", "MIXER_REPO", "-D", "MIXER_REPOPATH="+b.Repodir, b.Yumtemplate)
+		}
+		cmd.Stdout = outfile
+		cmd.Stderr = logger.Stderr()
+		err = cmd.Run()
+		if cerr := outfile.Close(); err == nil {
+			err = cerr
 		}
-		outfile.Close()
 		if err != nil {
-			helpers.PrintError(err)
+			// Do not leave a partial config behind, it would be used as is
+			// by the next build
+			_ = os.Remove(b.Yumconf)
+			err = fmt.Errorf("failed to generate %s from %s: %v", b.Yumconf, b.Yumtemplate, err)
+			step.Fail(err)
 			return err
 		}
 	}
 
 	// If MIXVER already exists, wipe it so it's a fresh build
 	if _, err := os.Stat(b.Statedir + "/image/" + b.Mixver); err == nil {
-		fmt.Printf("Wiping away previous version %s...\n", b.Mixver)
+		events.Info("Wiping away previous version %s...", b.Mixver)
 		err = os.RemoveAll(b.Statedir + "/www/" + b.Mixver)
 		if err != nil {
+			step.Fail(err)
 			return err
 		}
 		err = os.RemoveAll(b.Statedir + "/image/" + b.Mixver)
 		if err != nil {
+			step.Fail(err)
 			return err
 		}
 	}
 
+	// The chroot builder gets the configuration as mixer resolved it, so
+	// that both use the same directories.
+	chrootconf, err := b.writeChrootConfig()
+	if err != nil {
+		step.Fail(err)
+		return err
+	}
+	defer os.Remove(chrootconf)
+
 	// If this is a mix, we need to build with the Clear version, but publish the mix version
-	chrootcmd := exec.Command(b.Buildscript, "-c", b.Buildconf, "-m", b.Mixver, b.Clearver)
-	chrootcmd.Stdout = os.Stdout
-	chrootcmd.Stderr = os.Stderr
-	err := chrootcmd.Run()
+	chrootcmd := exec.Command(b.Buildscript, "-c", chrootconf, "-m", b.Mixver, b.Clearver)
+	logger.Debug("Running %s", strings.Join(chrootcmd.Args, " "))
+	chrootcmd.Stdout = logger.Stdout()
+	chrootcmd.Stderr = logger.Stderr()
+	err = chrootcmd.Run()
 	if err != nil {
-		helpers.PrintError(err)
+		step.Fail(err)
 		return err
 	}
 
 	// Generate the certificate needed for signing verification if it does not exist and insert it into the chroot
 	if signflag == false && template != nil {
-		err = helpers.GenerateCertificate(b.Cert, template, template, &privkey.PublicKey, privkey)
+		if b.SigningBackend != "" && b.SigningBackend != SigningBackendFile {
+			err = fmt.Errorf("%s must exist to sign with the %s backend", b.Cert, b.SigningBackend)
+			step.Fail(err)
+			return err
+		}
+		err = helpers.GenerateCertificate(b.Cert, b.SigningKeyPath(), template, template, privkey.Public(), privkey)
 		if err != nil {
+			step.Fail(err)
 			return err
 		}
 	}
@@ -404,14 +545,21 @@ func (b *Builder) BuildChroots(template *x509.Certificate, privkey *rsa.PrivateK
 		certdir := b.Statedir + "/image/" + b.Mixver + "/os-core-update/usr/share/clear/update-ca"
 		err = os.MkdirAll(certdir, 0755)
 		if err != nil {
-			helpers.PrintError(err)
+			step.Fail(err)
 			return err
 		}
 		chrootcert := certdir + "/Swupd_Root.pem"
-		fmt.Println("Copying Certificate into chroot...")
-		err = helpers.CopyFile(chrootcert, b.Cert)
+		events.Info("Copying Certificate into chroot...")
+		// Certificates of a pending key rotation or renewal are published
+		// along with the current one, so clients can transition.
+		certs, err := b.publishedCertificates()
 		if err != nil {
-			helpers.PrintError(err)
+			step.Fail(err)
+			return err
+		}
+		err = ioutil.WriteFile(chrootcert, certs, 0644)
+		if err != nil {
+			step.Fail(err)
 			return err
 		}
 	}
@@ -419,13 +567,14 @@ func (b *Builder) BuildChroots(template *x509.Certificate, privkey *rsa.PrivateK
 	// TODO: Remove all the files-* entries since they're now copied into the noship dir
 	// do code stuff here
 
+	b.finishStep(step, "", StepReport{}, nil)
 	return nil
 }
 
 // Set the published versions to what was just built
-func (b *Builder) setVersion(publish bool) {
+func (b *Builder) setVersion(publish bool) error {
 	if publish == false {
-		return
+		return nil
 	}
 
 	// Create the www/version/format# dir if it doesn't exist
@@ -434,39 +583,36 @@ func (b *Builder) setVersion(publish bool) {
 		os.MkdirAll(formatdir, 0777)
 	}
 
-	fmt.Println("Setting latest version to " + b.Mixver)
+	events.VersionPublished(b.Mixver, b.Format)
 	err := ioutil.WriteFile(formatdir+"/latest", []byte(b.Mixver), 0644)
 	if err != nil {
-		helpers.PrintError(err)
-		os.Exit(1)
-	}
-
-	err = ioutil.WriteFile(b.Statedir+"/image/LAST_VER", []byte(b.Mixver), 0644)
-	if err != nil {
-		helpers.PrintError(err)
-		os.Exit(1)
+		return err
 	}
 
+	return ioutil.WriteFile(b.Statedir+"/image/LAST_VER", []byte(b.Mixver), 0644)
 }
 
 // CleanChroots will remove chroots based on what bundles are defined
-func (b *Builder) CleanChroots() {
-	files := helpers.GetDirContents(b.Bundledir)
+func (b *Builder) CleanChroots() error {
+	files, err := helpers.GetDirContents(b.Bundledir)
+	if err != nil {
+		return err
+	}
 	basedir := b.Statedir + "/image/" + b.Mixver + "/"
 
 	for _, f := range files {
 		if f.Name() == "full" {
 			continue
 		}
-		err := os.RemoveAll(basedir + f.Name())
-		if err != nil {
-			helpers.PrintError(err)
+		if err = os.RemoveAll(basedir + f.Name()); err != nil {
+			return err
 		}
 	}
+	return nil
 }
 
 // BuildUpdate will produce an update consumable by the swupd client
-func (b *Builder) BuildUpdate(prefixflag string, minvflag int, formatflag string, signflag bool, publishflag bool, keepchrootsflag bool) error {
+func (b *Builder) BuildUpdate(minvflag int, formatflag string, signflag bool, publishflag bool, keepchrootsflag bool) error {
 	if formatflag != "" {
 		b.Format = formatflag
 	}
@@ -475,58 +621,213 @@ func (b *Builder) BuildUpdate(prefixflag string, minvflag int, formatflag string
 		os.Mkdir(b.Statedir+"www/version/format"+b.Format, 0777)
 	}
 
-	// Step 1: create update content for the current mix
-	updatecmd := exec.Command(prefixflag+"swupd_create_update", "-S", b.Statedir, "--minversion", strconv.Itoa(minvflag), "-F", b.Format, "--osversion", b.Mixver)
-	updatecmd.Stdout = os.Stdout
-	updatecmd.Stderr = os.Stderr
-	err := updatecmd.Run()
+	mixver, err := strconv.ParseUint(b.Mixver, 10, 32)
+	if err != nil {
+		err = fmt.Errorf("invalid mix version %q: %v", b.Mixver, err)
+		helpers.PrintError(err)
+		return err
+	}
+	format, err := strconv.ParseUint(b.Format, 10, 32)
 	if err != nil {
+		err = fmt.Errorf("invalid format %q: %v", b.Format, err)
 		helpers.PrintError(err)
 		return err
 	}
 
+	b.startReport()
+	wwwdir := filepath.Join(b.Statedir, "www", b.Mixver)
+
+	// Step 1: create update content for the current mix
+	step := events.StartStep("manifests", "Creating manifests for version "+b.Mixver)
+	mom, err := swupd.CreateManifests(uint32(mixver), uint32(minvflag), uint(format), b.Statedir)
+	if err != nil {
+		step.Fail(err)
+		return err
+	}
+	var result StepReport
+	if result.Files, result.Bytes, err = filesUsage(filepath.Join(wwwdir, "Manifest.*")); err != nil {
+		step.Fail(err)
+		return err
+	}
+	b.finishStep(step, fmt.Sprintf("Created manifests for %d bundles", len(mom.SubManifests)), result,
+		map[string]interface{}{"bundles": len(mom.SubManifests)})
+
 	// We only need the full chroot from this point on, so cleanup the others to save space
 	if keepchrootsflag == false {
-		b.CleanChroots()
+		if err = b.CleanChroots(); err != nil {
+			helpers.PrintError(err)
+			return err
+		}
 	}
 
 	// Step 1.5: sign the Manifest.MoM that was just created
 	if signflag == false {
-		b.SignManifestMOM()
+		step = events.StartStep("sign", "")
+		if err = b.SignManifestMOM(); err != nil {
+			step.Fail(err)
+			return err
+		}
+		result = StepReport{}
+		if result.Files, result.Bytes, err = filesUsage(filepath.Join(wwwdir, "Manifest.MoM.sig")); err != nil {
+			step.Fail(err)
+			return err
+		}
+		b.finishStep(step, "", result, nil)
 	}
 
 	// Step 2: create fullfiles
-	output, err := exec.Command(prefixflag+"swupd_make_fullfiles", "-S", b.Statedir, b.Mixver).Output()
+	step = events.StartStep("fullfiles", "Creating fullfiles for version "+b.Mixver)
+	fullfiles, err := swupd.CreateFullfiles(b.Statedir, uint32(mixver), runtime.NumCPU())
 	if err != nil {
-		helpers.PrintError(err)
+		step.Fail(err)
 		return err
 	}
-	fmt.Println(string(output))
+	b.finishStep(step, fmt.Sprintf("Created %d fullfiles (%d already existed)", fullfiles.Created, fullfiles.Skipped),
+		StepReport{Files: int(fullfiles.Created), Bytes: fullfiles.Size},
+		map[string]interface{}{"created": fullfiles.Created, "existing": fullfiles.Skipped})
 
 	// Step 3: create zero packs
-	if prefixflag == "" {
-		output, err = exec.Command("mixer-pack-maker.sh", "--to", b.Mixver, "-S", b.Statedir).Output()
-	} else {
-		output, err = exec.Command("mixer-pack-maker.sh", "--to", b.Mixver, "-S", b.Statedir, "--repodir", prefixflag).Output()
+	if err = b.BuildPacks(b.Mixver, nil, true, false); err != nil {
+		return err
+	}
+
+	// Step 4: hardlink relevant dirs
+	step = events.StartStep("hardlink", "")
+	hardlinkcmd := exec.Command("hardlink", "-f", b.Statedir+"/image/"+b.Mixver+"/")
+	hardlinkcmd.Stdout = logger.Stdout()
+	hardlinkcmd.Stderr = logger.Stderr()
+	if err = hardlinkcmd.Run(); err != nil {
+		logger.Warn("failed to hardlink the chroots: %v", err)
+	}
+	b.finishStep(step, "", StepReport{}, nil)
+
+	// Step 5: update the latest version
+	if publishflag {
+		step = events.StartStep("publish", "")
+		if err = b.setVersion(publishflag); err != nil {
+			step.Fail(err)
+			return err
+		}
+		b.finishStep(step, "", StepReport{}, nil)
 	}
+
+	if err = b.finishReport(); err != nil {
+		helpers.PrintError(err)
+		return err
+	}
+	return nil
+}
+
+// BuildPacks creates the packs clients download to update to version to. Zero
+// packs hold the full content of each bundle, delta packs are created for
+// updates from every version in from, using delta files where possible.
+// Packs that already exist are kept unless force is set.
+func (b *Builder) BuildPacks(to string, from []string, zero bool, force bool) error {
+	toVer, err := strconv.ParseUint(to, 10, 32)
 	if err != nil {
+		err = fmt.Errorf("invalid version %q: %v", to, err)
 		helpers.PrintError(err)
 		return err
 	}
-	fmt.Println(string(output))
 
-	// Step 4: hardlink relevant dirs
-	_, err = exec.Command("hardlink", "-f", b.Statedir+"/image/"+b.Mixver+"/").Output()
+	var packs []*swupd.Pack
+	if zero {
+		if packs, err = swupd.ZeroPacks(b.Statedir, uint32(toVer)); err != nil {
+			helpers.PrintError(err)
+			return err
+		}
+	}
+	for _, f := range from {
+		fromVer, err := strconv.ParseUint(f, 10, 32)
+		if err != nil {
+			err = fmt.Errorf("invalid version %q: %v", f, err)
+			helpers.PrintError(err)
+			return err
+		}
+		deltas, err := swupd.DeltaPacks(b.Statedir, uint32(fromVer), uint32(toVer))
+		if err != nil {
+			helpers.PrintError(err)
+			return err
+		}
+		packs = append(packs, deltas...)
 
-	// Step 5: update the latest version
-	b.setVersion(publishflag)
+		// Without delta files the delta packs contain the full files, so
+		// failures here are not fatal.
+		info, err := swupd.CreateDeltas(b.Statedir, uint32(fromVer), uint32(toVer), runtime.NumCPU())
+		if err != nil {
+			events.Warning("not all delta files from %s to %s were created", f, to)
+			helpers.PrintError(err)
+		}
+		if info != nil {
+			events.Info("Created %d delta files from %s to %s (%d already existed, %d not worth it)",
+				info.Created, f, to, info.Existing, info.Skipped)
+		}
+	}
 
+	step := events.StartStep("packs", fmt.Sprintf("Creating %d packs for version %s...", len(packs), to))
+	err = swupd.CreatePacks(b.Statedir, packs, force, runtime.NumCPU())
+	skipped := 0
+	for _, p := range packs {
+		if p.Skipped {
+			events.Info("%d/%s already exists, skipping.", p.ToVersion, p.FileName())
+			skipped++
+		}
+	}
+	if err != nil {
+		step.Fail(err)
+		return err
+	}
+	result := StepReport{Packs: len(packs) - skipped}
+	for _, p := range packs {
+		if p.Skipped {
+			continue
+		}
+		fi, err := os.Stat(p.Path(b.Statedir))
+		if err != nil {
+			step.Fail(err)
+			return err
+		}
+		result.Bytes += fi.Size()
+	}
+	b.finishStep(step, "", result, map[string]interface{}{"created": len(packs) - skipped, "existing": skipped})
+	return nil
+}
+
+// BuildSuperpacks merges the delta packs of version to from the count
+// previous versions into superpacks, keeping the most recent keep delta packs
+// and linking the others to the superpack.
+func (b *Builder) BuildSuperpacks(to string, count int, keep int) error {
+	toVer, err := strconv.ParseUint(to, 10, 32)
+	if err != nil {
+		err = fmt.Errorf("invalid version %q: %v", to, err)
+		helpers.PrintError(err)
+		return err
+	}
+
+	step := events.StartStep("superpacks", "Creating superpacks for version "+to)
+	info, err := swupd.CreateSuperpacks(b.Statedir, uint32(toVer), count, keep)
+	if err != nil {
+		step.Fail(err)
+		return err
+	}
+
+	step.Finish(fmt.Sprintf("Created %d superpacks, linked %d delta packs\n"+
+		"Initial size before super pack created: %d kB\n"+
+		"Pack size after super pack created: %d kB\n"+
+		"Total delta: %d kB",
+		info.Superpacks, info.Linked, info.SizeBefore/1024, info.SizeAfter/1024, (info.SizeAfter-info.SizeBefore)/1024),
+		map[string]interface{}{
+			"superpacks":  info.Superpacks,
+			"linked":      info.Linked,
+			"size_before": info.SizeBefore,
+			"size_after":  info.SizeAfter,
+		})
 	return nil
 }
 
 // BuildImage will now proceed to build the full image with the previously
 // validated configuration.
-func (b *Builder) BuildImage(format string, template string) {
+func (b *Builder) BuildImage(format string, template string) error {
 	// If the user did not pass in a format, default to builder.conf
 	if format == "" {
 		format = b.Format
@@ -539,52 +840,46 @@ func (b *Builder) BuildImage(format string, template string) {
 
 	content := "file://" + b.Statedir + "/www"
 	imagecmd := exec.Command("ister.py", "-t", template, "-V", content, "-C", content, "-f", format, "-s", b.Cert)
-	imagecmd.Stdout = os.Stdout
-	imagecmd.Stderr = os.Stderr
-
-	err := imagecmd.Run()
-	if err != nil {
-		helpers.PrintError(err)
-		fmt.Println("Failed to create image, check /var/log/ister")
+	logger.Debug("Running %s", strings.Join(imagecmd.Args, " "))
+	imagecmd.Stdout = logger.Stdout()
+	imagecmd.Stderr = logger.Stderr()
+
+	if err := imagecmd.Run(); err != nil {
+		logs := "/var/log/ister"
+		if path := logger.FilePath(); path != "" {
+			logs = path + " and " + logs
+		}
+		return fmt.Errorf("failed to create image, check %s: %v", logs, err)
 	}
+	return nil
 }
 
 // AddRPMList copies rpms into the repodir and calls createrepo_c on it to
 // generate a yum-consumable repository for the chroot builder to use.
-func (b *Builder) AddRPMList(rpms []os.FileInfo) {
+// ErrInvalidRPM is returned for files that are not valid RPMs.
+func (b *Builder) AddRPMList(rpms []os.FileInfo) error {
 	for _, rpm := range rpms {
 		if err := helpers.CheckRPM(b.Rpmdir + "/" + rpm.Name()); err != nil {
-			fmt.Println("ERROR: RPM is not valid! Please make sure it was built correctly.")
-			os.Exit(1)
-		} else {
-			if _, err = os.Stat(b.Repodir + "/" + rpm.Name()); err == nil {
-				continue
-			}
+			return fmt.Errorf("%w: %s: %v", ErrInvalidRPM, rpm.Name(), err)
+		}
+		if _, err := os.Stat(b.Repodir + "/" + rpm.Name()); err == nil {
+			continue
 		}
-		fmt.Printf("Hardlinking %s to repodir\n", rpm.Name())
+		events.Info("Hardlinking %s to repodir", rpm.Name())
 		err := os.Link(b.Rpmdir+"/"+rpm.Name(), b.Repodir+"/"+rpm.Name())
 		if err != nil {
 			err = helpers.CopyFile(b.Repodir+"/"+rpm.Name(), b.Rpmdir+"/"+rpm.Name())
 			if err != nil {
-				helpers.PrintError(err)
-				os.Exit(1)
+				return err
 			}
 		}
 	}
-	// Save current dir so we can get back to it
-	curr, err := os.Getwd()
-	if err != nil {
-		helpers.PrintError(err)
-		os.Exit(1)
-	}
-	os.Chdir(b.Repodir)
 	createcmd := exec.Command("createrepo_c", ".")
-	createcmd.Stdout = os.Stdout
-	createcmd.Stderr = os.Stderr
-	err = createcmd.Run()
-	if err != nil {
-		helpers.PrintError(err)
-		os.Exit(1)
+	createcmd.Dir = b.Repodir
+	createcmd.Stdout = logger.Stdout()
+	createcmd.Stderr = logger.Stderr()
+	if err := createcmd.Run(); err != nil {
+		return fmt.Errorf("failed to run createrepo_c: %v", err)
 	}
-	os.Chdir(curr)
+	return nil
 }
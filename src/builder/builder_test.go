@@ -0,0 +1,70 @@
+package builder
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestLoadErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "builder-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = NewFromConfig(""); !errors.Is(err, ErrNoBuilderConf) {
+		t.Errorf("expected ErrNoBuilderConf without builder.conf, got %v", err)
+	}
+
+	conf := writeConf(t, dir, "BUNDLE_DIR = "+dir+"/bundles\nSERVER_STATE_DIR = "+dir+"\nVERSIONS_PATH = "+dir+"\nYUM_CONF = "+dir+"/yum.conf\n")
+	if _, err = NewFromConfig(conf); !errors.Is(err, ErrNotInitialized) {
+		t.Errorf("expected ErrNotInitialized without version files, got %v", err)
+	}
+
+	b := New()
+	b.Bundledir = dir + "/bundles"
+	if _, err = b.AddBundles([]string{"os-core"}, false, false); !errors.Is(err, ErrNotInitialized) {
+		t.Errorf("expected ErrNotInitialized without bundles directory, got %v", err)
+	}
+}
+
+func TestBuildChrootsYumConfFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "builder-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// m4 that fails halfway through writing the config
+	bin := dir + "/bin"
+	if err = os.Mkdir(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestScript(t, bin+"/m4", "echo '[main]'\nexit 1\n")
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+path)
+
+	b := New()
+	b.Statedir = dir
+	b.Yumconf = dir + "/yum.conf"
+	b.Yumtemplate = dir + "/yum.conf.in"
+	b.Mixver = "10"
+	if err = b.BuildChroots(nil, nil, false); err == nil {
+		t.Fatal("expected an error when m4 fails")
+	}
+	if _, err = os.Stat(b.Yumconf); !os.IsNotExist(err) {
+		t.Errorf("expected the partial %s to be removed, got %v", b.Yumconf, err)
+	}
+}
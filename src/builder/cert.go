@@ -0,0 +1,372 @@
+package builder
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"events"
+	"helpers"
+)
+
+// certExpiryWarning is how long before its expiration the signing
+// certificate gets reported as expiring
+const certExpiryWarning = 30 * 24 * time.Hour
+
+// Defaults for the keys and certificates created by mixer
+const (
+	defaultKeyAlgorithm     = helpers.KeyAlgorithmRSA
+	defaultRSAKeySize       = 4096
+	defaultECDSAKeySize     = 256
+	defaultCertValidityDays = 365
+	defaultCertOrganization = "Mixer"
+)
+
+// checkKeyAlgorithm returns an error unless updates can be signed with keys
+// of algorithm. Ed25519 is refused since swupd clients verify signatures with
+// OpenSSL, which does not support Ed25519 in PKCS#7 signatures.
+func checkKeyAlgorithm(algorithm string) error {
+	switch algorithm {
+	case helpers.KeyAlgorithmRSA, helpers.KeyAlgorithmECDSA:
+		return nil
+	case helpers.KeyAlgorithmEd25519:
+		return errors.New("ed25519 keys cannot sign updates, swupd clients cannot verify their signatures, use rsa or ecdsa")
+	default:
+		return fmt.Errorf("unsupported key algorithm %q, use rsa or ecdsa", algorithm)
+	}
+}
+
+// NewKeyPair creates a signing key following KEY_ALGORITHM and KEY_SIZE from
+// builder.conf. The algorithm is rsa or ecdsa, the size is the number of bits
+// for RSA and the curve size, 256 or 384, for ECDSA.
+func (b *Builder) NewKeyPair() (crypto.Signer, error) {
+	algorithm := strings.ToLower(b.KeyAlgorithm)
+	if algorithm == "" {
+		algorithm = defaultKeyAlgorithm
+	}
+	if err := checkKeyAlgorithm(algorithm); err != nil {
+		return nil, fmt.Errorf("invalid KEY_ALGORITHM: %v", err)
+	}
+
+	var size int
+	switch {
+	case b.KeySize != "":
+		var err error
+		if size, err = strconv.Atoi(b.KeySize); err != nil {
+			return nil, fmt.Errorf("invalid KEY_SIZE %q: %v", b.KeySize, err)
+		}
+	case algorithm == helpers.KeyAlgorithmRSA:
+		size = defaultRSAKeySize
+	case algorithm == helpers.KeyAlgorithmECDSA:
+		size = defaultECDSAKeySize
+	}
+	return helpers.CreateKeyPair(algorithm, size)
+}
+
+// NewCertTemplate returns the template for a new signing certificate, with
+// the subject from CERT_ORGANIZATION and CERT_COMMON_NAME and valid for
+// CERT_VALIDITY days.
+func (b *Builder) NewCertTemplate() (*x509.Certificate, error) {
+	days := defaultCertValidityDays
+	if b.CertValidity != "" {
+		var err error
+		if days, err = strconv.Atoi(b.CertValidity); err != nil || days <= 0 {
+			return nil, fmt.Errorf("invalid CERT_VALIDITY %q, expected a number of days", b.CertValidity)
+		}
+	}
+
+	subject := pkix.Name{CommonName: b.CertCommonName}
+	organization := b.CertOrganization
+	if organization == "" {
+		organization = defaultCertOrganization
+	}
+	subject.Organization = []string{organization}
+
+	return helpers.CreateCertTemplate(subject, time.Duration(days)*24*time.Hour)
+}
+
+// NextCertPath returns where the certificate created by a pending rotation is
+// stored until the rotation is finished
+func (b *Builder) NextCertPath() string {
+	return b.Cert + ".next"
+}
+
+// PreviousCertPath returns where the certificate replaced by the last renewal
+// or rotation is kept
+func (b *Builder) PreviousCertPath() string {
+	return b.Cert + ".previous"
+}
+
+// describeKey returns the type and size of the public key of cert
+func describeKey(cert *x509.Certificate) string {
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d bits", key.N.BitLen())
+	case *ecdsa.PublicKey:
+		return fmt.Sprintf("ECDSA %s", key.Curve.Params().Name)
+	case ed25519.PublicKey:
+		return "Ed25519"
+	default:
+		return cert.PublicKeyAlgorithm.String()
+	}
+}
+
+// expiryMessage describes when cert expires, relative to now
+func expiryMessage(cert *x509.Certificate, now time.Time) string {
+	left := cert.NotAfter.Sub(now)
+	switch {
+	case left <= 0:
+		return fmt.Sprintf("EXPIRED %d days ago", int(-left.Hours()/24))
+	case left < certExpiryWarning:
+		return fmt.Sprintf("expires in %d days, renew it with 'mixer cert renew'", int(left.Hours()/24))
+	default:
+		return fmt.Sprintf("expires in %d days", int(left.Hours()/24))
+	}
+}
+
+// printCertificate shows the details of the certificate at path
+func printCertificate(title string, path string) error {
+	cert, err := helpers.ReadCertificate(path)
+	if err != nil {
+		return err
+	}
+	fingerprint := sha256.Sum256(cert.Raw)
+
+	var text strings.Builder
+	fmt.Fprintf(&text, "%s: %s\n", title, path)
+	fmt.Fprintf(&text, "  Subject:     %s\n", cert.Subject)
+	fmt.Fprintf(&text, "  Issuer:      %s\n", cert.Issuer)
+	fmt.Fprintf(&text, "  Serial:      %x\n", cert.SerialNumber)
+	fmt.Fprintf(&text, "  Key:         %s\n", describeKey(cert))
+	fmt.Fprintf(&text, "  Not before:  %s\n", cert.NotBefore.UTC().Format(time.RFC3339))
+	fmt.Fprintf(&text, "  Not after:   %s (%s)\n", cert.NotAfter.UTC().Format(time.RFC3339), expiryMessage(cert, time.Now()))
+	fmt.Fprintf(&text, "  Fingerprint: SHA256:%x", fingerprint)
+
+	events.Result(text.String(), map[string]interface{}{
+		"certificate": title,
+		"path":        path,
+		"subject":     cert.Subject.String(),
+		"issuer":      cert.Issuer.String(),
+		"serial":      fmt.Sprintf("%x", cert.SerialNumber),
+		"key":         describeKey(cert),
+		"not_before":  cert.NotBefore.UTC(),
+		"not_after":   cert.NotAfter.UTC(),
+		"fingerprint": fmt.Sprintf("SHA256:%x", fingerprint),
+	})
+	return nil
+}
+
+// ShowCertificate prints the signing certificate, along with the
+// certificates of a pending rotation or the last renewal
+func (b *Builder) ShowCertificate() error {
+	if err := printCertificate("Certificate", b.Cert); err != nil {
+		return err
+	}
+	if _, err := os.Stat(b.NextCertPath()); err == nil {
+		if err = printCertificate("Next certificate (rotation pending)", b.NextCertPath()); err != nil {
+			return err
+		}
+	}
+	if _, err := os.Stat(b.PreviousCertPath()); err == nil {
+		if err = printCertificate("Previous certificate", b.PreviousCertPath()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WarnCertExpiry prints a warning when the signing certificate expired or is
+// about to expire
+func (b *Builder) WarnCertExpiry() {
+	cert, err := helpers.ReadCertificate(b.Cert)
+	if err != nil {
+		return
+	}
+	if cert.NotAfter.Sub(time.Now()) < certExpiryWarning {
+		events.Warning("certificate %s %s", b.Cert, expiryMessage(cert, time.Now()))
+	}
+}
+
+// RenewCertificate replaces the signing certificate with a new self-signed
+// one for the same key and subject, valid for CERT_VALIDITY days. The new
+// certificate is not issued by the old one, there is no chain between them.
+// The old certificate is kept as the previous certificate and published next
+// to the new one until it expires, and since the key did not change the
+// signatures made with it verify against either certificate.
+func (b *Builder) RenewCertificate() error {
+	old, err := helpers.ReadCertificate(b.Cert)
+	if err != nil {
+		return err
+	}
+	key, err := b.signingKey(old)
+	if err != nil {
+		return err
+	}
+
+	// The subject is kept so that clients looking up the signer by its
+	// issuer and subject find a certificate for the same key.
+	template, err := b.NewCertTemplate()
+	if err != nil {
+		return err
+	}
+	template.Subject = old.Subject
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return fmt.Errorf("failed to create certificate: %v", err)
+	}
+
+	// The new certificate replaces the current one in a single rename, so
+	// that signing never lacks a certificate.
+	tmp := b.Cert + ".tmp"
+	if err = helpers.WriteCertificate(tmp, der); err != nil {
+		return err
+	}
+	if err = replaceFile(b.Cert, b.PreviousCertPath()); err == nil {
+		err = os.Rename(tmp, b.Cert)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	events.Info("Renewed certificate %s, valid until %s", b.Cert, template.NotAfter.UTC().Format(time.RFC3339))
+	return nil
+}
+
+// replaceFile makes dst a hard link to src, atomically replacing an existing
+// dst
+func replaceFile(src, dst string) error {
+	tmp := dst + ".tmp"
+	_ = os.Remove(tmp)
+	if err := os.Link(src, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// finishRotation switches the signing certificate and key to the pending
+// next ones, keeping the current pair as the previous one. The current pair
+// stays in place until both new files are moved over it, and the key is put
+// back if the certificate cannot be moved, so that a failure never leaves
+// the mix without a matching certificate and key.
+func (b *Builder) finishRotation(next, nextKey string) error {
+	key := b.SigningKeyPath()
+	previousKey := key + ".previous"
+	if err := replaceFile(b.Cert, b.PreviousCertPath()); err != nil {
+		return err
+	}
+	if err := replaceFile(key, previousKey); err != nil {
+		return err
+	}
+
+	if err := os.Rename(nextKey, key); err != nil {
+		return err
+	}
+	if err := os.Rename(next, b.Cert); err != nil {
+		rerr := os.Link(key, nextKey)
+		if rerr == nil {
+			rerr = replaceFile(previousKey, key)
+		}
+		if rerr != nil {
+			return fmt.Errorf("%v, restoring the key %s from %s failed: %v", err, key, previousKey, rerr)
+		}
+		return err
+	}
+	return nil
+}
+
+// RotateCertificate moves signing to a new key in two steps. The first call
+// creates the new key and certificate, which is published in os-core-update
+// next to the current one while updates are still signed with the old key.
+// Once clients have updated, calling it with finish set switches signing to
+// the new key. Only keys stored in files can be rotated.
+func (b *Builder) RotateCertificate(finish bool) error {
+	if b.SigningBackend != "" && b.SigningBackend != SigningBackendFile {
+		return fmt.Errorf("keys of the %s signing backend must be rotated outside of mixer", b.SigningBackend)
+	}
+	next := b.NextCertPath()
+	nextKey := b.SigningKeyPath() + ".next"
+
+	if finish {
+		if _, err := os.Stat(next); err != nil {
+			return errors.New("no rotation pending, run 'mixer cert rotate' first")
+		}
+		if err := b.finishRotation(next, nextKey); err != nil {
+			return err
+		}
+		events.Info("Updates are now signed with the key of %s", b.Cert)
+		return nil
+	}
+
+	if _, err := os.Stat(next); err == nil {
+		return fmt.Errorf("rotation already pending with %s, finish it with 'mixer cert rotate -finish'", next)
+	}
+	key, err := b.NewKeyPair()
+	if err != nil {
+		return err
+	}
+	template, err := b.NewCertTemplate()
+	if err != nil {
+		return err
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return fmt.Errorf("failed to create certificate: %v", err)
+	}
+	if err = helpers.WritePrivateKey(nextKey, key); err != nil {
+		return err
+	}
+	if err = helpers.WriteCertificate(next, der); err != nil {
+		return err
+	}
+
+	events.Info("Created certificate %s for the new key", next)
+	events.Info("It is published with the current certificate from the next build on.")
+	events.Info("Run 'mixer cert rotate -finish' once clients have updated to sign with the new key.")
+	return nil
+}
+
+// publishedCertificates returns the PEM encoded certificates clients trust:
+// the signing certificate, the certificate of a pending rotation and the
+// previous certificate if it did not expire yet.
+func (b *Builder) publishedCertificates() ([]byte, error) {
+	var certs []string
+	current, err := ioutil.ReadFile(b.Cert)
+	if err != nil {
+		return nil, err
+	}
+	certs = append(certs, string(current))
+
+	if next, err := ioutil.ReadFile(b.NextCertPath()); err == nil {
+		certs = append(certs, string(next))
+	}
+	if cert, err := helpers.ReadCertificate(b.PreviousCertPath()); err == nil && time.Now().Before(cert.NotAfter) {
+		previous, err := ioutil.ReadFile(b.PreviousCertPath())
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, string(previous))
+	}
+
+	for i := range certs {
+		if !strings.HasSuffix(certs[i], "\n") {
+			certs[i] += "\n"
+		}
+	}
+	return []byte(strings.Join(certs, "")), nil
+}
@@ -0,0 +1,190 @@
+package builder
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"helpers"
+	"logger"
+)
+
+// checkKeyPair fails unless the signing key of b matches its certificate
+func checkKeyPair(t *testing.T, b *Builder) {
+	t.Helper()
+	signer, err := b.NewSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := signer.Sign([]byte("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := helpers.ReadCertificate(b.Cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = helpers.VerifyPKCS7([]byte("content"), signature, cert); err != nil {
+		t.Errorf("signing key does not match %s: %v", b.Cert, err)
+	}
+}
+
+// showCertificate returns the output of b.ShowCertificate
+func showCertificate(t *testing.T, b *Builder) string {
+	t.Helper()
+	var out bytes.Buffer
+	logger.SetConsole(&out, &out)
+	defer logger.SetConsole(os.Stdout, os.Stderr)
+	if err := b.ShowCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+func TestCertificateLifecycle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cert-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := New()
+	b.Cert = filepath.Join(dir, "Swupd_Root.pem")
+	b.KeyAlgorithm = helpers.KeyAlgorithmECDSA
+	b.CertCommonName = "test"
+	writeTestCertificate(t, b)
+	original, err := helpers.ReadCertificate(b.Cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := showCertificate(t, b)
+	if !strings.Contains(out, "Certificate: "+b.Cert) || !strings.Contains(out, "ECDSA P-256") {
+		t.Errorf("unexpected certificate output:\n%s", out)
+	}
+	if strings.Contains(out, "Next certificate") || strings.Contains(out, "Previous certificate") {
+		t.Errorf("unexpected next or previous certificate:\n%s", out)
+	}
+
+	t.Run("renew", func(t *testing.T) {
+		if err := b.RenewCertificate(); err != nil {
+			t.Fatal(err)
+		}
+		renewed, err := helpers.ReadCertificate(b.Cert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		previous, err := helpers.ReadCertificate(b.PreviousCertPath())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if renewed.SerialNumber.Cmp(original.SerialNumber) == 0 || previous.SerialNumber.Cmp(original.SerialNumber) != 0 {
+			t.Error("certificate not replaced by the renewed one")
+		}
+		if renewed.Subject.String() != original.Subject.String() {
+			t.Errorf("subject changed from %s to %s", original.Subject, renewed.Subject)
+		}
+		if _, err = os.Stat(b.Cert + ".tmp"); !os.IsNotExist(err) {
+			t.Errorf("temporary certificate left: %v", err)
+		}
+		checkKeyPair(t, b)
+	})
+
+	t.Run("rotate", func(t *testing.T) {
+		current, err := helpers.ReadCertificate(b.Cert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = b.RotateCertificate(true); err == nil {
+			t.Error("expected an error finishing a rotation that was not started")
+		}
+		if err = b.RotateCertificate(false); err != nil {
+			t.Fatal(err)
+		}
+		if err = b.RotateCertificate(false); err == nil {
+			t.Error("expected an error starting a second rotation")
+		}
+		if out := showCertificate(t, b); !strings.Contains(out, "Next certificate (rotation pending)") {
+			t.Errorf("pending rotation not shown:\n%s", out)
+		}
+		published, err := b.publishedCertificates()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := strings.Count(string(published), "BEGIN CERTIFICATE"); n != 3 {
+			t.Errorf("%d certificates published, expected the current, next and previous ones", n)
+		}
+		next, err := helpers.ReadCertificate(b.NextCertPath())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = b.RotateCertificate(true); err != nil {
+			t.Fatal(err)
+		}
+		cert, err := helpers.ReadCertificate(b.Cert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		previous, err := helpers.ReadCertificate(b.PreviousCertPath())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cert.SerialNumber.Cmp(next.SerialNumber) != 0 || previous.SerialNumber.Cmp(current.SerialNumber) != 0 {
+			t.Error("certificates not rotated")
+		}
+		for _, path := range []string{b.NextCertPath(), b.SigningKeyPath() + ".next"} {
+			if _, err = os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("%s left after the rotation: %v", path, err)
+			}
+		}
+		checkKeyPair(t, b)
+	})
+
+	t.Run("failed rotation", func(t *testing.T) {
+		if err := b.RotateCertificate(false); err != nil {
+			t.Fatal(err)
+		}
+		// A directory cannot be moved over the certificate.
+		if err := os.Remove(b.NextCertPath()); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Mkdir(b.NextCertPath(), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.RotateCertificate(true); err == nil {
+			t.Fatal("expected an error finishing the rotation")
+		}
+		checkKeyPair(t, b)
+		if _, err := os.Stat(b.SigningKeyPath() + ".next"); err != nil {
+			t.Errorf("next key not restored: %v", err)
+		}
+	})
+}
+
+func TestNewKeyPair(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		size      string
+		valid     bool
+	}{
+		{"ecdsa", "", true},
+		{"ECDSA", "384", true},
+		{"ecdsa", "521", false},
+		{"ed25519", "", false},
+		{"dsa", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.algorithm+tt.size, func(t *testing.T) {
+			b := New()
+			b.KeyAlgorithm = tt.algorithm
+			b.KeySize = tt.size
+			if _, err := b.NewKeyPair(); (err == nil) != tt.valid {
+				t.Errorf("unexpected result %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,720 @@
+package builder
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"events"
+)
+
+// ConfigEnvPrefix is the prefix of the environment variables overriding
+// builder.conf keys, e.g. MIXER_SERVER_STATE_DIR overrides SERVER_STATE_DIR.
+const ConfigEnvPrefix = "MIXER_"
+
+// configKey describes a key of builder.conf and the Builder field it sets
+type configKey struct {
+	Name     string
+	Required bool
+	Default  string
+	dest     func(b *Builder) *string
+}
+
+// configKeys lists the keys mixer knows about
+var configKeys = []configKey{
+	{"BUNDLE_DIR", true, "", func(b *Builder) *string { return &b.Bundledir }},
+	{"CERT", false, "", func(b *Builder) *string { return &b.Cert }},
+	{"CLEARVER", false, "", func(b *Builder) *string { return &b.Clearver }},
+	{"FORMAT", false, "", func(b *Builder) *string { return &b.Format }},
+	{"MIXVER", false, "", func(b *Builder) *string { return &b.Mixver }},
+	{"REPODIR", false, "", func(b *Builder) *string { return &b.Repodir }},
+	{"RPMDIR", false, "", func(b *Builder) *string { return &b.Rpmdir }},
+	{"SERVER_STATE_DIR", true, "", func(b *Builder) *string { return &b.Statedir }},
+	{"VERSIONS_PATH", true, "", func(b *Builder) *string { return &b.Versiondir }},
+	{"YUM_CONF", true, "", func(b *Builder) *string { return &b.Yumconf }},
+	{"KEY_ALGORITHM", false, defaultKeyAlgorithm, func(b *Builder) *string { return &b.KeyAlgorithm }},
+	{"KEY_SIZE", false, "", func(b *Builder) *string { return &b.KeySize }},
+	{"CERT_VALIDITY", false, strconv.Itoa(defaultCertValidityDays), func(b *Builder) *string { return &b.CertValidity }},
+	{"CERT_ORGANIZATION", false, defaultCertOrganization, func(b *Builder) *string { return &b.CertOrganization }},
+	{"CERT_COMMON_NAME", false, "", func(b *Builder) *string { return &b.CertCommonName }},
+	{"SIGNING_BACKEND", false, SigningBackendFile, func(b *Builder) *string { return &b.SigningBackend }},
+	{"SIGNING_KEY", false, "", func(b *Builder) *string { return &b.SigningKey }},
+	{"SIGNING_COMMAND", false, "", func(b *Builder) *string { return &b.SigningCommand }},
+	{"PKCS11_MODULE", false, "", func(b *Builder) *string { return &b.PKCS11Module }},
+	{"PKCS11_TOKEN", false, "", func(b *Builder) *string { return &b.PKCS11Token }},
+	{"PKCS11_KEY_LABEL", false, "", func(b *Builder) *string { return &b.PKCS11KeyLabel }},
+	{"PKCS11_KEY_ID", false, "", func(b *Builder) *string { return &b.PKCS11KeyID }},
+	{"PKCS11_PIN", false, "", func(b *Builder) *string { return &b.PKCS11Pin }},
+	{"PUBLISH_BACKEND", false, PublishBackendLocal, func(b *Builder) *string { return &b.PublishBackend }},
+	{"PUBLISH_DEST", false, "", func(b *Builder) *string { return &b.PublishDest }},
+	{"PUBLISH_S3_ENDPOINT", false, "", func(b *Builder) *string { return &b.S3Endpoint }},
+	{"PUBLISH_S3_REGION", false, defaultS3Region, func(b *Builder) *string { return &b.S3Region }},
+	{"PUBLISH_S3_ACCESS_KEY", false, "", func(b *Builder) *string { return &b.S3AccessKey }},
+	{"PUBLISH_S3_SECRET_KEY", false, "", func(b *Builder) *string { return &b.S3SecretKey }},
+}
+
+// otherToolKeys are keys of builder.conf used by other tools sharing the
+// file, such as the chroot builder. They are accepted without a warning.
+var otherToolKeys = map[string]bool{
+	"BUNDLE":            true,
+	"CONTENTURL":        true,
+	"VERSIONURL":        true,
+	"DEBUG_INFO_BANNED": true,
+	"DEBUG_INFO_LIB":    true,
+	"DEBUG_INFO_SRC":    true,
+}
+
+// chrootBuilderSections are the keys of builder.conf read by the chroot
+// builder, with the section it reads each of them from
+var chrootBuilderSections = map[string]string{
+	"BUNDLE_DIR":       "Builder",
+	"CERT":             "Builder",
+	"SERVER_STATE_DIR": "Builder",
+	"VERSIONS_PATH":    "Builder",
+	"YUM_CONF":         "Builder",
+	"BUNDLE":           "swupd",
+	"CONTENTURL":       "swupd",
+	"FORMAT":           "swupd",
+	"VERSIONURL":       "swupd",
+}
+
+// findConfigKey returns the description of the key called name or nil
+func findConfigKey(name string) *configKey {
+	for i := range configKeys {
+		if configKeys[i].Name == name {
+			return &configKeys[i]
+		}
+	}
+	return nil
+}
+
+// ConfigError is returned when builder.conf is invalid. Line is zero for
+// errors that are not about a single line, such as a missing key.
+type ConfigError struct {
+	File string
+	Line int
+	Key  string
+	Err  error
+}
+
+func (e *ConfigError) Error() string {
+	msg := e.File
+	if e.Line > 0 {
+		msg += fmt.Sprintf(":%d", e.Line)
+	}
+	if e.Key != "" {
+		msg += ": " + e.Key
+	}
+	return fmt.Sprintf("%s: %v", msg, e.Err)
+}
+
+// ErrorCode returns the code identifying the error in events
+func (e *ConfigError) ErrorCode() string {
+	return "invalid-config"
+}
+
+// ConfigValue is the value of a builder.conf key along with where it came
+// from: the file and line, an environment variable or the default.
+type ConfigValue struct {
+	Key     string
+	Value   string
+	Section string
+	Source  string
+	Line    int
+}
+
+// Config is a parsed builder.conf
+type Config struct {
+	File   string
+	values map[string]*ConfigValue
+	// Warnings lists problems that do not prevent using the configuration,
+	// like unknown or duplicate keys
+	Warnings []string
+}
+
+// ReadConfig parses the builder.conf at path. The file is made of KEY = VALUE
+// lines, optionally grouped in [sections] that are only informative, since
+// key names are unique across the file. Lines starting with # or ; are
+// comments, as is anything after a # preceded by a space outside of quotes.
+// Values may be quoted with double quotes, allowing \" and \\ escapes, or
+// with single quotes, which are taken literally. ${NAME} in unquoted or
+// double quoted values is replaced by the value of a key defined earlier in
+// the file or else by the environment variable NAME. Every key can be
+// overridden by the environment variable MIXER_<KEY>. Keys mixer does not
+// know about are reported in Warnings.
+func ReadConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c := &Config{File: path, values: make(map[string]*ConfigValue)}
+	section := ""
+	line := 0
+	input := bufio.NewScanner(f)
+	for input.Scan() {
+		line++
+		text := strings.TrimSpace(input.Text())
+		if text == "" || text[0] == '#' || text[0] == ';' {
+			continue
+		}
+
+		if text[0] == '[' {
+			if !strings.HasSuffix(text, "]") {
+				return nil, &ConfigError{File: path, Line: line, Err: fmt.Errorf("invalid section header %q", text)}
+			}
+			section = strings.TrimSpace(text[1 : len(text)-1])
+			continue
+		}
+
+		eq := strings.IndexByte(text, '=')
+		if eq < 0 {
+			return nil, &ConfigError{File: path, Line: line, Err: fmt.Errorf("expected KEY = VALUE, found %q", text)}
+		}
+		key := strings.TrimSpace(text[:eq])
+		if key == "" {
+			return nil, &ConfigError{File: path, Line: line, Err: errors.New("missing key name")}
+		}
+		value, err := c.parseValue(strings.TrimSpace(text[eq+1:]))
+		if err != nil {
+			return nil, &ConfigError{File: path, Line: line, Key: key, Err: err}
+		}
+
+		if prev, ok := c.values[key]; ok {
+			c.Warnings = append(c.Warnings, fmt.Sprintf("%s:%d: %s already set on line %d, using the last value", path, line, key, prev.Line))
+		}
+		if findConfigKey(key) == nil && !otherToolKeys[key] {
+			c.Warnings = append(c.Warnings, fmt.Sprintf("%s:%d: unknown key %s", path, line, key))
+		}
+		c.values[key] = &ConfigValue{
+			Key:     key,
+			Value:   value,
+			Section: section,
+			Source:  fmt.Sprintf("%s:%d", path, line),
+			Line:    line,
+		}
+	}
+	if err = input.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, k := range configKeys {
+		env := ConfigEnvPrefix + k.Name
+		if value, ok := os.LookupEnv(env); ok {
+			c.values[k.Name] = &ConfigValue{Key: k.Name, Value: value, Source: "environment " + env}
+		}
+	}
+
+	if err = c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// parseValue unquotes and interpolates the raw value of a key
+func (c *Config) parseValue(raw string) (string, error) {
+	var value strings.Builder
+	for i := 0; i < len(raw); i++ {
+		ch := raw[i]
+		switch {
+		case ch == '#' && (i == 0 || raw[i-1] == ' ' || raw[i-1] == '\t'):
+			// Comment until the end of the line.
+			return strings.TrimSpace(value.String()), nil
+		case ch == '\'':
+			end := strings.IndexByte(raw[i+1:], '\'')
+			if end < 0 {
+				return "", errors.New("unterminated single quote")
+			}
+			value.WriteString(raw[i+1 : i+1+end])
+			i += end + 1
+		case ch == '"':
+			i++
+			for ; i < len(raw) && raw[i] != '"'; i++ {
+				switch {
+				case raw[i] == '\\' && i+1 < len(raw) && (raw[i+1] == '"' || raw[i+1] == '\\'):
+					i++
+					value.WriteByte(raw[i])
+				case raw[i] == '$' && strings.HasPrefix(raw[i:], "${"):
+					n, err := c.interpolate(raw[i:], &value)
+					if err != nil {
+						return "", err
+					}
+					i += n - 1
+				default:
+					value.WriteByte(raw[i])
+				}
+			}
+			if i == len(raw) {
+				return "", errors.New("unterminated double quote")
+			}
+		case ch == '$' && strings.HasPrefix(raw[i:], "${"):
+			n, err := c.interpolate(raw[i:], &value)
+			if err != nil {
+				return "", err
+			}
+			i += n - 1
+		default:
+			value.WriteByte(ch)
+		}
+	}
+	return value.String(), nil
+}
+
+// interpolate writes the value of the ${NAME} reference at the start of s to
+// value and returns the length of the reference
+func (c *Config) interpolate(s string, value *strings.Builder) (int, error) {
+	end := strings.IndexByte(s, '}')
+	if end < 0 {
+		return 0, fmt.Errorf("unterminated variable reference %q", s)
+	}
+	name := s[2:end]
+	if name == "" {
+		return 0, errors.New("empty variable reference ${}")
+	}
+	if v, ok := c.values[name]; ok {
+		// Overrides from the environment apply to references as well.
+		if env, ok := os.LookupEnv(ConfigEnvPrefix + name); ok && findConfigKey(name) != nil {
+			value.WriteString(env)
+		} else {
+			value.WriteString(v.Value)
+		}
+	} else if env, ok := os.LookupEnv(name); ok {
+		value.WriteString(env)
+	} else {
+		return 0, fmt.Errorf("undefined variable ${%s}", name)
+	}
+	return end + 1, nil
+}
+
+// validate checks that every required key has a value
+func (c *Config) validate() error {
+	for _, k := range configKeys {
+		if !k.Required {
+			continue
+		}
+		v, ok := c.values[k.Name]
+		if !ok {
+			return &ConfigError{File: c.File, Key: k.Name, Err: errors.New("missing required key")}
+		}
+		if v.Value == "" {
+			return &ConfigError{File: c.File, Line: v.Line, Key: k.Name, Err: errors.New("required key has an empty value")}
+		}
+	}
+	return nil
+}
+
+// Get returns the value of key, falling back to its default
+func (c *Config) Get(key string) string {
+	if v, ok := c.values[key]; ok {
+		return v.Value
+	}
+	if k := findConfigKey(key); k != nil {
+		return k.Default
+	}
+	return ""
+}
+
+// Values returns the value of every key known to mixer, including defaults,
+// and of the other keys set in the file, sorted by key name.
+func (c *Config) Values() []*ConfigValue {
+	var values []*ConfigValue
+	for _, k := range configKeys {
+		if _, ok := c.values[k.Name]; !ok {
+			values = append(values, &ConfigValue{Key: k.Name, Value: k.Default, Source: "default"})
+		}
+	}
+	for _, v := range c.values {
+		values = append(values, v)
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i].Key < values[j].Key })
+	return values
+}
+
+// versionFiles are the files of VERSIONS_PATH that take precedence over the
+// MIXVER and CLEARVER keys of builder.conf
+var versionFiles = map[string]string{
+	"MIXVER":   ".mixversion",
+	"CLEARVER": ".clearversion",
+}
+
+// secretKeys are the keys whose values are not shown
+var secretKeys = map[string]bool{
+	"PKCS11_PIN":            true,
+	"PUBLISH_S3_SECRET_KEY": true,
+}
+
+// quoteConfigValue returns value in a form ReadConfig reads back unchanged.
+// Values with spaces or special characters are single quoted, or double
+// quoted when they contain single quotes. Single quotes in values that also
+// contain a $ are written as "'" between single quoted parts.
+func quoteConfigValue(value string) string {
+	switch {
+	case !strings.ContainsAny(value, " \t#;'\"$\\"):
+		return value
+	case !strings.Contains(value, "'"):
+		return "'" + value + "'"
+	case !strings.Contains(value, "$"):
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+	default:
+		return "'" + strings.Replace(value, "'", `'"'"'`, -1) + "'"
+	}
+}
+
+// configLineKey returns the key set by a line of builder.conf, or an empty
+// string for comments, sections and invalid lines
+func configLineKey(line string) string {
+	text := strings.TrimSpace(line)
+	if text == "" || text[0] == '#' || text[0] == ';' || text[0] == '[' {
+		return ""
+	}
+	eq := strings.IndexByte(text, '=')
+	if eq < 0 {
+		return ""
+	}
+	return strings.TrimSpace(text[:eq])
+}
+
+// ShowConfig prints the effective configuration, with the version files
+// applied, in builder.conf format along with where each value comes from
+func (b *Builder) ShowConfig() error {
+	conf := b.Config
+	if conf == nil {
+		var err error
+		if conf, err = ReadConfig(b.Buildconf); err != nil {
+			return err
+		}
+	}
+
+	events.Info("# Configuration read from %s", conf.File)
+	for _, v := range conf.Values() {
+		value, source := v.Value, v.Source
+		if file, ok := versionFiles[v.Key]; ok {
+			path := filepath.Join(conf.Get("VERSIONS_PATH"), file)
+			if ver, err := ioutil.ReadFile(path); err == nil {
+				value, source = strings.TrimSpace(string(ver)), path
+			}
+		}
+		if secretKeys[v.Key] && value != "" {
+			value = "********"
+		}
+		events.Result(fmt.Sprintf("%-20s = %-40s # %s", v.Key, quoteConfigValue(value), source),
+			map[string]interface{}{"key": v.Key, "value": value, "source": source})
+	}
+	return nil
+}
+
+// writeChrootConfig writes the configuration as mixer resolved it to a
+// temporary file for the chroot builder and returns its path. The chroot
+// builder reads builder.conf with Python's ConfigParser, which knows nothing
+// of the environment overrides, interpolation, quoting and inline comments
+// of ReadConfig, so the file holds plain KEY = VALUE lines in the sections
+// the keys were set in. Secrets are left out.
+func (b *Builder) writeChrootConfig() (string, error) {
+	conf := b.Config
+	fromFields := conf != nil
+	if conf == nil {
+		var err error
+		if conf, err = ReadConfig(b.Buildconf); err != nil {
+			return "", err
+		}
+	}
+
+	values := make(map[string]*ConfigValue)
+	for k, v := range conf.values {
+		values[k] = v
+	}
+	// The fields hold the values mixer uses, which the chroot builder must
+	// use as well.
+	if fromFields {
+		for _, k := range configKeys {
+			value := *k.dest(b)
+			if v, ok := values[k.Name]; ok {
+				values[k.Name] = &ConfigValue{Key: k.Name, Value: value, Section: v.Section}
+			} else if _, ok := chrootBuilderSections[k.Name]; ok && value != "" {
+				values[k.Name] = &ConfigValue{Key: k.Name, Value: value}
+			}
+		}
+	}
+
+	sections := make(map[string][]string)
+	for _, v := range values {
+		if secretKeys[v.Key] {
+			continue
+		}
+		section := v.Section
+		if section == "" {
+			if section = chrootBuilderSections[v.Key]; section == "" {
+				section = "Builder"
+			}
+		}
+		sections[section] = append(sections[section], v.Key+" = "+v.Value)
+	}
+	names := make([]string, 0, len(sections))
+	for name := range sections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var content strings.Builder
+	fmt.Fprintf(&content, "# Resolved from %s by mixer\n", conf.File)
+	for _, name := range names {
+		lines := sections[name]
+		sort.Strings(lines)
+		fmt.Fprintf(&content, "\n[%s]\n%s\n", name, strings.Join(lines, "\n"))
+	}
+
+	f, err := ioutil.TempFile("", "mixer-builder-*.conf")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.WriteString(content.String())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// insertConfigLine adds setting to the lines of builder.conf at the end of
+// section, which is appended when missing. Without any section in the file
+// the setting is appended.
+func insertConfigLine(lines []string, section string, setting string) []string {
+	// The file ends with a newline, leaving an empty last line.
+	if n := len(lines); n > 0 && lines[n-1] == "" {
+		lines = lines[:n-1]
+	}
+	current := ""
+	sections := false
+	at := -1
+	for i, line := range lines {
+		text := strings.TrimSpace(line)
+		if strings.HasPrefix(text, "[") && strings.HasSuffix(text, "]") {
+			current = strings.TrimSpace(text[1 : len(text)-1])
+			sections = true
+			if current == section {
+				at = i
+			}
+			continue
+		}
+		if current == section && text != "" {
+			at = i
+		}
+	}
+
+	switch {
+	case at >= 0:
+		lines = append(lines[:at+1], append([]string{setting}, lines[at+1:]...)...)
+	case sections:
+		lines = append(lines, "", "["+section+"]", setting)
+	default:
+		lines = append(lines, setting)
+	}
+	return append(lines, "")
+}
+
+// SetConfig sets key to value in builder.conf, replacing the line setting it
+// or adding one to the section the key belongs in, while keeping the rest of
+// the file as it is. Values of keys also read by other tools must not need
+// quoting. MIXVER and CLEARVER are written to their version files instead,
+// since these take precedence.
+func (b *Builder) SetConfig(key string, value string) error {
+	if findConfigKey(key) == nil && !otherToolKeys[key] {
+		return fmt.Errorf("unknown key %s", key)
+	}
+	// A line break would end the setting and add lines of its own.
+	if strings.ContainsAny(value, "\n\r") {
+		return fmt.Errorf("invalid %s, values cannot contain line breaks", key)
+	}
+	// Other tools read the file with Python's ConfigParser, which keeps
+	// quotes as part of the value.
+	if _, shared := chrootBuilderSections[key]; (shared || otherToolKeys[key]) && quoteConfigValue(value) != value {
+		return fmt.Errorf("invalid %s, the value needs quoting, which other tools reading %s do not support", key, b.Buildconf)
+	}
+
+	if file, ok := versionFiles[key]; ok {
+		if _, err := strconv.ParseUint(value, 10, 32); err != nil {
+			return fmt.Errorf("invalid %s %q, expected a version number", key, value)
+		}
+		conf, err := ReadConfig(b.Buildconf)
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(conf.Get("VERSIONS_PATH"), file)
+		if err = ioutil.WriteFile(path, []byte(value), 0644); err != nil {
+			return err
+		}
+		events.Info("Set %s to %s in %s", key, value, path)
+		return nil
+	}
+
+	fi, err := os.Stat(b.Buildconf)
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(b.Buildconf)
+	if err != nil {
+		return err
+	}
+
+	setting := key + " = " + quoteConfigValue(value)
+	lines := strings.Split(string(content), "\n")
+	found := false
+	// The last line setting the key is the one in effect.
+	for i := len(lines) - 1; i >= 0; i-- {
+		if configLineKey(lines[i]) == key {
+			lines[i] = setting
+			found = true
+			break
+		}
+	}
+	if !found {
+		section := chrootBuilderSections[key]
+		if section == "" {
+			section = "Builder"
+		}
+		lines = insertConfigLine(lines, section, setting)
+	}
+
+	if err = ioutil.WriteFile(b.Buildconf, []byte(strings.Join(lines, "\n")), fi.Mode()); err != nil {
+		return err
+	}
+	events.Info("Set %s in %s", key, b.Buildconf)
+	if _, ok := os.LookupEnv(ConfigEnvPrefix + key); ok {
+		events.Warning("%s%s is set in the environment and overrides this value", ConfigEnvPrefix, key)
+	}
+	return nil
+}
+
+// Kinds of paths checked by ValidateConfig
+const (
+	// pathDir is a directory that must exist and be writable
+	pathDir = iota
+	// pathFile is a file that must exist
+	pathFile
+	// pathCreated is a file mixer creates when missing, it must be writable
+	// or be in a writable directory
+	pathCreated
+)
+
+// configPaths lists the keys holding paths and how ValidateConfig checks them
+var configPaths = []struct {
+	key  string
+	kind int
+}{
+	{"BUNDLE_DIR", pathDir},
+	{"SERVER_STATE_DIR", pathDir},
+	{"VERSIONS_PATH", pathDir},
+	{"REPODIR", pathDir},
+	{"RPMDIR", pathDir},
+	{"YUM_CONF", pathCreated},
+	{"CERT", pathCreated},
+	{"SIGNING_KEY", pathCreated},
+	{"PKCS11_MODULE", pathFile},
+}
+
+// checkWritableDir returns an error if dir is not a directory the current
+// user can create files in
+func checkWritableDir(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	f, err := ioutil.TempFile(dir, ".mixer-check-")
+	if err != nil {
+		return fmt.Errorf("%s is not writable", dir)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// checkPath checks path according to kind
+func checkPath(path string, kind int) error {
+	switch kind {
+	case pathDir:
+		return checkWritableDir(path)
+	case pathFile:
+		_, err := os.Stat(path)
+		return err
+	default:
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return checkWritableDir(filepath.Dir(path))
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			return fmt.Errorf("%s is not writable", path)
+		}
+		return f.Close()
+	}
+}
+
+// ValidateConfig checks builder.conf beyond what is needed to read it: the
+// configured paths must exist and be writable, KEY_ALGORITHM must be usable
+// for signing, and FORMAT and the versions of the mix must be numbers. It
+// returns every problem found, warnings about the file are printed.
+func (b *Builder) ValidateConfig() []error {
+	conf, err := ReadConfig(b.Buildconf)
+	if err != nil {
+		return []error{err}
+	}
+	for _, w := range conf.Warnings {
+		events.Warning("%s", w)
+	}
+
+	var errs []error
+	report := func(key string, err error) {
+		e := &ConfigError{File: conf.File, Key: key, Err: err}
+		if v, ok := conf.values[key]; ok {
+			e.Line = v.Line
+		}
+		errs = append(errs, e)
+	}
+
+	for _, p := range configPaths {
+		path := conf.Get(p.key)
+		if path == "" {
+			continue
+		}
+		if err := checkPath(path, p.kind); err != nil {
+			report(p.key, err)
+		}
+	}
+	if path := conf.Get("CERT"); path == "" {
+		report("CERT", errors.New("no certificate configured to sign the mix"))
+	}
+
+	if algorithm := conf.Get("KEY_ALGORITHM"); algorithm != "" {
+		if err := checkKeyAlgorithm(strings.ToLower(algorithm)); err != nil {
+			report("KEY_ALGORITHM", err)
+		}
+	}
+	if format := conf.Get("FORMAT"); format != "" {
+		if _, err := strconv.ParseUint(format, 10, 32); err != nil {
+			report("FORMAT", fmt.Errorf("invalid format %q, expected a number", format))
+		}
+	}
+	for _, key := range []string{"MIXVER", "CLEARVER"} {
+		path := filepath.Join(conf.Get("VERSIONS_PATH"), versionFiles[key])
+		ver, err := ioutil.ReadFile(path)
+		if err != nil {
+			report(key, fmt.Errorf("%v, run 'mixer init-mix' first", err))
+			continue
+		}
+		if _, err = strconv.ParseUint(strings.TrimSpace(string(ver)), 10, 32); err != nil {
+			report(key, fmt.Errorf("invalid version %q in %s", strings.TrimSpace(string(ver)), path))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,409 @@
+package builder
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"logger"
+)
+
+const requiredConf = `BUNDLE_DIR = /mix/bundles
+SERVER_STATE_DIR = /mix/update
+VERSIONS_PATH = /mix
+YUM_CONF = /mix/yum.conf
+`
+
+func writeConf(t *testing.T, dir string, content string) string {
+	path := filepath.Join(dir, "builder.conf")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv("CONFIG_TEST_HOME", "/home/mix")
+	defer os.Unsetenv("CONFIG_TEST_HOME")
+
+	tests := []struct {
+		name    string
+		content string
+		env     map[string]string
+		want    map[string]string
+	}{
+		{
+			"comments and sections",
+			"# comment\n; comment\n[Builder]\n" + requiredConf + "CERT = /mix/cert.pem # trailing comment\n",
+			nil,
+			map[string]string{"CERT": "/mix/cert.pem", "BUNDLE_DIR": "/mix/bundles"},
+		},
+		{
+			"quotes",
+			requiredConf + `CERT_COMMON_NAME = "My \"Mix\" # 1"` + "\nSIGNING_COMMAND = 'sign ${NOT_EXPANDED}'\n",
+			nil,
+			map[string]string{"CERT_COMMON_NAME": `My "Mix" # 1`, "SIGNING_COMMAND": "sign ${NOT_EXPANDED}"},
+		},
+		{
+			"interpolation",
+			"TOP = /mix\nBUNDLE_DIR = ${TOP}/bundles\nSERVER_STATE_DIR = \"${TOP}/update\"\nVERSIONS_PATH = ${CONFIG_TEST_HOME}\nYUM_CONF = ${TOP}/yum.conf\n",
+			nil,
+			map[string]string{"BUNDLE_DIR": "/mix/bundles", "SERVER_STATE_DIR": "/mix/update", "VERSIONS_PATH": "/home/mix"},
+		},
+		{
+			"environment overrides",
+			requiredConf + "CERT = /mix/cert.pem\nRPMDIR = ${SERVER_STATE_DIR}/rpms\n",
+			map[string]string{"MIXER_SERVER_STATE_DIR": "/other", "MIXER_CERT": "/other/cert.pem"},
+			map[string]string{"SERVER_STATE_DIR": "/other", "CERT": "/other/cert.pem", "RPMDIR": "/other/rpms"},
+		},
+		{
+			"defaults",
+			requiredConf,
+			nil,
+			map[string]string{"SIGNING_BACKEND": SigningBackendFile, "CERT_ORGANIZATION": defaultCertOrganization, "CERT": ""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				os.Setenv(k, v)
+				defer os.Unsetenv(k)
+			}
+			conf, err := ReadConfig(writeConf(t, dir, tt.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range tt.want {
+				if got := conf.Get(k); got != v {
+					t.Errorf("%s = %q, expected %q", k, got, v)
+				}
+			}
+		})
+	}
+}
+
+func TestReadConfigErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		content string
+		line    int
+		key     string
+	}{
+		{"missing required key", "BUNDLE_DIR = /mix/bundles\n", 0, "SERVER_STATE_DIR"},
+		{"empty required key", requiredConf + "YUM_CONF =\n", 5, "YUM_CONF"},
+		{"not a key value", requiredConf + "CERT /mix/cert.pem\n", 5, ""},
+		{"unterminated quote", requiredConf + "CERT = \"/mix/cert.pem\n", 5, "CERT"},
+		{"undefined variable", requiredConf + "CERT = ${CONFIG_TEST_UNDEFINED}/cert.pem\n", 5, "CERT"},
+		{"bad section", "[Builder\n" + requiredConf, 1, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadConfig(writeConf(t, dir, tt.content))
+			cerr, ok := err.(*ConfigError)
+			if !ok {
+				t.Fatalf("expected a ConfigError, got %v", err)
+			}
+			if cerr.Line != tt.line || cerr.Key != tt.key {
+				t.Errorf("error %q is for line %d key %q, expected line %d key %q", err, cerr.Line, cerr.Key, tt.line, tt.key)
+			}
+		})
+	}
+}
+
+func TestReadConfigWarnings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf, err := ReadConfig(writeConf(t, dir, requiredConf+"CONTENTURL = http://example.com\nCERTT = typo\nCERT = a\nCERT = b\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.Warnings) != 2 {
+		t.Fatalf("expected 2 warnings, got %q", conf.Warnings)
+	}
+	if !strings.Contains(conf.Warnings[0], ":6: unknown key CERTT") {
+		t.Errorf("unexpected warning %q", conf.Warnings[0])
+	}
+	if !strings.Contains(conf.Warnings[1], ":8: CERT already set on line 7") {
+		t.Errorf("unexpected warning %q", conf.Warnings[1])
+	}
+	if got := conf.Get("CERT"); got != "b" {
+		t.Errorf("CERT = %q, expected the last value", got)
+	}
+}
+
+func TestSetConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := New()
+	b.Buildconf = writeConf(t, dir, "# mix\n[Builder]\n"+requiredConf+"CERT = /mix/a.pem # old\nCERT = /mix/b.pem\n\n[swupd]\nCONTENTURL = http://example.com\n")
+
+	values := map[string]string{
+		"CERT":              "/mix/c.pem",
+		"CERT_COMMON_NAME":  "My mix # 1",
+		"CERT_ORGANIZATION": `It's "quoted" \ here`,
+		"SIGNING_COMMAND":   `sign '${MIXER_CERT}'`,
+		"VERSIONURL":        "http://example.com/version",
+	}
+	for k, v := range values {
+		if err = b.SetConfig(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = b.SetConfig("CERTT", "typo"); err == nil {
+		t.Error("expected an error setting an unknown key")
+	}
+	for _, v := range []string{"x\nSIGNING_BACKEND = command", "x\rSIGNING_BACKEND = command"} {
+		if err = b.SetConfig("CERT", v); err == nil {
+			t.Errorf("expected an error setting %q", v)
+		}
+	}
+	// The chroot builder would keep the quotes.
+	if err = b.SetConfig("CERT", "/my mix/cert.pem"); err == nil {
+		t.Error("expected an error setting a value that needs quoting for the chroot builder")
+	}
+
+	conf, err := ReadConfig(b.Buildconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range values {
+		if got := conf.Get(k); got != v {
+			t.Errorf("%s = %q, expected %q", k, got, v)
+		}
+	}
+
+	content, err := ioutil.ReadFile(b.Buildconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(content), "\n")
+	if lines[0] != "# mix" || lines[6] != "CERT = /mix/a.pem # old" || lines[7] != "CERT = /mix/c.pem" {
+		t.Errorf("unexpected content after setting keys:\n%s", content)
+	}
+	// New keys are added to the section they belong in.
+	sections := make(map[string]string)
+	section := ""
+	for _, line := range lines {
+		if strings.HasPrefix(line, "[") {
+			section = line
+		} else if key := configLineKey(line); key != "" {
+			sections[key] = section
+		}
+	}
+	for _, key := range []string{"CERT_COMMON_NAME", "CERT_ORGANIZATION", "SIGNING_COMMAND"} {
+		if sections[key] != "[Builder]" {
+			t.Errorf("%s added to section %q, expected [Builder]:\n%s", key, sections[key], content)
+		}
+	}
+	if sections["VERSIONURL"] != "[swupd]" {
+		t.Errorf("VERSIONURL added to section %q, expected [swupd]:\n%s", sections["VERSIONURL"], content)
+	}
+}
+
+func TestInsertConfigLine(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{"no section", "A = 1\n", "A = 1\nKEY = value\n"},
+		{"missing section", "[Builder]\nA = 1\n", "[Builder]\nA = 1\n\n[swupd]\nKEY = value\n"},
+		{"empty section", "[swupd]\n\n[Builder]\nA = 1\n", "[swupd]\nKEY = value\n\n[Builder]\nA = 1\n"},
+		{"section", "[swupd]\nA = 1\n\n[Other]\nB = 2", "[swupd]\nA = 1\nKEY = value\n\n[Other]\nB = 2\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lines := insertConfigLine(strings.Split(tt.content, "\n"), "swupd", "KEY = value")
+			if got := strings.Join(lines, "\n"); got != tt.expected {
+				t.Errorf("got\n%q\nexpected\n%q", got, tt.expected)
+			}
+		})
+	}
+}
+
+// writeValidConf writes a builder.conf whose paths all exist in dir,
+// followed by extra, along with the version files
+func writeValidConf(t *testing.T, dir string, extra string) string {
+	for _, d := range []string{"bundles", "update"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for file, ver := range map[string]string{".mixversion": "20", ".clearversion": "21000"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(ver+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return writeConf(t, dir, "BUNDLE_DIR = "+filepath.Join(dir, "bundles")+"\n"+
+		"SERVER_STATE_DIR = "+filepath.Join(dir, "update")+"\n"+
+		"VERSIONS_PATH = "+dir+"\n"+
+		"YUM_CONF = "+filepath.Join(dir, "yum.conf")+"\n"+
+		"CERT = "+filepath.Join(dir, "Swupd_Root.pem")+"\n"+extra)
+}
+
+func TestValidateConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name  string
+		extra string
+		keys  []string
+	}{
+		{"valid", "KEY_ALGORITHM = ECDSA\nFORMAT = 3\n", nil},
+		{"missing directory", "REPODIR = " + filepath.Join(dir, "missing") + "\n", []string{"REPODIR"}},
+		{"missing PKCS#11 module", "PKCS11_MODULE = " + filepath.Join(dir, "missing.so") + "\n", []string{"PKCS11_MODULE"}},
+		{"ed25519 key", "KEY_ALGORITHM = ed25519\n", []string{"KEY_ALGORITHM"}},
+		{"invalid format", "FORMAT = three\n", []string{"FORMAT"}},
+		{"no certificate", "CERT =\nFORMAT = -1\n", []string{"CERT", "FORMAT"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := New()
+			b.Buildconf = writeValidConf(t, dir, tt.extra)
+			var keys []string
+			for _, err := range b.ValidateConfig() {
+				cerr, ok := err.(*ConfigError)
+				if !ok {
+					t.Fatalf("expected a ConfigError, got %v", err)
+				}
+				keys = append(keys, cerr.Key)
+			}
+			if strings.Join(keys, " ") != strings.Join(tt.keys, " ") {
+				t.Errorf("errors for %v, expected %v", keys, tt.keys)
+			}
+		})
+	}
+
+	b := New()
+	b.Buildconf = writeValidConf(t, dir, "")
+	if err = ioutil.WriteFile(filepath.Join(dir, ".mixversion"), []byte("twenty"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if errs := b.ValidateConfig(); len(errs) != 1 || errs[0].(*ConfigError).Key != "MIXVER" {
+		t.Errorf("expected an error for MIXVER, got %v", errs)
+	}
+}
+
+func TestShowConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := New()
+	b.Buildconf = writeValidConf(t, dir, "PKCS11_PIN = 123456\nPUBLISH_S3_SECRET_KEY = wJalrXUtnFEMI\nCERT_COMMON_NAME = My mix\n")
+	var out bytes.Buffer
+	logger.SetConsole(&out, &out)
+	defer logger.SetConsole(os.Stdout, os.Stderr)
+	if err = b.ShowConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	text := out.String()
+	for _, secret := range []string{"123456", "wJalrXUtnFEMI"} {
+		if strings.Contains(text, secret) {
+			t.Errorf("secret value %s shown:\n%s", secret, text)
+		}
+	}
+	expected := []string{
+		"PKCS11_PIN           = ********",
+		"CERT_COMMON_NAME     = 'My mix'",
+		"MIXVER               = 20",
+		"# " + filepath.Join(dir, ".mixversion"),
+		"# " + b.Buildconf + ":",
+	}
+	for _, e := range expected {
+		if !strings.Contains(text, e) {
+			t.Errorf("expected %q in the configuration:\n%s", e, text)
+		}
+	}
+}
+
+func TestWriteChrootConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	old, set := os.LookupEnv(ConfigEnvPrefix + "SERVER_STATE_DIR")
+	os.Setenv(ConfigEnvPrefix+"SERVER_STATE_DIR", "/other/update")
+	defer func() {
+		if set {
+			os.Setenv(ConfigEnvPrefix+"SERVER_STATE_DIR", old)
+		} else {
+			os.Unsetenv(ConfigEnvPrefix + "SERVER_STATE_DIR")
+		}
+	}()
+
+	b := New()
+	b.Buildconf = writeConf(t, dir, `[Builder]
+VERSIONS_PATH = /mix
+BUNDLE_DIR = ${VERSIONS_PATH}/bundles # inline comment
+SERVER_STATE_DIR = /mix/update
+YUM_CONF = "/mix/yum.conf"
+PKCS11_PIN = 1234
+
+[swupd]
+CONTENTURL = 'http://example.com/update'
+`)
+	if err = b.ReadBuilderConf(); err != nil {
+		t.Fatal(err)
+	}
+	b.Format = "3"
+	path, err := b.writeChrootConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "# Resolved from " + b.Buildconf + ` by mixer
+
+[Builder]
+BUNDLE_DIR = /mix/bundles
+SERVER_STATE_DIR = /other/update
+VERSIONS_PATH = /mix
+YUM_CONF = /mix/yum.conf
+
+[swupd]
+CONTENTURL = http://example.com/update
+FORMAT = 3
+`
+	if string(content) != expected {
+		t.Errorf("unexpected configuration for the chroot builder:\n%s\nexpected\n%s", content, expected)
+	}
+}
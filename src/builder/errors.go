@@ -0,0 +1,39 @@
+package builder
+
+// codedError is an error with a code reported in the JSON output
+type codedError struct {
+	code string
+	msg  string
+}
+
+func (e *codedError) Error() string {
+	return e.msg
+}
+
+// ErrorCode returns the code identifying the error in events
+func (e *codedError) ErrorCode() string {
+	return e.code
+}
+
+// Errors returned by the Builder, possibly wrapped with more details. They
+// can be told apart with errors.Is.
+var (
+	// ErrNoBuilderConf is returned when no builder.conf was given and there
+	// is none in the current directory
+	ErrNoBuilderConf error = &codedError{"no-builder-conf", "cannot find any builder.conf to use"}
+
+	// ErrNotInitialized is returned when the versions or the bundles of the
+	// mix are missing because the mix was not initialized with init-mix
+	ErrNotInitialized error = &codedError{"not-initialized", "mix is not initialized, run 'mixer init-mix'"}
+
+	// ErrBundleNotFound is returned when adding a bundle that does not exist
+	// in the Clear Linux version of the mix
+	ErrBundleNotFound error = &codedError{"bundle-not-found", "bundle not found"}
+
+	// ErrInvalidRPM is returned when adding a file that is not a valid RPM
+	ErrInvalidRPM error = &codedError{"invalid-rpm", "invalid RPM, make sure it was built correctly"}
+
+	// ErrInvalidContent is returned when the manifests, fullfiles and packs
+	// of a version do not match each other
+	ErrInvalidContent error = &codedError{"invalid-content", "invalid update content"}
+)
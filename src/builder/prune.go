@@ -0,0 +1,204 @@
+package builder
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"syscall"
+
+	"events"
+	"logger"
+	"swupd"
+)
+
+// PruneInfo summarizes what Prune removed, or would remove in a dry run
+type PruneInfo struct {
+	// Versions are the versions pruned
+	Versions []uint32 `json:"versions"`
+	// Files is the number of files removed, Bytes the space reclaimed
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+	// Kept is the number of files of pruned versions kept because a
+	// retained version still needs them
+	Kept int `json:"kept"`
+}
+
+// versionDirs returns the versions with a directory in dir, sorted
+func versionDirs(dir string) ([]uint32, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var versions []uint32
+	for _, e := range entries {
+		if ver, err := strconv.ParseUint(e.Name(), 10, 32); err == nil && e.IsDir() {
+			versions = append(versions, uint32(ver))
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	return versions, nil
+}
+
+// retainedVersions returns the keep most recent versions with a
+// Manifest.MoM, along with the latest versions of every format
+func (b *Builder) retainedVersions(keep int) (map[uint32]bool, error) {
+	versions, err := versionDirs(filepath.Join(b.Statedir, "www"))
+	if err != nil {
+		return nil, err
+	}
+	retained := make(map[uint32]bool)
+	for i := len(versions) - 1; i >= 0 && len(retained) < keep; i-- {
+		mom := filepath.Join(b.Statedir, "www", fmt.Sprint(versions[i]), "Manifest."+swupd.MoMName)
+		if _, err = os.Stat(mom); err == nil {
+			retained[versions[i]] = true
+		}
+	}
+
+	latest, err := b.latestVersions()
+	if err != nil {
+		return nil, err
+	}
+	for ver := range latest {
+		retained[ver] = true
+	}
+	return retained, nil
+}
+
+// pruner removes the files of pruned versions, counting the space reclaimed.
+// Files with several hard links only free space once all their links are
+// removed, as is usual for chroots.
+type pruner struct {
+	dryRun bool
+	info   *PruneInfo
+	// links counts the links removed of each inode with several links
+	links map[uint64]uint64
+}
+
+func (p *pruner) remove(path string, fi os.FileInfo) error {
+	p.info.Files++
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && st.Nlink > 1 {
+		p.links[st.Ino]++
+		if p.links[st.Ino] == uint64(st.Nlink) {
+			p.info.Bytes += fi.Size()
+		}
+	} else {
+		p.info.Bytes += fi.Size()
+	}
+
+	if p.dryRun {
+		logger.Debug("Would remove %s", path)
+		return nil
+	}
+	logger.Debug("Removing %s", path)
+	return os.Remove(path)
+}
+
+// pruneDir removes the files in dir for which keep returns false, along with
+// the directories left empty
+func (p *pruner) pruneDir(dir string, keep func(path string) bool) error {
+	var dirs []string
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			dirs = append(dirs, path)
+			return nil
+		}
+		if keep != nil && keep(path) {
+			p.info.Kept++
+			return nil
+		}
+		return p.remove(path, fi)
+	})
+	if err != nil || p.dryRun {
+		return err
+	}
+
+	// Remove the deepest directories first, those still holding kept files
+	// stay.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if entries, err := ioutil.ReadDir(dirs[i]); err == nil && len(entries) == 0 {
+			if err = os.Remove(dirs[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Prune removes the chroots and update content of old versions, keeping the
+// keep most recent versions and the latest published ones. Versions more
+// recent than the retained ones, like a version being built, are left
+// alone. Manifests, packs, fullfiles and delta files of pruned versions that
+// the retained versions still need are kept. With dryRun nothing is removed,
+// the returned PruneInfo tells what would be.
+func (b *Builder) Prune(keep int, dryRun bool) (*PruneInfo, error) {
+	if keep < 1 {
+		return nil, fmt.Errorf("invalid number of versions to keep %d, at least one must be kept", keep)
+	}
+
+	retained, err := b.retainedVersions(keep)
+	if err != nil {
+		return nil, err
+	}
+	var newest uint32
+	refs := swupd.NewReferences()
+	for ver := range retained {
+		if err = refs.AddVersion(b.Statedir, ver); err != nil {
+			return nil, fmt.Errorf("cannot read the content of version %d: %v", ver, err)
+		}
+		if ver > newest {
+			newest = ver
+		}
+	}
+
+	wwwdir := filepath.Join(b.Statedir, "www")
+	imagedir := filepath.Join(b.Statedir, "image")
+	pruned := make(map[uint32]bool)
+	for _, dir := range []string{wwwdir, imagedir} {
+		versions, err := versionDirs(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, ver := range versions {
+			if ver < newest && !retained[ver] {
+				pruned[ver] = true
+			}
+		}
+	}
+
+	p := &pruner{dryRun: dryRun, info: &PruneInfo{}, links: make(map[uint64]uint64)}
+	for ver := range pruned {
+		p.info.Versions = append(p.info.Versions, ver)
+	}
+	sort.Slice(p.info.Versions, func(i, j int) bool { return p.info.Versions[i] < p.info.Versions[j] })
+
+	keepReferenced := func(path string) bool {
+		rel, err := filepath.Rel(wwwdir, path)
+		return err == nil && refs.Referenced(rel)
+	}
+	for _, ver := range p.info.Versions {
+		files, bytes, kept := p.info.Files, p.info.Bytes, p.info.Kept
+		for _, dir := range []string{filepath.Join(wwwdir, fmt.Sprint(ver)), filepath.Join(imagedir, fmt.Sprint(ver))} {
+			if _, err = os.Stat(dir); os.IsNotExist(err) {
+				continue
+			}
+			if err = p.pruneDir(dir, keepReferenced); err != nil {
+				return p.info, err
+			}
+		}
+		verb := "Pruned"
+		if dryRun {
+			verb = "Would prune"
+		}
+		events.Info("%s version %d: %d files, %d kB (%d files still needed)",
+			verb, ver, p.info.Files-files, (p.info.Bytes-bytes)/1024, p.info.Kept-kept)
+	}
+	return p.info, nil
+}
@@ -0,0 +1,183 @@
+package builder
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"swupd"
+)
+
+// buildTestVersion builds the manifests, fullfiles and zero packs of version
+// in statedir, where os-core changes in every version and editors never does
+func buildTestVersion(t *testing.T, statedir string, version uint32) {
+	buildTestEditor(t, statedir, version, "editor")
+}
+
+// buildTestEditor builds version like buildTestVersion, with editor as the
+// content of the editors bundle
+func buildTestEditor(t *testing.T, statedir string, version uint32, editor string) {
+	files := map[string]string{
+		"os-core/usr/bin/core":   fmt.Sprint("core ", version),
+		"editors/usr/bin/editor": editor,
+		"full/usr/bin/core":      fmt.Sprint("core ", version),
+		"full/usr/bin/editor":    editor,
+	}
+	for name, content := range files {
+		path := filepath.Join(statedir, "image", fmt.Sprint(version), name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := swupd.CreateManifests(version, 0, 1, statedir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := swupd.CreateFullfiles(statedir, version, 1); err != nil {
+		t.Fatal(err)
+	}
+	packs, err := swupd.ZeroPacks(statedir, version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = swupd.CreatePacks(statedir, packs, false, 1); err != nil {
+		t.Fatal(err)
+	}
+	last := filepath.Join(statedir, "image", "LAST_VER")
+	if err = ioutil.WriteFile(last, []byte(fmt.Sprint(version)), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prune-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, ver := range []uint32{10, 20, 30} {
+		buildTestVersion(t, dir, ver)
+	}
+	// Chroots of a version being built are left alone.
+	if err = os.MkdirAll(filepath.Join(dir, "image", "40", "full"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	b := New()
+	b.Statedir = dir
+	if _, err = b.Prune(0, false); err == nil {
+		t.Error("expected an error when keeping no version")
+	}
+
+	dryRun, err := b.Prune(1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dryRun.Versions) != 2 || dryRun.Files == 0 || dryRun.Bytes == 0 || dryRun.Kept == 0 {
+		t.Errorf("unexpected dry run result %+v", dryRun)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "www", "10", "Manifest.MoM")); err != nil {
+		t.Errorf("dry run removed files: %v", err)
+	}
+
+	info, err := b.Prune(1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Files != dryRun.Files || info.Bytes != dryRun.Bytes || info.Kept != dryRun.Kept {
+		t.Errorf("pruned %+v, dry run announced %+v", info, dryRun)
+	}
+
+	for _, path := range []string{"image/10", "image/20", "www/10/Manifest.MoM", "www/10/Manifest.os-core", "www/20"} {
+		if _, err = os.Stat(filepath.Join(dir, path)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed: %v", path, err)
+		}
+	}
+	for _, path := range []string{"image/30", "image/40", "www/30/Manifest.MoM", "www/10/Manifest.editors", "www/10/pack-editors-from-0.tar"} {
+		if _, err = os.Stat(filepath.Join(dir, path)); err != nil {
+			t.Errorf("expected %s to be kept: %v", path, err)
+		}
+	}
+
+	// The retained version is still complete.
+	problems, err := b.versionProblems(30)
+	if err != nil || len(problems) != 0 {
+		t.Errorf("version 30 is incomplete after pruning: %v %v", problems, err)
+	}
+	missing := 0
+	refs := swupd.NewReferences()
+	if err = refs.AddVersion(dir, 30); err != nil {
+		t.Fatal(err)
+	}
+	err = filepath.Walk(filepath.Join(dir, "www", "10"), func(path string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			rel, _ := filepath.Rel(filepath.Join(dir, "www"), path)
+			if !refs.Referenced(rel) {
+				missing++
+			}
+		}
+		return err
+	})
+	if err != nil || missing != 0 {
+		t.Errorf("%d unreferenced files left in version 10: %v", missing, err)
+	}
+}
+
+func TestPruneKeepsDeltaPacks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prune-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Editors changes in 30, which is pruned while the published 20 and the
+	// most recent 40 are retained: updating 20 to 40 needs the pack from
+	// editors 10 to 30, stored in version 30.
+	buildTestVersion(t, dir, 10)
+	buildTestVersion(t, dir, 20)
+	buildTestEditor(t, dir, 30, "new editor")
+	buildTestEditor(t, dir, 40, "new editor")
+	for _, from := range []uint32{20, 30} {
+		packs, err := swupd.DeltaPacks(dir, from, from+10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = swupd.CreatePacks(dir, packs, false, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	latest := filepath.Join(dir, "www", "version", "format1", "latest")
+	if err = os.MkdirAll(filepath.Dir(latest), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(latest, []byte("20\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b := New()
+	b.Statedir = dir
+	info, err := b.Prune(1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Versions) != 2 || info.Versions[0] != 10 || info.Versions[1] != 30 {
+		t.Fatalf("expected versions 10 and 30 to be pruned, got %v", info.Versions)
+	}
+
+	for _, path := range []string{"www/30/pack-editors-from-10.tar", "www/30/Manifest.editors", "www/30/pack-editors-from-0.tar", "www/10/Manifest.editors"} {
+		if _, err = os.Stat(filepath.Join(dir, path)); err != nil {
+			t.Errorf("expected %s to be kept: %v", path, err)
+		}
+	}
+	for _, path := range []string{"www/30/pack-os-core-from-20.tar", "www/30/Manifest.os-core", "www/30/Manifest.MoM", "www/10/Manifest.os-core"} {
+		if _, err = os.Stat(filepath.Join(dir, path)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed: %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package builder
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"events"
+	"helpers"
+	"logger"
+	"swupd"
+)
+
+// Publish backends that can be selected with PUBLISH_BACKEND in builder.conf
+const (
+	PublishBackendLocal = "local"
+	PublishBackendRsync = "rsync"
+	PublishBackendS3    = "s3"
+)
+
+// A Publisher copies update content to where clients download it from. Names
+// are slash separated paths relative to the root of the update content, the
+// www directory of the state directory.
+type Publisher interface {
+	// PublishDir copies the files in the local directory dir, recursively,
+	// to the directory name
+	PublishDir(dir string, name string) error
+	// PublishFile copies the local file at path to name
+	PublishFile(path string, name string) error
+	// PublishFiles copies the files at names, relative to the local
+	// directory root, to the same names
+	PublishFiles(root string, names []string) error
+}
+
+// NewPublisher returns the Publisher for the backend configured in
+// builder.conf. Publishing defaults to the local backend.
+func (b *Builder) NewPublisher() (Publisher, error) {
+	if b.PublishDest == "" {
+		return nil, errors.New("PUBLISH_DEST must be set to publish")
+	}
+
+	switch b.PublishBackend {
+	case "", PublishBackendLocal:
+		return &localPublisher{root: b.PublishDest}, nil
+	case PublishBackendRsync:
+		return &rsyncPublisher{dest: strings.TrimSuffix(b.PublishDest, "/")}, nil
+	case PublishBackendS3:
+		return b.newS3Publisher()
+	default:
+		return nil, fmt.Errorf("unknown publish backend %q", b.PublishBackend)
+	}
+}
+
+// referencedFiles returns the files of older versions that version refers
+// to, such as the manifests, zero packs and fullfiles of the bundles that did
+// not change in version, as slash separated paths relative to the www
+// directory
+func (b *Builder) referencedFiles(version uint32) ([]string, error) {
+	refs := swupd.NewReferences()
+	if err := refs.AddVersion(b.Statedir, version); err != nil {
+		return nil, err
+	}
+	wwwDir := filepath.Join(b.Statedir, "www")
+	prefix := fmt.Sprint(version) + string(filepath.Separator)
+	var names []string
+	for _, name := range refs.Paths() {
+		if strings.HasPrefix(name, prefix) {
+			continue
+		}
+		// Signatures and manifest archives are not created for every
+		// version.
+		if _, err := os.Stat(filepath.Join(wwwDir, name)); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		names = append(names, filepath.ToSlash(name))
+	}
+	return names, nil
+}
+
+// Publish copies version, which must be complete, to the publish
+// destination along with the content of older versions it refers to, and
+// then makes it the latest version of its format there. The latest version is
+// only updated once all the content is published, so that clients never see
+// a partially published version.
+func (b *Builder) Publish(version string) error {
+	ver, err := b.checkPublish(version)
+	var p Publisher
+	if err == nil {
+		p, err = b.NewPublisher()
+	}
+	var older []string
+	if err == nil {
+		older, err = b.referencedFiles(ver)
+	}
+	if err != nil {
+		helpers.PrintError(err)
+		return err
+	}
+	versionDir := filepath.Join(b.Statedir, "www", version)
+	var mom swupd.MoM
+	if err = mom.ReadMoMFromFile(filepath.Join(versionDir, "Manifest."+swupd.MoMName)); err != nil {
+		helpers.PrintError(err)
+		return err
+	}
+
+	step := events.StartStep("upload", fmt.Sprintf("Publishing version %s to %s", version, b.PublishDest))
+	if len(older) > 0 {
+		logger.Debug("Publishing %d files of older versions referenced by version %s", len(older), version)
+		if err = p.PublishFiles(filepath.Join(b.Statedir, "www"), older); err != nil {
+			step.Fail(err)
+			return err
+		}
+	}
+	if err = p.PublishDir(versionDir, version); err != nil {
+		step.Fail(err)
+		return err
+	}
+
+	latest, err := ioutil.TempFile("", "mixer-latest-")
+	if err != nil {
+		step.Fail(err)
+		return err
+	}
+	defer os.Remove(latest.Name())
+	_, err = latest.WriteString(version)
+	if cerr := latest.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = p.PublishFile(latest.Name(), fmt.Sprintf("version/format%d/latest", mom.Header.Format))
+	}
+	if err != nil {
+		step.Fail(err)
+		return err
+	}
+	step.Finish("", map[string]interface{}{"version": version, "destination": b.PublishDest, "referenced_files": len(older)})
+	events.VersionPublished(version, fmt.Sprint(mom.Header.Format))
+	return nil
+}
+
+// checkPublish returns the number of version, or an error if it cannot be
+// published
+func (b *Builder) checkPublish(version string) (uint32, error) {
+	ver, err := strconv.ParseUint(version, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid version %q: %v", version, err)
+	}
+	problems, err := b.versionProblems(uint32(ver))
+	if err != nil {
+		return 0, fmt.Errorf("cannot publish version %s: %v", version, err)
+	}
+	if len(problems) > 0 {
+		return 0, fmt.Errorf("cannot publish incomplete version %s: %s", version, strings.Join(problems, ", "))
+	}
+	return uint32(ver), nil
+}
+
+// localPublisher copies the content to a directory, like one served by a
+// web server or mounted from it
+type localPublisher struct {
+	root string
+}
+
+func (p *localPublisher) PublishDir(dir string, name string) error {
+	return filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(p.root, filepath.FromSlash(name), rel)
+		switch {
+		case fi.IsDir():
+			return os.MkdirAll(dest, 0755)
+		case fi.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			os.Remove(dest)
+			return os.Symlink(target, dest)
+		default:
+			return copyFileAtomic(dest, path)
+		}
+	})
+}
+
+func (p *localPublisher) PublishFile(path string, name string) error {
+	dest := filepath.Join(p.root, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	return copyFileAtomic(dest, path)
+}
+
+func (p *localPublisher) PublishFiles(root string, names []string) error {
+	for _, name := range names {
+		if err := p.PublishFile(filepath.Join(root, filepath.FromSlash(name)), name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFileAtomic copies src to dest through a temporary file renamed once
+// complete, so that dest is never seen partially written
+func copyFileAtomic(dest string, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := ioutil.TempFile(filepath.Dir(dest), "."+filepath.Base(dest)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Chmod(out.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), dest)
+}
+
+// rsyncPublisher copies the content with rsync, to a local path, a remote
+// host through SSH (host:path) or an rsync daemon (rsync://host/module)
+type rsyncPublisher struct {
+	dest string
+}
+
+func (p *rsyncPublisher) rsync(args ...string) error {
+	// With --delay-updates the files are only put in place once all of them
+	// are transferred, so a version is never seen partially copied.
+	cmd := exec.Command("rsync", append([]string{"-a", "--delay-updates"}, args...)...)
+	logger.Debug("Running %s", strings.Join(cmd.Args, " "))
+	cmd.Stdout = logger.Stdout()
+	cmd.Stderr = logger.Stderr()
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("rsync failed: %v", err)
+	}
+	return nil
+}
+
+func (p *rsyncPublisher) PublishDir(dir string, name string) error {
+	return p.rsync(dir+"/", p.dest+"/"+name+"/")
+}
+
+func (p *rsyncPublisher) PublishFile(path string, name string) error {
+	// rsync only creates the last directory of the destination, so the file
+	// is staged in a tree matching the destination.
+	stage, err := ioutil.TempDir("", "mixer-publish-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(stage)
+	// The permissions of the stage are those the destination gets.
+	if err = os.Chmod(stage, 0755); err != nil {
+		return err
+	}
+	staged := filepath.Join(stage, filepath.FromSlash(name))
+	if err = os.MkdirAll(filepath.Dir(staged), 0755); err != nil {
+		return err
+	}
+	if err = copyFileAtomic(staged, path); err != nil {
+		return err
+	}
+	return p.rsync(stage+"/", p.dest+"/")
+}
+
+func (p *rsyncPublisher) PublishFiles(root string, names []string) error {
+	list, err := ioutil.TempFile("", "mixer-publish-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(list.Name())
+	_, err = list.WriteString(strings.Join(names, "\n") + "\n")
+	if cerr := list.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	// The files are copied in a single run, with their directories.
+	return p.rsync("--files-from="+list.Name(), root+"/", p.dest+"/")
+}
@@ -0,0 +1,136 @@
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"events"
+)
+
+// ReportFile is the name of the build report saved next to the content of
+// the version in www
+const ReportFile = "build-report.json"
+
+// StepReport is what a build step took and produced
+type StepReport struct {
+	Name  string    `json:"name"`
+	Start time.Time `json:"start"`
+	// Duration is the wall time of the step in seconds
+	Duration float64 `json:"duration"`
+	// Files and Packs are the number of files and packs written, Bytes is
+	// their total size
+	Files int   `json:"files,omitempty"`
+	Packs int   `json:"packs,omitempty"`
+	Bytes int64 `json:"bytes,omitempty"`
+}
+
+// BuildReport lists the steps of the build of a version, in the order they
+// ran
+type BuildReport struct {
+	Version  string        `json:"version"`
+	Start    time.Time     `json:"start"`
+	Duration float64       `json:"duration"`
+	Steps    []*StepReport `json:"steps"`
+}
+
+// startReport starts collecting the steps of the build of the mix version,
+// unless they are already collected, as when build-all builds the chroots
+// before the update
+func (b *Builder) startReport() {
+	if b.report == nil || b.report.Version != b.Mixver {
+		b.report = &BuildReport{Version: b.Mixver, Start: time.Now()}
+	}
+}
+
+// finishStep reports the end of step, with the files, packs and bytes of
+// result added to data, and adds the step to the report of the build if one
+// is collected
+func (b *Builder) finishStep(step *events.Step, message string, result StepReport, data map[string]interface{}) {
+	result.Name = step.Name
+	result.Start = step.Start
+	result.Duration = time.Since(step.Start).Seconds()
+	if b.report != nil {
+		b.report.Steps = append(b.report.Steps, &result)
+	}
+
+	if data == nil {
+		data = make(map[string]interface{})
+	}
+	if result.Files > 0 {
+		data["files"] = result.Files
+	}
+	if result.Packs > 0 {
+		data["packs"] = result.Packs
+	}
+	if result.Bytes > 0 {
+		data["bytes"] = result.Bytes
+	}
+	step.Finish(message, data)
+}
+
+// filesUsage returns the number and total size of the regular files matching
+// pattern
+func filesUsage(pattern string) (int, int64, error) {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return 0, 0, err
+	}
+	var count int
+	var size int64
+	for _, m := range matches {
+		fi, err := os.Lstat(m)
+		if err != nil {
+			return 0, 0, err
+		}
+		if fi.Mode().IsRegular() {
+			count++
+			size += fi.Size()
+		}
+	}
+	return count, size, nil
+}
+
+// String formats the report as a table
+func (r *BuildReport) String() string {
+	var text strings.Builder
+	fmt.Fprintf(&text, "Build report for version %s:\n", r.Version)
+	fmt.Fprintf(&text, "  %-15s %12s %10s %8s %12s\n", "Step", "Time", "Files", "Packs", "Size")
+	for _, s := range r.Steps {
+		fmt.Fprintf(&text, "  %-15s %12s %10d %8d %9d kB\n", s.Name, formatSeconds(s.Duration), s.Files, s.Packs, s.Bytes/1024)
+	}
+	fmt.Fprintf(&text, "  %-15s %12s", "Total", formatSeconds(r.Duration))
+	return text.String()
+}
+
+// formatSeconds formats a duration in seconds to a tenth of a second
+func formatSeconds(seconds float64) string {
+	return time.Duration(seconds * float64(time.Second)).Round(100 * time.Millisecond).String()
+}
+
+// finishReport shows the report of the build and saves it as ReportFile in
+// the www directory of the version
+func (b *Builder) finishReport() error {
+	r := b.report
+	if r == nil {
+		return nil
+	}
+	b.report = nil
+	r.Duration = time.Since(r.Start).Seconds()
+
+	content, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(b.Statedir, "www", r.Version, ReportFile)
+	if err = ioutil.WriteFile(path, append(content, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to save build report: %v", err)
+	}
+
+	events.Result(r.String(), map[string]interface{}{"report": r, "path": path})
+	return nil
+}
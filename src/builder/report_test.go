@@ -0,0 +1,71 @@
+package builder
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"events"
+)
+
+func TestBuildReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "report-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wwwdir := filepath.Join(dir, "www", "10")
+	if err = os.MkdirAll(wwwdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{"Manifest.MoM": "mom", "Manifest.os-core": "core!", "other": "x"} {
+		if err = ioutil.WriteFile(filepath.Join(wwwdir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := New()
+	b.Statedir = dir
+	b.Mixver = "10"
+
+	// Steps outside of a build are not reported.
+	b.finishStep(events.StartStep("packs", ""), "", StepReport{Packs: 1}, nil)
+	if err = b.finishReport(); err != nil {
+		t.Fatal(err)
+	}
+
+	b.startReport()
+	var result StepReport
+	if result.Files, result.Bytes, err = filesUsage(filepath.Join(wwwdir, "Manifest.*")); err != nil {
+		t.Fatal(err)
+	}
+	b.finishStep(events.StartStep("manifests", ""), "", result, nil)
+	b.finishStep(events.StartStep("packs", ""), "", StepReport{Packs: 2, Bytes: 100}, nil)
+	if err = b.finishReport(); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(wwwdir, ReportFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r BuildReport
+	if err = json.Unmarshal(content, &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Version != "10" || len(r.Steps) != 2 {
+		t.Fatalf("unexpected report %+v", r)
+	}
+	if s := r.Steps[0]; s.Name != "manifests" || s.Files != 2 || s.Bytes != 8 {
+		t.Errorf("unexpected manifests step %+v", s)
+	}
+	if s := r.Steps[1]; s.Name != "packs" || s.Packs != 2 || s.Bytes != 100 {
+		t.Errorf("unexpected packs step %+v", s)
+	}
+	if b.report != nil {
+		t.Error("report not reset after the build")
+	}
+}
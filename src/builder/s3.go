@@ -0,0 +1,224 @@
+package builder
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"logger"
+)
+
+// defaultS3Region is the region requests are signed for when
+// PUBLISH_S3_REGION is not set, S3-compatible servers like MinIO use it too
+const defaultS3Region = "us-east-1"
+
+// s3Publisher uploads the content to a bucket of an S3-compatible object
+// storage. Requests use path-style addressing, endpoint/bucket/key, and are
+// signed with AWS Signature Version 4.
+type s3Publisher struct {
+	endpoint  *url.URL
+	bucket    string
+	prefix    string
+	region    string
+	accessKey string
+	secretKey string
+	// token is the session token of temporary credentials
+	token  string
+	client *http.Client
+}
+
+// newS3Publisher returns the publisher for PUBLISH_DEST, the bucket followed
+// by an optional prefix for the keys. The credentials default to the usual
+// AWS environment variables.
+func (b *Builder) newS3Publisher() (Publisher, error) {
+	if b.S3Endpoint == "" {
+		return nil, errors.New("PUBLISH_S3_ENDPOINT must be set to publish with the s3 backend")
+	}
+	endpoint, err := url.Parse(b.S3Endpoint)
+	if err != nil || endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return nil, fmt.Errorf("invalid PUBLISH_S3_ENDPOINT %q, expected an http or https URL", b.S3Endpoint)
+	}
+
+	p := &s3Publisher{
+		endpoint:  endpoint,
+		region:    b.S3Region,
+		accessKey: b.S3AccessKey,
+		secretKey: b.S3SecretKey,
+		token:     os.Getenv("AWS_SESSION_TOKEN"),
+		client:    &http.Client{Timeout: 10 * time.Minute},
+	}
+	dest := strings.Trim(b.PublishDest, "/")
+	if i := strings.Index(dest, "/"); i >= 0 {
+		p.bucket, p.prefix = dest[:i], dest[i+1:]
+	} else {
+		p.bucket = dest
+	}
+	if p.region == "" {
+		p.region = defaultS3Region
+	}
+	if p.accessKey == "" {
+		p.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if p.secretKey == "" {
+		p.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if p.accessKey == "" || p.secretKey == "" {
+		return nil, errors.New("PUBLISH_S3_ACCESS_KEY and PUBLISH_S3_SECRET_KEY, or AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, must be set to publish with the s3 backend")
+	}
+	return p, nil
+}
+
+func (p *s3Publisher) PublishDir(dir string, name string) error {
+	return filepath.Walk(dir, func(file string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		// Object storage has no links, they are uploaded as the file they
+		// point to.
+		return p.PublishFile(file, path.Join(name, filepath.ToSlash(rel)))
+	})
+}
+
+func (p *s3Publisher) PublishFiles(root string, names []string) error {
+	for _, name := range names {
+		if err := p.PublishFile(filepath.Join(root, filepath.FromSlash(name)), name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *s3Publisher) PublishFile(file string, name string) error {
+	// Packs can be large, the file is read once to get the hash of the
+	// payload and then streamed.
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	u := *p.endpoint
+	u.Path = path.Join("/", u.Path, p.bucket, p.prefix, name)
+	// The path is sent escaped as it is signed.
+	u.RawPath = s3EscapePath(u.Path)
+	req, err := http.NewRequest(http.MethodPut, u.String(), ioutil.NopCloser(f))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		// Else the body would be sent chunked, with an unknown length.
+		req.Body = http.NoBody
+	}
+	if p.token != "" {
+		req.Header.Set("X-Amz-Security-Token", p.token)
+	}
+	signV4(req, hex.EncodeToString(h.Sum(nil)), p.accessKey, p.secretKey, p.region, time.Now())
+
+	logger.Debug("Uploading %s to %s", file, u.String())
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("failed to upload %s: %s: %s", name, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// s3EscapePath escapes the path of a request the way Signature Version 4
+// expects it, every byte but the unreserved characters and slashes
+func s3EscapePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// signV4 signs req for the s3 service with AWS Signature Version 4, adding
+// the X-Amz-Date, X-Amz-Content-Sha256 and Authorization headers. All the
+// headers of req and its host are signed. payloadHash is the hex encoded
+// SHA-256 of the body.
+func signV4(req *http.Request, payloadHash string, accessKey, secretKey, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	// The query of the requests made is always empty.
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		"",
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
@@ -0,0 +1,148 @@
+package builder
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"events"
+	"helpers"
+)
+
+// serveCertValidity is how long the generated certificate of the content
+// server is valid
+const serveCertValidity = 365 * 24 * time.Hour
+
+// accessRecorder keeps the status and size of a response for the access log
+type accessRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *accessRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *accessRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// contentHandler serves the files in dir, reporting every request
+func contentHandler(dir string) http.Handler {
+	files := http.FileServer(http.Dir(dir))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &accessRecorder{ResponseWriter: w}
+		files.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		duration := time.Since(start)
+
+		events.Emit(&events.Event{
+			Type: events.TypeMessage,
+			Message: fmt.Sprintf("%s %s %s %d %d %s", r.RemoteAddr, r.Method, r.URL.Path,
+				rec.status, rec.bytes, duration.Round(time.Microsecond)),
+			Data: map[string]interface{}{
+				"remote":   r.RemoteAddr,
+				"method":   r.Method,
+				"path":     r.URL.Path,
+				"status":   rec.status,
+				"bytes":    rec.bytes,
+				"duration": duration.Seconds(),
+			},
+		})
+	})
+}
+
+// ServeCertPaths returns the certificate and key generated for serving the
+// content over TLS
+func (b *Builder) ServeCertPaths() (string, string) {
+	dir := filepath.Join(b.Statedir, "serve")
+	return filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+}
+
+// serveCertificate returns the certificate and key to serve the content over
+// TLS, generating a self-signed certificate for localhost and the host name
+// unless a valid one was already generated
+func (b *Builder) serveCertificate() (string, string, error) {
+	certPath, keyPath := b.ServeCertPaths()
+	if _, err := os.Stat(certPath); err == nil {
+		if cert, err := helpers.ReadCertificate(certPath); err == nil && time.Now().Before(cert.NotAfter) {
+			return certPath, keyPath, nil
+		}
+		// GenerateCertificate keeps existing certificates.
+		if err = os.Remove(certPath); err != nil {
+			return "", "", err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(certPath), 0755); err != nil {
+		return "", "", err
+	}
+	key, err := helpers.CreateKeyPair(helpers.KeyAlgorithmECDSA, 256)
+	if err != nil {
+		return "", "", err
+	}
+	template, err := helpers.CreateCertTemplate(pkix.Name{CommonName: "mixer serve"}, serveCertValidity)
+	if err != nil {
+		return "", "", err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	template.DNSNames = []string{"localhost"}
+	if host, err := os.Hostname(); err == nil {
+		template.DNSNames = append(template.DNSNames, host)
+	}
+	template.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+
+	if err = helpers.GenerateCertificate(certPath, keyPath, template, template, key.Public(), key); err != nil {
+		return "", "", err
+	}
+	events.Info("Generated certificate %s for serving over TLS", certPath)
+	return certPath, keyPath, nil
+}
+
+// Serve serves the update content in the www directory of the state
+// directory on addr until it fails, logging every request. With useTLS the
+// content is served over HTTPS with a generated certificate, see
+// ServeCertPaths, that the clients must trust.
+func (b *Builder) Serve(addr string, useTLS bool) error {
+	wwwdir := filepath.Join(b.Statedir, "www")
+	if _, err := os.Stat(wwwdir); err != nil {
+		return fmt.Errorf("nothing to serve: %v", err)
+	}
+
+	server := &http.Server{Addr: addr, Handler: contentHandler(wwwdir)}
+	scheme := "http"
+	var certPath, keyPath string
+	if useTLS {
+		var err error
+		if certPath, keyPath, err = b.serveCertificate(); err != nil {
+			return fmt.Errorf("failed to create the certificate: %v", err)
+		}
+		scheme = "https"
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	events.Info("Serving %s on %s://%s", wwwdir, scheme, listener.Addr())
+	if useTLS {
+		return server.ServeTLS(listener, certPath, keyPath)
+	}
+	return server.Serve(listener)
+}
@@ -0,0 +1,156 @@
+package builder
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"events"
+	"helpers"
+)
+
+func TestServe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serve-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wwwdir := filepath.Join(dir, "www", "version", "format1")
+	if err = os.MkdirAll(wwwdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(wwwdir, "latest"), []byte("10"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b := New()
+	b.Statedir = dir
+	certPath, _, err := b.serveCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := helpers.ReadCertificate(certPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cert.VerifyHostname("localhost"); err != nil {
+		t.Error(err)
+	}
+	// The certificate is reused while valid.
+	if again, _, err := b.serveCertificate(); err != nil || again != certPath {
+		t.Errorf("certificate not reused: %s %v", again, err)
+	}
+	again, err := helpers.ReadCertificate(certPath)
+	if err != nil || again.SerialNumber.Cmp(cert.SerialNumber) != 0 {
+		t.Errorf("certificate regenerated: %v", err)
+	}
+
+	// An expired certificate is replaced.
+	template, err := helpers.CreateCertTemplate(cert.Subject, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.NotBefore = time.Now().Add(-2 * time.Hour)
+	template.NotAfter = time.Now().Add(-time.Hour)
+	key, err := helpers.CreateKeyPair(helpers.KeyAlgorithmECDSA, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(certPath); err != nil {
+		t.Fatal(err)
+	}
+	if err = helpers.GenerateCertificate(certPath, filepath.Join(dir, "expired.pem"), template, template, key.Public(), key); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = b.serveCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	if cert, err = helpers.ReadCertificate(certPath); err != nil {
+		t.Fatal(err)
+	}
+	if !time.Now().Before(cert.NotAfter) || cert.SerialNumber.Cmp(again.SerialNumber) == 0 {
+		t.Errorf("expired certificate not regenerated, valid until %s", cert.NotAfter)
+	}
+
+	// The access log is read back from the JSON events.
+	var output bytes.Buffer
+	events.SetOutput(&output)
+	if err = events.SetFormat(events.FormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		events.SetOutput(os.Stdout)
+		events.SetFormat(events.FormatText)
+	}()
+
+	server := httptest.NewUnstartedServer(contentHandler(filepath.Join(dir, "www")))
+	keyPair, err := tls.LoadX509KeyPair(b.ServeCertPaths())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{keyPair}}
+	server.StartTLS()
+	defer server.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+
+	tests := []struct {
+		path   string
+		status int
+		bytes  int
+	}{
+		{"/version/format1/latest", http.StatusOK, len("10")},
+		{"/10/Manifest.MoM", http.StatusNotFound, len("404 page not found\n")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			resp, err := client.Get(server.URL + tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Errorf("got status %d, expected %d", resp.StatusCode, tt.status)
+			}
+		})
+	}
+
+	// Closing the server waits for the requests to be logged.
+	server.Close()
+	var logged []events.Event
+	dec := json.NewDecoder(&output)
+	for {
+		var e events.Event
+		if err = dec.Decode(&e); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		logged = append(logged, e)
+	}
+	if len(logged) != len(tests) {
+		t.Fatalf("%d requests logged, expected %d: %+v", len(logged), len(tests), logged)
+	}
+	for i, tt := range tests {
+		data := logged[i].Data
+		// Numbers are decoded as float64.
+		if data["method"] != http.MethodGet || data["path"] != tt.path ||
+			data["status"] != float64(tt.status) || data["bytes"] != float64(tt.bytes) {
+			t.Errorf("unexpected access log for %s: %v", tt.path, data)
+		}
+		if _, ok := data["remote"].(string); !ok {
+			t.Errorf("no remote address logged for %s: %v", tt.path, data)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package builder
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"helpers"
+)
+
+// Signing backends that can be selected with SIGNING_BACKEND in builder.conf
+const (
+	SigningBackendFile    = "file"
+	SigningBackendPKCS11  = "pkcs11"
+	SigningBackendCommand = "command"
+)
+
+// A Signer creates the detached PKCS#7 signatures published with the mix
+type Signer interface {
+	// Sign returns the DER encoded signature of content
+	Sign(content []byte) ([]byte, error)
+}
+
+// NewSigner returns the Signer for the backend configured in builder.conf.
+// Signing defaults to the file backend.
+func (b *Builder) NewSigner() (Signer, error) {
+	if b.SigningBackend == SigningBackendCommand {
+		if b.SigningCommand == "" {
+			return nil, errors.New("SIGNING_COMMAND must be set to sign with the command backend")
+		}
+		return &commandSigner{command: b.SigningCommand, cert: b.Cert}, nil
+	}
+
+	cert, err := helpers.ReadCertificate(b.Cert)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate: %v", err)
+	}
+	if _, ok := cert.PublicKey.(ed25519.PublicKey); ok {
+		return nil, fmt.Errorf("%s has an ed25519 key: %v", b.Cert, checkKeyAlgorithm(helpers.KeyAlgorithmEd25519))
+	}
+	key, err := b.signingKey(cert)
+	if err != nil {
+		return nil, err
+	}
+	return &keySigner{cert: cert, key: key}, nil
+}
+
+// signingKey returns the private key matching cert for the backends that
+// give access to a crypto.Signer
+func (b *Builder) signingKey(cert *x509.Certificate) (crypto.Signer, error) {
+	switch b.SigningBackend {
+	case "", SigningBackendFile:
+		key, err := helpers.ReadPrivateKey(b.SigningKeyPath())
+		if err != nil {
+			return nil, fmt.Errorf("failed to read signing key: %v", err)
+		}
+		return key, nil
+	case SigningBackendPKCS11:
+		if b.PKCS11Module == "" {
+			return nil, errors.New("PKCS11_MODULE must be set to sign with the pkcs11 backend")
+		}
+		if b.PKCS11KeyLabel == "" && b.PKCS11KeyID == "" {
+			return nil, errors.New("PKCS11_KEY_LABEL or PKCS11_KEY_ID must be set to sign with the pkcs11 backend")
+		}
+		return &pkcs11Key{
+			public:   cert.PublicKey,
+			module:   b.PKCS11Module,
+			token:    b.PKCS11Token,
+			keyLabel: b.PKCS11KeyLabel,
+			keyID:    b.PKCS11KeyID,
+			pin:      b.PKCS11Pin,
+		}, nil
+	case SigningBackendCommand:
+		return nil, errors.New("the private key is not accessible with the command backend")
+	default:
+		return nil, fmt.Errorf("unknown signing backend %q", b.SigningBackend)
+	}
+}
+
+// SigningKeyPath returns the private key used by the file backend, by
+// default private.pem next to the certificate
+func (b *Builder) SigningKeyPath() string {
+	if b.SigningKey != "" {
+		return b.SigningKey
+	}
+	return filepath.Join(filepath.Dir(b.Cert), "private.pem")
+}
+
+// keySigner signs with a crypto.Signer matching cert
+type keySigner struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+func (s *keySigner) Sign(content []byte) ([]byte, error) {
+	return helpers.SignPKCS7(content, s.cert, s.key)
+}
+
+// commandSigner runs an external command that gets the content to sign on
+// its standard input and writes the DER encoded PKCS#7 signature to its
+// standard output. The command is run by the shell with MIXER_CERT set to
+// the certificate the signature must match.
+type commandSigner struct {
+	command string
+	cert    string
+}
+
+func (s *commandSigner) Sign(content []byte) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("sh", "-c", s.command)
+	cmd.Env = append(os.Environ(), "MIXER_CERT="+s.cert)
+	cmd.Stdin = bytes.NewReader(content)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("signing command failed: %v: %s", err, stderr.String())
+	}
+	if stdout.Len() == 0 {
+		return nil, errors.New("signing command did not output a signature")
+	}
+	return stdout.Bytes(), nil
+}
+
+// digestInfoSHA256 is the DER prefix of a PKCS#1 v1.5 DigestInfo for a
+// SHA-256 digest
+var digestInfoSHA256 = []byte{
+	0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01,
+	0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20,
+}
+
+// pkcs11PinEnv is the environment variable passing the PIN to pkcs11-tool,
+// which unlike its command line is not readable by other users
+const pkcs11PinEnv = "MIXER_PKCS11_PIN"
+
+// pkcs11Key is a crypto.Signer for a private key stored in a PKCS#11 token,
+// such as an HSM or SoftHSM. Signing is done with pkcs11-tool from OpenSC,
+// the key never leaves the token.
+type pkcs11Key struct {
+	public   crypto.PublicKey
+	module   string
+	token    string
+	keyLabel string
+	keyID    string
+	pin      string
+}
+
+func (k *pkcs11Key) Public() crypto.PublicKey {
+	return k.public
+}
+
+func (k *pkcs11Key) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	var input []byte
+	args := []string{"--module", k.module, "--sign"}
+	switch k.public.(type) {
+	case *rsa.PublicKey:
+		if opts.HashFunc() != crypto.SHA256 {
+			return nil, fmt.Errorf("unsupported hash %v for PKCS#11 RSA signing", opts.HashFunc())
+		}
+		input = append(append(input, digestInfoSHA256...), digest...)
+		args = append(args, "--mechanism", "RSA-PKCS")
+	case *ecdsa.PublicKey:
+		input = digest
+		args = append(args, "--mechanism", "ECDSA", "--signature-format", "openssl")
+	default:
+		return nil, fmt.Errorf("unsupported key type %T for PKCS#11 signing", k.public)
+	}
+	if k.token != "" {
+		args = append(args, "--token-label", k.token)
+	}
+	if k.keyID != "" {
+		args = append(args, "--id", k.keyID)
+	} else {
+		args = append(args, "--label", k.keyLabel)
+	}
+	if k.pin != "" {
+		args = append(args, "--login", "--pin", "env:"+pkcs11PinEnv)
+	}
+
+	dir, err := ioutil.TempDir("", "mixer-pkcs11-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	in := filepath.Join(dir, "input")
+	out := filepath.Join(dir, "signature")
+	if err = ioutil.WriteFile(in, input, 0600); err != nil {
+		return nil, err
+	}
+	args = append(args, "--input-file", in, "--output-file", out)
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("pkcs11-tool", args...)
+	cmd.Env = append(os.Environ(), pkcs11PinEnv+"="+k.pin)
+	cmd.Stderr = &stderr
+	if err = cmd.Run(); err != nil {
+		return nil, fmt.Errorf("pkcs11-tool failed: %v: %s", err, stderr.String())
+	}
+	return ioutil.ReadFile(out)
+}
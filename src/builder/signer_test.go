@@ -0,0 +1,287 @@
+package builder
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"helpers"
+)
+
+// writeTestCertificate creates a self-signed ECDSA certificate for b.Cert with
+// its key where the file backend expects it
+func writeTestCertificate(t *testing.T, b *Builder) {
+	key, err := helpers.CreateKeyPair(helpers.KeyAlgorithmECDSA, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template, err := b.NewCertTemplate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = helpers.GenerateCertificate(b.Cert, b.SigningKeyPath(), template, template, key.Public(), key); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeTestScript writes an executable shell script to path
+func writeTestScript(t *testing.T, path string, script string) {
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSigners(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signer-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	content := []byte("MANIFEST\t1\nversion:\t10\n")
+
+	t.Run("file", func(t *testing.T) {
+		b := New()
+		b.Cert = filepath.Join(dir, "file", "Swupd_Root.pem")
+		if err := os.MkdirAll(filepath.Dir(b.Cert), 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeTestCertificate(t, b)
+
+		signer, err := b.NewSigner()
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature, err := signer.Sign(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := helpers.ReadCertificate(b.Cert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = helpers.VerifyPKCS7(content, signature, cert); err != nil {
+			t.Errorf("signature does not verify: %v", err)
+		}
+		if err = helpers.VerifyPKCS7(append(content, '\n'), signature, cert); err == nil {
+			t.Error("signature verifies for modified content")
+		}
+	})
+
+	t.Run("ed25519", func(t *testing.T) {
+		b := New()
+		b.Cert = filepath.Join(dir, "ed25519", "Swupd_Root.pem")
+		if err := os.MkdirAll(filepath.Dir(b.Cert), 0755); err != nil {
+			t.Fatal(err)
+		}
+		key, err := helpers.CreateKeyPair(helpers.KeyAlgorithmEd25519, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template, err := b.NewCertTemplate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = helpers.GenerateCertificate(b.Cert, b.SigningKeyPath(), template, template, key.Public(), key); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = b.NewSigner(); err == nil {
+			t.Error("expected an error signing with an ed25519 key")
+		}
+	})
+
+	t.Run("command", func(t *testing.T) {
+		// The stub keeps its input and certificate and outputs a fixed
+		// signature.
+		script := filepath.Join(dir, "sign.sh")
+		writeTestScript(t, script, `cat > "$(dirname "$0")/input"
+echo "$MIXER_CERT" > "$(dirname "$0")/cert"
+printf signature
+`)
+		b := New()
+		b.Cert = "/path/to/Swupd_Root.pem"
+		b.SigningBackend = SigningBackendCommand
+		b.SigningCommand = script
+		signer, err := b.NewSigner()
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature, err := signer.Sign(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(signature) != "signature" {
+			t.Errorf("unexpected signature %q", signature)
+		}
+		if input, err := ioutil.ReadFile(filepath.Join(dir, "input")); err != nil || !bytes.Equal(input, content) {
+			t.Errorf("command got %q as input: %v", input, err)
+		}
+		if cert, err := ioutil.ReadFile(filepath.Join(dir, "cert")); err != nil || string(cert) != b.Cert+"\n" {
+			t.Errorf("command got %q as MIXER_CERT: %v", cert, err)
+		}
+
+		if _, err = (&commandSigner{command: "true"}).Sign(content); err == nil {
+			t.Error("expected an error without signature output")
+		}
+		_, err = (&commandSigner{command: "echo failed >&2; exit 1"}).Sign(content)
+		if err == nil || !strings.Contains(err.Error(), "failed") {
+			t.Errorf("expected the error output of the command, got %v", err)
+		}
+	})
+
+	t.Run("pkcs11", func(t *testing.T) {
+		// The stub pkcs11-tool records its arguments and the PIN it got
+		// from the environment.
+		bin := filepath.Join(dir, "bin")
+		if err := os.MkdirAll(bin, 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeTestScript(t, filepath.Join(bin, "pkcs11-tool"), `echo "$@" > "$(dirname "$0")/args"
+echo "$MIXER_PKCS11_PIN" > "$(dirname "$0")/pin"
+while [ $# -gt 0 ]; do
+	if [ "$1" = --output-file ]; then printf signature > "$2"; fi
+	shift
+done
+`)
+		path := os.Getenv("PATH")
+		defer os.Setenv("PATH", path)
+		os.Setenv("PATH", bin+string(os.PathListSeparator)+path)
+
+		b := New()
+		b.Cert = filepath.Join(dir, "pkcs11", "Swupd_Root.pem")
+		if err := os.MkdirAll(filepath.Dir(b.Cert), 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeTestCertificate(t, b)
+		b.SigningBackend = SigningBackendPKCS11
+		b.PKCS11Module = "/usr/lib64/softhsm/libsofthsm.so"
+		b.PKCS11KeyLabel = "mixer"
+		b.PKCS11Pin = "s3cr3t"
+		signer, err := b.NewSigner()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The stub signature is no valid ECDSA signature, only check that
+		// the tool was run as expected.
+		signer.Sign(content)
+
+		args, err := ioutil.ReadFile(filepath.Join(bin, "args"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(args), b.PKCS11Pin) || !strings.Contains(string(args), "--pin env:"+pkcs11PinEnv) {
+			t.Errorf("PIN not passed through the environment: %s", args)
+		}
+		if pin, err := ioutil.ReadFile(filepath.Join(bin, "pin")); err != nil || string(pin) != b.PKCS11Pin+"\n" {
+			t.Errorf("pkcs11-tool got PIN %q: %v", pin, err)
+		}
+	})
+}
+
+// softHSMModules are where distributions install the SoftHSM PKCS#11 module
+var softHSMModules = []string{
+	"/usr/lib64/pkcs11/libsofthsm2.so",
+	"/usr/lib64/softhsm/libsofthsm.so",
+	"/usr/lib/softhsm/libsofthsm2.so",
+	"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+	"/usr/local/lib/softhsm/libsofthsm2.so",
+}
+
+// softhsm runs softhsm2-util with args
+func softhsm(t *testing.T, args ...string) {
+	t.Helper()
+	if out, err := exec.Command("softhsm2-util", args...).CombinedOutput(); err != nil {
+		t.Fatalf("softhsm2-util %s failed: %v: %s", args[0], err, out)
+	}
+}
+
+func TestSoftHSMSigner(t *testing.T) {
+	for _, tool := range []string{"softhsm2-util", "pkcs11-tool"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not available", tool)
+		}
+	}
+	var module string
+	for _, m := range softHSMModules {
+		if _, err := os.Stat(m); err == nil {
+			module = m
+			break
+		}
+	}
+	if module == "" {
+		t.Skip("SoftHSM module not found")
+	}
+
+	dir, err := ioutil.TempDir("", "softhsm-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokens := filepath.Join(dir, "tokens")
+	if err = os.Mkdir(tokens, 0700); err != nil {
+		t.Fatal(err)
+	}
+	conf := filepath.Join(dir, "softhsm2.conf")
+	if err = ioutil.WriteFile(conf, []byte("directories.tokendir = "+tokens+"\nobjectstore.backend = file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	old, set := os.LookupEnv("SOFTHSM2_CONF")
+	os.Setenv("SOFTHSM2_CONF", conf)
+	defer func() {
+		if set {
+			os.Setenv("SOFTHSM2_CONF", old)
+		} else {
+			os.Unsetenv("SOFTHSM2_CONF")
+		}
+	}()
+
+	// The key is created outside the token and imported, along with a
+	// certificate for it.
+	b := New()
+	b.Cert = filepath.Join(dir, "Swupd_Root.pem")
+	writeTestCertificate(t, b)
+	key, err := helpers.ReadPrivateKey(b.SigningKeyPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8 := filepath.Join(dir, "key.p8")
+	if err = ioutil.WriteFile(pkcs8, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	softhsm(t, "--init-token", "--free", "--label", "mixer", "--pin", "1234", "--so-pin", "5678")
+	softhsm(t, "--import", pkcs8, "--token", "mixer", "--label", "signing", "--id", "01", "--pin", "1234")
+	if err = os.Remove(b.SigningKeyPath()); err != nil {
+		t.Fatal(err)
+	}
+
+	b.SigningBackend = SigningBackendPKCS11
+	b.PKCS11Module = module
+	b.PKCS11Token = "mixer"
+	b.PKCS11KeyLabel = "signing"
+	b.PKCS11Pin = "1234"
+	signer, err := b.NewSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("MANIFEST\t1\nversion:\t10\n")
+	signature, err := signer.Sign(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := helpers.ReadCertificate(b.Cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = helpers.VerifyPKCS7(content, signature, cert); err != nil {
+		t.Errorf("signature made by the token does not verify: %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+package builder
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"events"
+)
+
+func TestVerifyContent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verify-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	buildTestVersion(t, dir, 10)
+
+	b := New()
+	b.Statedir = dir
+	if err = b.VerifyContent("10"); err != nil {
+		t.Fatalf("unexpected error verifying valid content: %v", err)
+	}
+
+	if err = os.Remove(filepath.Join(dir, "www", "10", "pack-editors-from-0.tar")); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.VerifyContent("10"); !errors.Is(err, ErrInvalidContent) {
+		t.Errorf("expected ErrInvalidContent, got %v", err)
+	}
+
+	// The step ends with the error when the content cannot be read.
+	var output bytes.Buffer
+	events.SetOutput(&output)
+	if err = events.SetFormat(events.FormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	err = b.VerifyContent("20")
+	events.SetOutput(os.Stdout)
+	events.SetFormat(events.FormatText)
+	if err == nil || errors.Is(err, ErrInvalidContent) {
+		t.Errorf("expected an error reading a version that was not built, got %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	var last events.Event
+	if err = json.Unmarshal([]byte(lines[len(lines)-1]), &last); err != nil {
+		t.Fatal(err)
+	}
+	if last.Type != events.TypeError || last.Step != "verify-content" {
+		t.Errorf("step not failed, last event %+v", last)
+	}
+}
@@ -0,0 +1,173 @@
+package builder
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"events"
+	"swupd"
+)
+
+// VersionInfo describes a version found in the www directory, as read from
+// the header of its Manifest.MoM
+type VersionInfo struct {
+	Version     uint32    `json:"version"`
+	Previous    uint32    `json:"previous"`
+	Format      uint      `json:"format"`
+	TimeStamp   time.Time `json:"timestamp"`
+	Bundles     int       `json:"bundles"`
+	ContentSize uint64    `json:"content_size"`
+
+	// Latest is set when the version is the latest published for its format
+	Latest bool `json:"latest"`
+	// Problems lists what the version is missing to be served, it is empty
+	// for complete versions
+	Problems []string `json:"problems,omitempty"`
+}
+
+// latestVersions returns the formats each version is the latest of, as
+// written in www/version/format<N>/latest
+func (b *Builder) latestVersions() (map[uint32][]uint, error) {
+	latest := make(map[uint32][]uint)
+	dirs, err := filepath.Glob(filepath.Join(b.Statedir, "www", "version", "format*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		format, err := strconv.ParseUint(strings.TrimPrefix(filepath.Base(dir), "format"), 10, 32)
+		if err != nil {
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(dir, "latest"))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		ver, err := strconv.ParseUint(strings.TrimSpace(string(content)), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid latest version in %s: %v", dir, err)
+		}
+		latest[uint32(ver)] = append(latest[uint32(ver)], uint(format))
+	}
+	return latest, nil
+}
+
+// versionProblems returns what version is missing: the fullfiles of the
+// files that changed in it and the zero packs of the bundles it lists
+func (b *Builder) versionProblems(version uint32) ([]string, error) {
+	var problems []string
+	missing, err := swupd.MissingFullfiles(b.Statedir, version)
+	if err != nil {
+		return nil, err
+	}
+	if len(missing) > 0 {
+		problems = append(problems, fmt.Sprintf("%d fullfiles missing", len(missing)))
+	}
+
+	packs, err := swupd.ZeroPacks(b.Statedir, version)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range packs {
+		if _, err = os.Stat(p.Path(b.Statedir)); os.IsNotExist(err) {
+			problems = append(problems, fmt.Sprintf("%d/%s missing", p.ToVersion, p.FileName()))
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return problems, nil
+}
+
+// ListVersions returns the versions in the www directory, sorted. Versions
+// whose manifests cannot be read are listed with the error as problem.
+func (b *Builder) ListVersions() ([]*VersionInfo, error) {
+	wwwdir := filepath.Join(b.Statedir, "www")
+	entries, err := ioutil.ReadDir(wwwdir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	latest, err := b.latestVersions()
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []*VersionInfo
+	for _, e := range entries {
+		ver, err := strconv.ParseUint(e.Name(), 10, 32)
+		if !e.IsDir() || err != nil {
+			continue
+		}
+		info := &VersionInfo{Version: uint32(ver)}
+		versions = append(versions, info)
+
+		var mom swupd.MoM
+		err = mom.ReadMoMFromFile(filepath.Join(wwwdir, e.Name(), "Manifest."+swupd.MoMName))
+		if errors.Is(err, os.ErrNotExist) {
+			info.Problems = []string{"Manifest." + swupd.MoMName + " missing"}
+			continue
+		} else if err != nil {
+			info.Problems = []string{err.Error()}
+			continue
+		}
+		info.Previous = mom.Header.Previous
+		info.Format = mom.Header.Format
+		info.TimeStamp = mom.Header.TimeStamp
+		info.Bundles = len(mom.SubManifests)
+		info.ContentSize = mom.Header.ContentSize
+		for _, f := range latest[info.Version] {
+			if f == info.Format {
+				info.Latest = true
+			}
+		}
+		if info.Problems, err = b.versionProblems(info.Version); err != nil {
+			info.Problems = []string{err.Error()}
+		}
+	}
+
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+	return versions, nil
+}
+
+// ShowVersions shows the versions in the www directory, one per line. Whether
+// a version is the latest and whether it is complete are shown separately, a
+// published version can be missing content.
+func (b *Builder) ShowVersions() error {
+	versions, err := b.ListVersions()
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		events.Info("No version in %s", filepath.Join(b.Statedir, "www"))
+		return nil
+	}
+
+	events.Info("%-10s %-10s %-6s %-20s %-8s %12s  %-6s %s", "VERSION", "PREVIOUS", "FORMAT", "TIMESTAMP", "BUNDLES", "SIZE", "LATEST", "STATUS")
+	for _, v := range versions {
+		latest := ""
+		if v.Latest {
+			latest = "yes"
+		}
+		status := "complete"
+		if len(v.Problems) > 0 {
+			status = "incomplete: " + strings.Join(v.Problems, ", ")
+		}
+		timestamp := ""
+		if !v.TimeStamp.IsZero() {
+			timestamp = v.TimeStamp.UTC().Format("2006-01-02 15:04:05")
+		}
+		events.Result(fmt.Sprintf("%-10d %-10d %-6d %-20s %-8d %9d kB  %-6s %s",
+			v.Version, v.Previous, v.Format, timestamp, v.Bundles, v.ContentSize/1024, latest, status),
+			map[string]interface{}{"version": v})
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package builder
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"logger"
+	"swupd"
+)
+
+func TestListVersions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "versions-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, bundle := range []string{"os-core", "full"} {
+		path := filepath.Join(dir, "image", "10", bundle, "usr", "bin")
+		if err = os.MkdirAll(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(filepath.Join(path, "hello"), []byte("hello"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = swupd.CreateManifests(10, 0, 1, dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = swupd.CreateFullfiles(dir, 10, 1); err != nil {
+		t.Fatal(err)
+	}
+	packs, err := swupd.ZeroPacks(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = swupd.CreatePacks(dir, packs, false, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	b := New()
+	b.Statedir = dir
+	b.Mixver = "10"
+	b.Format = "1"
+	if err = b.setVersion(true); err != nil {
+		t.Fatal(err)
+	}
+	// A version whose build failed before the manifests were written.
+	if err = os.MkdirAll(filepath.Join(dir, "www", "20"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err := b.ListVersions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 {
+		t.Fatalf("expected 2 versions, got %d", len(versions))
+	}
+	v := versions[0]
+	if v.Version != 10 || v.Format != 1 || v.Bundles != 1 || !v.Latest || len(v.Problems) != 0 {
+		t.Errorf("unexpected version %+v", v)
+	}
+	if v = versions[1]; v.Version != 20 || v.Latest || len(v.Problems) != 1 || v.Problems[0] != "Manifest.MoM missing" {
+		t.Errorf("unexpected incomplete version %+v", v)
+	}
+
+	if err = os.Remove(packs[0].Path(dir)); err != nil {
+		t.Fatal(err)
+	}
+	if versions, err = b.ListVersions(); err != nil {
+		t.Fatal(err)
+	}
+	if v = versions[0]; len(v.Problems) != 1 {
+		t.Errorf("expected the missing pack to be reported, got %v", v.Problems)
+	}
+
+	// The latest version stays reported as such while it is incomplete.
+	var out bytes.Buffer
+	logger.SetConsole(&out, &out)
+	defer logger.SetConsole(os.Stdout, os.Stderr)
+	if err = b.ShowVersions(); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, line := range strings.Split(out.String(), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] != "10" {
+			continue
+		}
+		found = true
+		if !strings.Contains(line, " yes ") || !strings.Contains(line, "incomplete: ") {
+			t.Errorf("expected version 10 to be shown as latest and incomplete, got %q", line)
+		}
+	}
+	if !found {
+		t.Errorf("version 10 not shown in:\n%s", out.String())
+	}
+}
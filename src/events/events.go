@@ -0,0 +1,214 @@
+// Package events reports the progress of mixer commands, either as text for
+// humans or as a stream of JSON objects, one per line, for tools.
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"logger"
+)
+
+// Output formats that can be selected with SetFormat
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Types of the events
+const (
+	TypeMessage          = "message"
+	TypeWarning          = "warning"
+	TypeError            = "error"
+	TypeStepStarted      = "step-started"
+	TypeStepFinished     = "step-finished"
+	TypeBundleAdded      = "bundle-added"
+	TypeVersionPublished = "version-published"
+	TypeResult           = "result"
+)
+
+// CodeUnknown is the code of errors that do not carry a code
+const CodeUnknown = "error"
+
+// An Event is something that happened while running a command. In the text
+// format only the message is shown.
+type Event struct {
+	Time    time.Time              `json:"time"`
+	Type    string                 `json:"type"`
+	Step    string                 `json:"step,omitempty"`
+	Message string                 `json:"message,omitempty"`
+	Code    string                 `json:"code,omitempty"`
+	Data    map[string]interface{} `json:"data,omitempty"`
+}
+
+// A Coder is an error with a stable code identifying it, used as the code of
+// error events
+type Coder interface {
+	ErrorCode() string
+}
+
+var (
+	mu     sync.Mutex
+	format           = FormatText
+	stdout io.Writer = os.Stdout
+)
+
+// SetFormat selects how events are written, FormatText or FormatJSON
+func SetFormat(f string) error {
+	if f != FormatText && f != FormatJSON {
+		return fmt.Errorf("unknown output format %q, use %s or %s", f, FormatText, FormatJSON)
+	}
+	mu.Lock()
+	format = f
+	mu.Unlock()
+	return nil
+}
+
+// SetOutput sets where events are written in the JSON format, the standard
+// output by default
+func SetOutput(w io.Writer) {
+	mu.Lock()
+	stdout = w
+	mu.Unlock()
+}
+
+// JSON returns whether events are written as JSON
+func JSON() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return format == FormatJSON
+}
+
+// logMessage returns the level and message e is logged with. Steps without
+// a message are only logged in verbose mode.
+func logMessage(e *Event) (logger.Level, string) {
+	switch {
+	case e.Type == TypeError:
+		return logger.LevelError, e.Message
+	case e.Type == TypeWarning:
+		return logger.LevelWarn, e.Message
+	case e.Message != "":
+		return logger.LevelInfo, e.Message
+	case e.Type == TypeStepStarted:
+		return logger.LevelDebug, "Started step " + e.Step
+	case e.Type == TypeStepFinished:
+		return logger.LevelDebug, fmt.Sprintf("Finished step %s in %.1fs", e.Step, e.Data["duration"])
+	default:
+		return logger.LevelDebug, ""
+	}
+}
+
+// Emit writes e. In the text format it is logged, as an error, a warning or
+// a message depending on its type. With JSON output it is only kept in the
+// log file.
+func Emit(e *Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	l, msg := logMessage(e)
+	if format == FormatJSON {
+		// Events only hold values that can be marshalled.
+		line, _ := json.Marshal(e)
+		stdout.Write(append(line, '\n'))
+		if msg != "" {
+			logger.File(l, msg)
+		}
+		return
+	}
+	if msg != "" {
+		logger.Log(l, msg)
+	}
+}
+
+// Info reports a message
+func Info(format string, args ...interface{}) {
+	Emit(&Event{Type: TypeMessage, Message: fmt.Sprintf(format, args...)})
+}
+
+// Warning reports a problem that does not stop the command
+func Warning(format string, args ...interface{}) {
+	Emit(&Event{Type: TypeWarning, Message: fmt.Sprintf(format, args...)})
+}
+
+// Error reports err, with the code of the first error in its chain that is
+// a Coder
+func Error(err error) {
+	Emit(&Event{Type: TypeError, Message: err.Error(), Code: ErrorCode(err)})
+}
+
+// ErrorCode returns the code of err, or CodeUnknown
+func ErrorCode(err error) string {
+	var c Coder
+	if errors.As(err, &c) {
+		return c.ErrorCode()
+	}
+	return CodeUnknown
+}
+
+// Result reports the outcome of a command, like the values shown by a show
+// command. message is what is shown in the text format.
+func Result(message string, data map[string]interface{}) {
+	Emit(&Event{Type: TypeResult, Message: message, Data: data})
+}
+
+// BundleAdded reports a bundle added to the mix
+func BundleAdded(bundle string) {
+	Emit(&Event{
+		Type:    TypeBundleAdded,
+		Message: fmt.Sprintf("Adding bundle %q", bundle),
+		Data:    map[string]interface{}{"bundle": bundle},
+	})
+}
+
+// VersionPublished reports a version made the latest of its format
+func VersionPublished(version string, format string) {
+	Emit(&Event{
+		Type:    TypeVersionPublished,
+		Message: "Setting latest version to " + version,
+		Data:    map[string]interface{}{"version": version, "format": format},
+	})
+}
+
+// A Step is a part of a command whose start and end are reported
+type Step struct {
+	Name  string
+	Start time.Time
+}
+
+// StartStep reports the start of the step called name, with message shown
+// in the text format
+func StartStep(name string, message string) *Step {
+	s := &Step{Name: name, Start: time.Now()}
+	Emit(&Event{Time: s.Start, Type: TypeStepStarted, Step: name, Message: message})
+	return s
+}
+
+// Finish reports the end of the step along with its duration and data about
+// the result. message is shown in the text format, if not empty.
+func (s *Step) Finish(message string, data map[string]interface{}) {
+	now := time.Now()
+	if data == nil {
+		data = make(map[string]interface{})
+	}
+	data["duration"] = now.Sub(s.Start).Seconds()
+	Emit(&Event{Time: now, Type: TypeStepFinished, Step: s.Name, Message: message, Data: data})
+}
+
+// Fail reports that the step stopped because of err
+func (s *Step) Fail(err error) {
+	Emit(&Event{
+		Type:    TypeError,
+		Step:    s.Name,
+		Message: err.Error(),
+		Code:    ErrorCode(err),
+		Data:    map[string]interface{}{"duration": time.Since(s.Start).Seconds()},
+	})
+}
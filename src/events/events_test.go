@@ -0,0 +1,97 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"logger"
+)
+
+type codeError struct{}
+
+func (codeError) Error() string     { return "coded" }
+func (codeError) ErrorCode() string { return "test-code" }
+
+// captureEvents runs f with the given format and returns what was written
+// to the standard output and error
+func captureEvents(t *testing.T, f string, run func()) (string, string) {
+	var out, errOut bytes.Buffer
+	SetOutput(&out)
+	logger.SetConsole(&out, &errOut)
+	defer func() {
+		SetOutput(os.Stdout)
+		logger.SetConsole(os.Stdout, os.Stderr)
+		SetFormat(FormatText)
+	}()
+	if err := SetFormat(f); err != nil {
+		t.Fatal(err)
+	}
+	run()
+	return out.String(), errOut.String()
+}
+
+func TestText(t *testing.T) {
+	out, errOut := captureEvents(t, FormatText, func() {
+		Info("hello %d", 1)
+		Warning("careful")
+		Error(errors.New("failed"))
+		StartStep("step", "").Finish("done", nil)
+	})
+	if out != "hello 1\nWARNING: careful\ndone\n" {
+		t.Errorf("unexpected output %q", out)
+	}
+	if errOut != "***Error: failed\n" {
+		t.Errorf("unexpected error output %q", errOut)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	out, errOut := captureEvents(t, FormatJSON, func() {
+		Info("hello")
+		Error(fmt.Errorf("wrapped: %w", codeError{}))
+		step := StartStep("step", "starting")
+		step.Finish("done", map[string]interface{}{"count": 2})
+		BundleAdded("os-core")
+	})
+	if errOut != "" {
+		t.Errorf("unexpected error output %q", errOut)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	expected := []Event{
+		{Type: TypeMessage, Message: "hello"},
+		{Type: TypeError, Message: "wrapped: coded", Code: "test-code"},
+		{Type: TypeStepStarted, Step: "step", Message: "starting"},
+		{Type: TypeStepFinished, Step: "step", Message: "done"},
+		{Type: TypeBundleAdded, Message: `Adding bundle "os-core"`},
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %d events, got %d:\n%s", len(expected), len(lines), out)
+	}
+	for i, line := range lines {
+		var e Event
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("invalid event %q: %v", line, err)
+		}
+		if e.Type != expected[i].Type || e.Step != expected[i].Step || e.Message != expected[i].Message || e.Code != expected[i].Code {
+			t.Errorf("event %d is %+v, expected %+v", i, e, expected[i])
+		}
+		if e.Time.IsZero() {
+			t.Errorf("event %d has no time", i)
+		}
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	if code := ErrorCode(errors.New("plain")); code != CodeUnknown {
+		t.Errorf("expected %s for an error without code, got %s", CodeUnknown, code)
+	}
+	if err := SetFormat("xml"); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
@@ -1,6 +1,10 @@
 package helpers
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
@@ -13,10 +17,12 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
-	"path/filepath"
 	"regexp"
 	"strings"
 	"time"
+
+	"events"
+	"logger"
 )
 
 var (
@@ -24,87 +30,187 @@ var (
 	ENOVERSION = 24
 )
 
-// PrintError is a utility function to emit an error to the console
+// PrintError is a utility function to emit an error to the console, or as
+// an error event with JSON output
 func PrintError(e error) {
-	fmt.Fprintf(os.Stderr, "***Error: %v\n", e)
+	events.Error(e)
 }
 
+// Key algorithms supported by CreateKeyPair
+const (
+	KeyAlgorithmRSA     = "rsa"
+	KeyAlgorithmECDSA   = "ecdsa"
+	KeyAlgorithmEd25519 = "ed25519"
+)
+
 // CreateCertTemplate will construct the template for needed openssl metadata
-// instead of using an attributes.cnf file
-func CreateCertTemplate() *x509.Certificate {
+// instead of using an attributes.cnf file. The certificate is valid for
+// validity starting now, the signature algorithm follows from the key.
+func CreateCertTemplate(subject pkix.Name, validity time.Duration) (*x509.Certificate, error) {
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	serialnumber, err := rand.Int(rand.Reader, serialNumberLimit)
 	if err != nil {
-		fmt.Println("ERROR: Failed to generate serial number")
-		PrintError(err)
+		return nil, fmt.Errorf("failed to generate serial number: %v", err)
 	}
 
+	now := time.Now()
 	template := x509.Certificate{
 		SerialNumber:          serialnumber,
-		Subject:               pkix.Name{Organization: []string{"Mixer"}},
-		SignatureAlgorithm:    x509.SHA256WithRSA,
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().AddDate(1, 0, 0),
+		Subject:               subject,
+		NotBefore:             now,
+		NotAfter:              now.Add(validity),
 		BasicConstraintsValid: true,
 		IsCA:        false, // This could be true since we are self signed, but set false for correctness
 		KeyUsage:    x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature | x509.KeyUsageCRLSign,
 		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
 	}
 
-	return &template
+	return &template, nil
 }
 
-// CreateKeyPair constructs an RSA keypair in memory
-func CreateKeyPair() (*rsa.PrivateKey, error) {
-	rootKey, err := rsa.GenerateKey(rand.Reader, 4096)
+// CreateKeyPair constructs a keypair in memory. The size is the number of
+// bits of an RSA key or the curve size of an ECDSA key, P-256 or P-384, and
+// is ignored for Ed25519.
+func CreateKeyPair(algorithm string, size int) (crypto.Signer, error) {
+	var key crypto.Signer
+	var err error
+	switch algorithm {
+	case KeyAlgorithmRSA:
+		if size < 2048 {
+			return nil, fmt.Errorf("RSA keys must have at least 2048 bits, got %d", size)
+		}
+		key, err = rsa.GenerateKey(rand.Reader, size)
+	case KeyAlgorithmECDSA:
+		var curve elliptic.Curve
+		switch size {
+		case 256:
+			curve = elliptic.P256()
+		case 384:
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported ECDSA curve size %d, use 256 or 384", size)
+		}
+		key, err = ecdsa.GenerateKey(curve, rand.Reader)
+	case KeyAlgorithmEd25519:
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported key algorithm %q", algorithm)
+	}
 	if err != nil {
-		fmt.Println("ERROR: Failed to generate random key")
-		PrintError(err)
+		err = fmt.Errorf("failed to generate random key: %v", err)
+		return nil, err
 	}
-	return rootKey, nil
+	return key, nil
 }
 
 // GenerateCertificate will create the private signing key and public
-// certificate for clients to use and writes them to disk
-func GenerateCertificate(cert string, template, parent *x509.Certificate, pubkey interface{}, privkey interface{}) error {
+// certificate for clients to use and writes them to disk, the key is written
+// to keyPath
+func GenerateCertificate(cert string, keyPath string, template, parent *x509.Certificate, pubkey interface{}, privkey interface{}) error {
 	if _, err := os.Stat(cert); os.IsNotExist(err) {
 		der, err := x509.CreateCertificate(rand.Reader, template, parent, pubkey, privkey)
 		if err != nil {
-			fmt.Println("ERROR: Failed to create certificate!")
-			PrintError(err)
+			err = fmt.Errorf("failed to create certificate: %v", err)
 			return err
 		}
 
 		// Write the public certficiate out for clients to use
-		certOut, err := os.Create(cert)
-		if err != nil {
-			fmt.Printf("failed to open cert.pem for writing: %v\n", err)
-			PrintError(err)
+		if err = WriteCertificate(cert, der); err != nil {
+			return err
 		}
-		pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: der})
-		certOut.Close()
 
 		// Write the private signing key out
-		keyOut, err := os.OpenFile(filepath.Dir(cert)+"/private.pem", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-		if err != nil {
-			fmt.Println("failed to open key.pem for writing")
-			PrintError(err)
+		if err = WritePrivateKey(keyPath, privkey); err != nil {
 			return err
 		}
-		defer keyOut.Close()
-		// Need type assertion for Marshal to work
-		priv := privkey.(*rsa.PrivateKey)
-		pem.Encode(keyOut, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
 	}
 	return nil
 }
 
+// WriteCertificate writes the DER encoded certificate to path in PEM form
+func WriteCertificate(path string, der []byte) error {
+	return ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// WritePrivateKey writes privkey to path in PEM form, readable only by the
+// owner. RSA and ECDSA keys use their traditional encodings, other keys are
+// written in PKCS#8 form.
+func WritePrivateKey(path string, privkey interface{}) error {
+	var block *pem.Block
+	switch priv := privkey.(type) {
+	case *rsa.PrivateKey:
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)}
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(priv)
+		if err != nil {
+			return err
+		}
+		block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	default:
+		der, err := x509.MarshalPKCS8PrivateKey(privkey)
+		if err != nil {
+			return err
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	}
+	return ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600)
+}
+
+// ReadCertificate reads the first PEM encoded certificate in the file at path
+func ReadCertificate(path string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no certificate found in %s", path)
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
+
+// ReadPrivateKey reads a PEM encoded private key, either in PKCS#1, SEC 1 or
+// PKCS#8 form, from the file at path
+func ReadPrivateKey(path string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no private key found in %s", path)
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key type %T in %s", key, path)
+		}
+		return signer, nil
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q in %s", block.Type, path)
+	}
+}
+
 // ReadFileAndSplit tokenizes the given file and converts in into a slice split
 // by the newline character.
 func ReadFileAndSplit(filename string) ([]string, error) {
 	builder, err := ioutil.ReadFile(filename)
 	if err != nil {
-		PrintError(err)
 		return nil, err
 	}
 	data := string(builder)
@@ -118,7 +224,6 @@ func ReadFileAndSplit(filename string) ([]string, error) {
 func GetIncludedBundles(filename string) ([]string, error) {
 	lines, err := ReadFileAndSplit(filename)
 	if err != nil {
-		PrintError(err)
 		return nil, err
 	}
 
@@ -140,27 +245,23 @@ func GetIncludedBundles(filename string) ([]string, error) {
 func CopyFile(dest string, src string) error {
 	source, err := os.Open(src)
 	if err != nil {
-		PrintError(err)
 		return err
 	}
 	defer source.Close()
 
 	destination, err := os.Create(dest)
 	if err != nil {
-		PrintError(err)
 		return err
 	}
 	defer destination.Close()
 
 	_, err = io.Copy(destination, source)
 	if err != nil {
-		PrintError(err)
 		return err
 	}
 
 	err = destination.Sync()
 	if err != nil {
-		PrintError(err)
 		return err
 	}
 
@@ -169,6 +270,7 @@ func CopyFile(dest string, src string) error {
 
 // Download will attempt to download a from URL to the given filename
 func Download(filename string, url string) (err error) {
+	logger.Debug("Downloading %s to %s", url, filename)
 	infile, err := http.Get(url)
 	if err != nil {
 		return err
@@ -194,32 +296,25 @@ func Download(filename string, url string) (err error) {
 	return nil
 }
 
-// GetDirContents is an an assert-style helper to get the contents of a
-// directory, or to exit on failure.
-func GetDirContents(dirname string) []os.FileInfo {
-	files, err := ioutil.ReadDir(dirname)
-	if err != nil {
-		PrintError(err)
-		os.Exit(1)
-	}
-
-	return files
+// GetDirContents returns the contents of a directory sorted by name.
+func GetDirContents(dirname string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(dirname)
 }
 
-// Git runs git with arguments and exits in case of failure.
+// Git runs git with arguments, returning an error in case of failure.
 // IMPORTANT: the 'args' passed to this function _must_ be validated,
 // as to avoid cases where input is received from a third party source.
 // Such inputs could be something the likes of 'status; rm -rf .*'
 // and need to be escaped or avoided properly.
-func Git(args ...string) {
+func Git(args ...string) error {
+	logger.Debug("Running git %s", strings.Join(args, " "))
 	cmd := exec.Command("git", args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err := cmd.Run()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "ERROR: failed to run git %s: %v\n", strings.Join(args, " "), err)
-		os.Exit(1)
+	cmd.Stdout = logger.Stdout()
+	cmd.Stderr = logger.Stderr()
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to run git %s: %v", strings.Join(args, " "), err)
 	}
+	return nil
 }
 
 // CheckRPM returns nil if file <name>.rpm shows a valid RPM v# output,
@@ -227,11 +322,10 @@ func Git(args ...string) {
 func CheckRPM(rpm string) error {
 	output, err := exec.Command("file", rpm).Output()
 	if err != nil {
-		PrintError(err)
 		return err
 	}
 	if strings.Contains(string(output), "RPM v") {
 		return nil
 	}
-	return fmt.Errorf("ERROR: %s is not valid!", rpm)
+	return fmt.Errorf("%s is not a valid RPM", rpm)
 }
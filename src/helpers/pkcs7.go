@@ -0,0 +1,355 @@
+package helpers
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+)
+
+// Object identifiers used in PKCS#7 signed data, see RFC 5652
+var (
+	oidData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSigningTime   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+
+	oidSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+
+	oidRSAEncryption   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidSHA256WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidSHA384WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 12}
+	oidSHA512WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 13}
+	oidECPublicKey     = asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidECDSAWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}
+	oidECDSAWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}
+	oidEd25519         = asn1.ObjectIdentifier{1, 3, 101, 112}
+)
+
+// digestAlgorithms maps the digest algorithms supported in signatures to
+// their hash
+var digestAlgorithms = []struct {
+	oid  asn1.ObjectIdentifier
+	hash crypto.Hash
+}{
+	{oidSHA256, crypto.SHA256},
+	{oidSHA384, crypto.SHA384},
+	{oidSHA512, crypto.SHA512},
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"optional"`
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      contentInfo
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+type issuerAndSerial struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type signerInfo struct {
+	Version            int
+	IssuerAndSerial    issuerAndSerial
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+	UnsignedAttrs      asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values []asn1.RawValue `asn1:"set"`
+}
+
+// contextTag wraps the DER encoded contents in a constructed context
+// specific tag, as used for the implicitly tagged fields of PKCS#7
+func contextTag(tag int, contents []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: tag, IsCompound: true, Bytes: contents}
+}
+
+// marshalAttributes returns the DER encoding of the contents of a SET OF
+// attributes holding one value each, sorted as DER requires
+func marshalAttributes(oids []asn1.ObjectIdentifier, values []interface{}) ([]byte, error) {
+	var encoded [][]byte
+	for i, oid := range oids {
+		v, err := asn1.Marshal(values[i])
+		if err != nil {
+			return nil, err
+		}
+		a, err := asn1.Marshal(attribute{Type: oid, Values: []asn1.RawValue{{FullBytes: v}}})
+		if err != nil {
+			return nil, err
+		}
+		encoded = append(encoded, a)
+	}
+	sort.Slice(encoded, func(i, j int) bool {
+		return bytes.Compare(encoded[i], encoded[j]) < 0
+	})
+	return bytes.Join(encoded, nil), nil
+}
+
+// signedAttrsDigestInput returns the DER encoding of the signed attributes
+// as an explicit SET, which is what the signature covers
+func signedAttrsDigestInput(contents []byte) ([]byte, error) {
+	return asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: contents})
+}
+
+// signatureAlgorithm returns the PKCS#7 digest and signature algorithm
+// identifiers for key, along with the hash used for the message digest. RSA
+// keys sign with SHA-256, ECDSA keys with the hash matching their curve size
+// and Ed25519 keys follow RFC 8419, using SHA-512 for the message digest.
+func signatureAlgorithm(key crypto.PublicKey) (pkix.AlgorithmIdentifier, pkix.AlgorithmIdentifier, crypto.Hash, error) {
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		return pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue},
+			pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue},
+			crypto.SHA256, nil
+	case *ecdsa.PublicKey:
+		switch pub.Curve.Params().BitSize {
+		case 256:
+			return pkix.AlgorithmIdentifier{Algorithm: oidSHA256},
+				pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256},
+				crypto.SHA256, nil
+		case 384:
+			return pkix.AlgorithmIdentifier{Algorithm: oidSHA384},
+				pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA384},
+				crypto.SHA384, nil
+		default:
+			return pkix.AlgorithmIdentifier{}, pkix.AlgorithmIdentifier{}, 0, fmt.Errorf("unsupported curve %s", pub.Curve.Params().Name)
+		}
+	case ed25519.PublicKey:
+		return pkix.AlgorithmIdentifier{Algorithm: oidSHA512},
+			pkix.AlgorithmIdentifier{Algorithm: oidEd25519},
+			crypto.SHA512, nil
+	default:
+		return pkix.AlgorithmIdentifier{}, pkix.AlgorithmIdentifier{}, 0, fmt.Errorf("unsupported key type %T", key)
+	}
+}
+
+// digestHash returns the hash of the digest algorithm of si
+func digestHash(si *signerInfo) (crypto.Hash, error) {
+	for _, d := range digestAlgorithms {
+		if si.DigestAlgorithm.Algorithm.Equal(d.oid) {
+			return d.hash, nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported digest algorithm %v", si.DigestAlgorithm.Algorithm)
+}
+
+// x509SignatureAlgorithm maps the algorithms of a signer info to the
+// algorithm used to check the signature with the certificate. Signers may
+// either name the key type or the combined signature algorithm.
+func x509SignatureAlgorithm(si *signerInfo, hash crypto.Hash) (x509.SignatureAlgorithm, error) {
+	alg := si.SignatureAlgorithm.Algorithm
+	rsaAlgs := map[crypto.Hash]x509.SignatureAlgorithm{
+		crypto.SHA256: x509.SHA256WithRSA,
+		crypto.SHA384: x509.SHA384WithRSA,
+		crypto.SHA512: x509.SHA512WithRSA,
+	}
+	ecdsaAlgs := map[crypto.Hash]x509.SignatureAlgorithm{
+		crypto.SHA256: x509.ECDSAWithSHA256,
+		crypto.SHA384: x509.ECDSAWithSHA384,
+		crypto.SHA512: x509.ECDSAWithSHA512,
+	}
+
+	switch {
+	case alg.Equal(oidRSAEncryption):
+		return rsaAlgs[hash], nil
+	case alg.Equal(oidSHA256WithRSA):
+		return x509.SHA256WithRSA, nil
+	case alg.Equal(oidSHA384WithRSA):
+		return x509.SHA384WithRSA, nil
+	case alg.Equal(oidSHA512WithRSA):
+		return x509.SHA512WithRSA, nil
+	case alg.Equal(oidECPublicKey):
+		return ecdsaAlgs[hash], nil
+	case alg.Equal(oidECDSAWithSHA256):
+		return x509.ECDSAWithSHA256, nil
+	case alg.Equal(oidECDSAWithSHA384):
+		return x509.ECDSAWithSHA384, nil
+	case alg.Equal(oidECDSAWithSHA512):
+		return x509.ECDSAWithSHA512, nil
+	case alg.Equal(oidEd25519):
+		return x509.PureEd25519, nil
+	default:
+		return x509.UnknownSignatureAlgorithm, fmt.Errorf("unsupported signature algorithm %v", alg)
+	}
+}
+
+// SignPKCS7 returns a DER encoded, detached PKCS#7 signature of content made
+// with key, including cert so that clients can match it to their trusted
+// certificate. The signature carries the content type, signing time and
+// message digest as signed attributes, like openssl smime -sign -binary.
+// OpenSSL cannot verify Ed25519 signatures in PKCS#7, so only RSA and ECDSA
+// keys produce signatures swupd clients accept.
+func SignPKCS7(content []byte, cert *x509.Certificate, key crypto.Signer) ([]byte, error) {
+	digestAlg, sigAlg, hash, err := signatureAlgorithm(key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	h := hash.New()
+	h.Write(content)
+	attrs, err := marshalAttributes(
+		[]asn1.ObjectIdentifier{oidContentType, oidSigningTime, oidMessageDigest},
+		[]interface{}{oidData, time.Now().UTC(), h.Sum(nil)})
+	if err != nil {
+		return nil, err
+	}
+
+	toSign, err := signedAttrsDigestInput(attrs)
+	if err != nil {
+		return nil, err
+	}
+	var signature []byte
+	if sigAlg.Algorithm.Equal(oidEd25519) {
+		// Ed25519 signs the message itself, see RFC 8419.
+		signature, err = key.Sign(rand.Reader, toSign, crypto.Hash(0))
+	} else {
+		h = hash.New()
+		h.Write(toSign)
+		signature, err = key.Sign(rand.Reader, h.Sum(nil), hash)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sd := signedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{digestAlg},
+		ContentInfo:      contentInfo{ContentType: oidData},
+		Certificates:     contextTag(0, cert.Raw),
+		SignerInfos: []signerInfo{{
+			Version: 1,
+			IssuerAndSerial: issuerAndSerial{
+				Issuer:       asn1.RawValue{FullBytes: cert.RawIssuer},
+				SerialNumber: cert.SerialNumber,
+			},
+			DigestAlgorithm:    digestAlg,
+			SignedAttrs:        contextTag(0, attrs),
+			SignatureAlgorithm: sigAlg,
+			Signature:          signature,
+		}},
+	}
+	inner, err := asn1.Marshal(sd)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(contentInfo{ContentType: oidSignedData, Content: contextTag(0, inner)})
+}
+
+// VerifyPKCS7 checks that signature is a valid detached PKCS#7 signature of
+// content made with the key of cert. Certificates embedded in the signature
+// are ignored, cert is the only one trusted.
+func VerifyPKCS7(content []byte, signature []byte, cert *x509.Certificate) error {
+	var ci contentInfo
+	rest, err := asn1.Unmarshal(signature, &ci)
+	if err != nil {
+		return fmt.Errorf("invalid signature: %v", err)
+	}
+	if len(rest) > 0 {
+		return errors.New("invalid signature: trailing data")
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		return fmt.Errorf("invalid signature: content type %v is not signed data", ci.ContentType)
+	}
+
+	var sd signedData
+	if _, err = asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return fmt.Errorf("invalid signature: %v", err)
+	}
+	if len(sd.ContentInfo.Content.Bytes) > 0 {
+		return errors.New("invalid signature: signature is not detached")
+	}
+
+	for i := range sd.SignerInfos {
+		si := &sd.SignerInfos[i]
+		if !bytes.Equal(si.IssuerAndSerial.Issuer.FullBytes, cert.RawIssuer) ||
+			si.IssuerAndSerial.SerialNumber.Cmp(cert.SerialNumber) != 0 {
+			continue
+		}
+		return verifySignerInfo(content, si, cert)
+	}
+	return errors.New("signature was not made with the given certificate")
+}
+
+// verifySignerInfo checks the signature of si over content
+func verifySignerInfo(content []byte, si *signerInfo, cert *x509.Certificate) error {
+	hash, err := digestHash(si)
+	if err != nil {
+		return err
+	}
+	alg, err := x509SignatureAlgorithm(si, hash)
+	if err != nil {
+		return err
+	}
+	if len(si.SignedAttrs.Bytes) == 0 {
+		// Without signed attributes the signature covers the content.
+		return cert.CheckSignature(alg, content, si.Signature)
+	}
+
+	var attrs []attribute
+	rest := si.SignedAttrs.Bytes
+	for len(rest) > 0 {
+		var a attribute
+		if rest, err = asn1.Unmarshal(rest, &a); err != nil {
+			return fmt.Errorf("invalid signed attributes: %v", err)
+		}
+		attrs = append(attrs, a)
+	}
+
+	var messageDigest []byte
+	for _, a := range attrs {
+		if len(a.Values) != 1 {
+			continue
+		}
+		switch {
+		case a.Type.Equal(oidMessageDigest):
+			if _, err = asn1.Unmarshal(a.Values[0].FullBytes, &messageDigest); err != nil {
+				return fmt.Errorf("invalid message digest: %v", err)
+			}
+		case a.Type.Equal(oidContentType):
+			var ct asn1.ObjectIdentifier
+			if _, err = asn1.Unmarshal(a.Values[0].FullBytes, &ct); err != nil || !ct.Equal(oidData) {
+				return errors.New("signed content type is not data")
+			}
+		}
+	}
+	h := hash.New()
+	h.Write(content)
+	if !bytes.Equal(messageDigest, h.Sum(nil)) {
+		return errors.New("content does not match the signed message digest")
+	}
+
+	signed, err := signedAttrsDigestInput(si.SignedAttrs.Bytes)
+	if err != nil {
+		return err
+	}
+	return cert.CheckSignature(alg, signed, si.Signature)
+}
@@ -0,0 +1,110 @@
+package helpers
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// mustCreateTestCert returns a self signed certificate and its key
+func mustCreateTestCert(t *testing.T, algorithm string, size int) (*x509.Certificate, crypto.Signer) {
+	key, err := CreateKeyPair(algorithm, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template, err := CreateCertTemplate(pkix.Name{Organization: []string{"Mixer"}}, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+var testKeyTypes = []struct {
+	algorithm string
+	size      int
+}{
+	{KeyAlgorithmRSA, 2048},
+	{KeyAlgorithmECDSA, 256},
+	{KeyAlgorithmECDSA, 384},
+	{KeyAlgorithmEd25519, 0},
+}
+
+func TestSignVerifyPKCS7(t *testing.T) {
+	content := []byte("MANIFEST\t1\nversion:\t10\n")
+	for _, tt := range testKeyTypes {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			cert, key := mustCreateTestCert(t, tt.algorithm, tt.size)
+
+			sig, err := SignPKCS7(content, cert, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = VerifyPKCS7(content, sig, cert); err != nil {
+				t.Errorf("failed to verify signature: %v", err)
+			}
+
+			if err = VerifyPKCS7([]byte("tampered"), sig, cert); err == nil {
+				t.Error("VerifyPKCS7 accepted modified content")
+			}
+
+			other, _ := mustCreateTestCert(t, tt.algorithm, tt.size)
+			if err = VerifyPKCS7(content, sig, other); err == nil {
+				t.Error("VerifyPKCS7 accepted a signature made with another certificate")
+			}
+
+			sig[len(sig)-1] ^= 0xff
+			if err = VerifyPKCS7(content, sig, cert); err == nil {
+				t.Error("VerifyPKCS7 accepted a corrupted signature")
+			}
+		})
+	}
+}
+
+func TestWriteReadPrivateKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helpers-key-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tt := range testKeyTypes {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			key, err := CreateKeyPair(tt.algorithm, tt.size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(dir, tt.algorithm+".pem")
+			if err = WritePrivateKey(path, key); err != nil {
+				t.Fatal(err)
+			}
+			read, err := ReadPrivateKey(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !read.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(key.Public()) {
+				t.Error("read key does not match the written key")
+			}
+		})
+	}
+
+	if _, err := CreateKeyPair(KeyAlgorithmECDSA, 521); err == nil {
+		t.Error("CreateKeyPair accepted an unsupported curve")
+	}
+	if _, err := CreateKeyPair("dsa", 2048); err == nil {
+		t.Error("CreateKeyPair accepted an unsupported algorithm")
+	}
+}
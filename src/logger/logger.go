@@ -0,0 +1,225 @@
+// Package logger writes the messages of mixer to the console, filtered by
+// level, and to a log file keeping everything, including the output of the
+// programs mixer runs.
+package logger
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a message
+type Level int
+
+// Levels of messages, from the most verbose
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	default:
+		return "ERROR"
+	}
+}
+
+// timeFormat is the format of the timestamps in the log file
+const timeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+var (
+	mu      sync.Mutex
+	level             = LevelInfo
+	stdout  io.Writer = os.Stdout
+	stderr  io.Writer = os.Stderr
+	file    *os.File
+	newLine = true
+)
+
+// SetLevel sets the lowest level of the messages shown on the console. The
+// log file always gets every message.
+func SetLevel(l Level) {
+	mu.Lock()
+	level = l
+	mu.Unlock()
+}
+
+// SetConsole sets where the messages are shown, out gets the messages below
+// LevelError and the output of programs, err gets errors and the error
+// output of programs.
+func SetConsole(out io.Writer, err io.Writer) {
+	mu.Lock()
+	stdout, stderr = out, err
+	mu.Unlock()
+}
+
+// OpenFile starts writing every message to the log file at path, creating
+// its directory if needed. Messages are appended if the file exists.
+func OpenFile(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if file != nil {
+		file.Close()
+	}
+	file = f
+	newLine = true
+	return nil
+}
+
+// CloseFile stops writing to the log file
+func CloseFile() error {
+	mu.Lock()
+	defer mu.Unlock()
+	if file == nil {
+		return nil
+	}
+	err := file.Close()
+	file = nil
+	return err
+}
+
+// FilePath returns the path of the log file, or an empty string if there is
+// none
+func FilePath() string {
+	mu.Lock()
+	defer mu.Unlock()
+	if file == nil {
+		return ""
+	}
+	return file.Name()
+}
+
+// writeFile writes p to the log file, starting each line with the time and
+// l. mu must be held.
+func writeFile(l Level, p []byte) {
+	if file == nil {
+		return
+	}
+	prefix := fmt.Sprintf("%s %-5s ", time.Now().Format(timeFormat), l)
+	var b strings.Builder
+	for len(p) > 0 {
+		if newLine {
+			b.WriteString(prefix)
+		}
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			b.Write(p)
+			newLine = false
+			break
+		}
+		b.Write(p[:i+1])
+		p = p[i+1:]
+		newLine = true
+	}
+	// Failing to log must not fail the build.
+	file.WriteString(b.String())
+}
+
+// File writes msg to the log file only. It is used for messages that are
+// shown on the console in another form.
+func File(l Level, msg string) {
+	mu.Lock()
+	defer mu.Unlock()
+	if !newLine {
+		writeFile(l, []byte{'\n'})
+	}
+	writeFile(l, []byte(msg+"\n"))
+}
+
+// Log writes msg to the log file and shows it on the console if its level is
+// at least the one set with SetLevel
+func Log(l Level, msg string) {
+	mu.Lock()
+	defer mu.Unlock()
+	if !newLine {
+		writeFile(l, []byte{'\n'})
+	}
+	writeFile(l, []byte(msg+"\n"))
+	if l < level {
+		return
+	}
+	switch l {
+	case LevelDebug:
+		fmt.Fprintf(stdout, "DEBUG: %s\n", msg)
+	case LevelInfo:
+		fmt.Fprintln(stdout, msg)
+	case LevelWarn:
+		fmt.Fprintf(stdout, "WARNING: %s\n", msg)
+	default:
+		fmt.Fprintf(stderr, "***Error: %s\n", msg)
+	}
+}
+
+// Debug logs a message only shown on the console in verbose mode
+func Debug(format string, args ...interface{}) {
+	Log(LevelDebug, fmt.Sprintf(format, args...))
+}
+
+// Info logs a message about the progress of mixer
+func Info(format string, args ...interface{}) {
+	Log(LevelInfo, fmt.Sprintf(format, args...))
+}
+
+// Warn logs a problem that does not stop mixer
+func Warn(format string, args ...interface{}) {
+	Log(LevelWarn, fmt.Sprintf(format, args...))
+}
+
+// Error logs an error
+func Error(format string, args ...interface{}) {
+	Log(LevelError, fmt.Sprintf(format, args...))
+}
+
+// programWriter passes the output of a program to the console and the log
+// file
+type programWriter struct {
+	level   Level
+	console func() io.Writer
+}
+
+func (w *programWriter) Write(p []byte) (int, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	writeFile(w.level, p)
+	// The output of programs is only hidden in quiet mode, errors are
+	// always shown.
+	if w.level >= level {
+		w.console().Write(p)
+	}
+	return len(p), nil
+}
+
+// Stdout returns the writer to use as the standard output of programs run by
+// mixer. Their output is shown on the console unless in quiet mode and is
+// kept in the log file.
+func Stdout() io.Writer {
+	return &programWriter{level: LevelInfo, console: func() io.Writer { return stdout }}
+}
+
+// Stderr returns the writer to use as the standard error of programs run by
+// mixer. Their error output is always shown and is kept in the log file.
+func Stderr() io.Writer {
+	return &programWriter{level: LevelError, console: func() io.Writer { return stderr }}
+}
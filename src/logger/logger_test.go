@@ -0,0 +1,106 @@
+package logger
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestLevels(t *testing.T) {
+	var out, errOut bytes.Buffer
+	SetConsole(&out, &errOut)
+	defer SetConsole(os.Stdout, os.Stderr)
+	defer SetLevel(LevelInfo)
+
+	tests := []struct {
+		level  Level
+		out    string
+		errOut string
+	}{
+		{LevelDebug, "DEBUG: debug\ninfo\nWARNING: warn\nprogram\n", "***Error: error\nprogram error\n"},
+		{LevelInfo, "info\nWARNING: warn\nprogram\n", "***Error: error\nprogram error\n"},
+		{LevelWarn, "WARNING: warn\n", "***Error: error\nprogram error\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.level.String(), func(t *testing.T) {
+			out.Reset()
+			errOut.Reset()
+			SetLevel(tt.level)
+			Debug("debug")
+			Info("info")
+			Warn("warn")
+			Error("error")
+			fmt.Fprintln(Stdout(), "program")
+			fmt.Fprintln(Stderr(), "program error")
+			if out.String() != tt.out {
+				t.Errorf("unexpected output %q, expected %q", out.String(), tt.out)
+			}
+			if errOut.String() != tt.errOut {
+				t.Errorf("unexpected error output %q, expected %q", errOut.String(), tt.errOut)
+			}
+		})
+	}
+}
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logger-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var out bytes.Buffer
+	SetConsole(&out, &out)
+	defer SetConsole(os.Stdout, os.Stderr)
+	SetLevel(LevelWarn)
+	defer SetLevel(LevelInfo)
+
+	path := filepath.Join(dir, "logs", "10.log")
+	if err = OpenFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if FilePath() != path {
+		t.Errorf("FilePath() = %q, expected %q", FilePath(), path)
+	}
+	Debug("hidden on the console")
+	fmt.Fprint(Stdout(), "partial ")
+	fmt.Fprint(Stdout(), "line\nsecond line\nno newline")
+	File(LevelInfo, "file only")
+	if err = CloseFile(); err != nil {
+		t.Fatal(err)
+	}
+	Info("after closing")
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	expected := []string{
+		"DEBUG hidden on the console",
+		"INFO  partial line",
+		"INFO  second line",
+		"INFO  no newline",
+		"INFO  file only",
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %d lines, got:\n%s", len(expected), content)
+	}
+	timestamp := regexp.MustCompile(`^\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{3}\S* `)
+	for i, line := range lines {
+		if !timestamp.MatchString(line) {
+			t.Errorf("line %q has no timestamp", line)
+		}
+		if got := timestamp.ReplaceAllString(line, ""); got != expected[i] {
+			t.Errorf("line %d is %q, expected %q", i, got, expected[i])
+		}
+	}
+	if out.Len() != 0 {
+		t.Errorf("nothing should be shown in quiet mode, got %q", out.String())
+	}
+}
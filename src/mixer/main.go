@@ -10,7 +10,9 @@ import (
 	"strings"
 
 	"builder"
+	"events"
 	"helpers"
+	"logger"
 )
 
 type Command struct {
@@ -27,6 +29,16 @@ func init() {
 		{"build-chroots", "Build chroots for the mix", cmdBuildChroots},
 		{"build-update", "Build all update content for the mix", cmdBuildUpdate},
 		{"build-image", "Build an image from the mix content", cmdBuildImage},
+		{"build-packs", "Build zero and delta packs for a mix version", cmdBuildPacks},
+		{"build-superpacks", "Merge delta packs of a mix version into superpacks", cmdBuildSuperpacks},
+		{"cert", "Show, renew or rotate the signing certificate", cmdCert},
+		{"config", "Show, set or validate the mix configuration", cmdConfig},
+		{"versions", "List the versions built and published", cmdVersions},
+		{"prune", "Remove old versions and the content no longer needed", cmdPrune},
+		{"publish", "Upload a version to the update server and make it the latest", cmdPublish},
+		{"serve", "Serve the update content over HTTP for testing", cmdServe},
+		{"verify-signature", "Verify the signature of a Manifest.MoM", cmdVerifySignature},
+		{"verify-content", "Check the manifests, fullfiles and packs of a version", cmdVerifyContent},
 		{"add-rpms", "Add rpms to local yum repository", cmdAddRPMs},
 		{"get-bundles", "Get the clr-bundles from upstream", cmdGetBundles},
 		{"add-bundles", "Add clr-bundles to your mix", cmdAddBundles},
@@ -36,7 +48,7 @@ func init() {
 }
 
 func PrintMainHelp() {
-	fmt.Printf("usage: mixer <command> [args]\n")
+	fmt.Printf("usage: mixer [-v|-q] [-output=text|json] <command> [args]\n")
 	for _, cmd := range commands {
 		fmt.Printf("\t%-20s\t%s\n", cmd.Name, cmd.Description)
 	}
@@ -48,37 +60,55 @@ func CheckDeps() error {
 		"git",
 		"hardlink",
 		"m4",
-		"openssl",
-		"parallel",
 		"rpm",
+		"xz",
 		"yum",
 	}
 	for _, dep := range deps {
 		if _, err := exec.LookPath(dep); err != nil {
-			return fmt.Errorf("failed to find program %q: %v\n", dep, err)
+			return fmt.Errorf("failed to find program %q: %v", dep, err)
 		}
 	}
 	return nil
 }
 
 func main() {
-	fmt.Println("Mixer 3.1.0")
+	output := flag.String("output", events.FormatText, "Output format, text or json to write one JSON event per line")
+	verbose := flag.Bool("v", false, "Show debug messages")
+	quiet := flag.Bool("q", false, "Only show warnings and errors")
+	flag.Usage = PrintMainHelp
+	flag.Parse()
+	if err := events.SetFormat(*output); err != nil {
+		helpers.PrintError(err)
+		os.Exit(1)
+	}
+	if events.JSON() {
+		// The standard output only holds events.
+		logger.SetConsole(os.Stderr, os.Stderr)
+	}
+	if *verbose {
+		logger.SetLevel(logger.LevelDebug)
+	} else if *quiet {
+		logger.SetLevel(logger.LevelWarn)
+	}
+
+	events.Info("Mixer 3.1.0")
 	os.Setenv("LD_PRELOAD", "/usr/lib64/nosync/nosync.so")
 
-	if len(os.Args) == 1 {
+	if flag.NArg() == 0 {
 		PrintMainHelp()
 		return
 	}
 
 	var cmd *Command
-	name := os.Args[1]
+	name := flag.Arg(0)
 	if name == "-h" {
 		name = "help"
 	}
 	if name != "version" && name != "help" {
 		err := CheckDeps()
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			helpers.PrintError(err)
 			os.Exit(1)
 		}
 	}
@@ -90,11 +120,11 @@ func main() {
 	}
 
 	if cmd == nil {
-		fmt.Printf("%q is not a valid command.\n", name)
+		helpers.PrintError(fmt.Errorf("%q is not a valid command", name))
 		os.Exit(-1)
 	}
 
-	args := os.Args[2:]
+	args := flag.Args()[1:]
 	cmd.Run(args)
 }
 
@@ -113,7 +143,7 @@ func setupUpdateFlags(v *UpdateVars, fs *flag.FlagSet) {
 	fs.BoolVar(&v.Increment, "increment", false, "Automatically increment the mixversion post build")
 	fs.IntVar(&v.MinVersion, "minversion", 0, "Supply minversion to build update with")
 	fs.BoolVar(&v.NoSigning, "no-signing", false, "Do not generate a certificate and do not sign the Manifest.MoM")
-	fs.StringVar(&v.Prefix, "prefix", "", "Supply prefix for where the swupd binaries live")
+	fs.StringVar(&v.Prefix, "prefix", "", "Deprecated: swupd binaries are no longer used")
 	fs.BoolVar(&v.NoPublish, "no-publish", false, "Do not update the latest version after update")
 	fs.BoolVar(&v.KeepChroot, "keep-chroots", false, "Keep individual chroots created and not just consolidated 'full'")
 }
@@ -127,18 +157,25 @@ func cmdBuildAll(args []string) {
 
 	fs.Parse(args)
 
-	b := builder.NewFromConfig(*config)
+	b := newBuilder(*config)
+	openBuildLog(b, b.Mixver)
 	rpms, err := ioutil.ReadDir(b.Rpmdir)
 	if err == nil {
-		b.AddRPMList(rpms)
+		if err = b.AddRPMList(rpms); err != nil {
+			helpers.PrintError(err)
+			os.Exit(1)
+		}
 	}
 	BuildChroots(b, v.NoSigning)
-	err = b.BuildUpdate(v.Prefix, v.MinVersion, v.Format, v.NoSigning, !v.NoPublish, v.KeepChroot)
+	err = b.BuildUpdate(v.MinVersion, v.Format, v.NoSigning, !v.NoPublish, v.KeepChroot)
 	if err != nil {
 		os.Exit(-1)
 	}
 
-	b.UpdateMixVer()
+	if err = b.UpdateMixVer(); err != nil {
+		helpers.PrintError(err)
+		os.Exit(1)
+	}
 }
 
 func cmdBuildChroots(args []string) {
@@ -148,7 +185,8 @@ func cmdBuildChroots(args []string) {
 
 	fs.Parse(args)
 
-	b := builder.NewFromConfig(*config)
+	b := newBuilder(*config)
+	openBuildLog(b, b.Mixver)
 	BuildChroots(b, *noSigning)
 }
 
@@ -161,14 +199,18 @@ func cmdBuildUpdate(args []string) {
 
 	fs.Parse(args)
 
-	b := builder.NewFromConfig(*config)
-	err := b.BuildUpdate(v.Prefix, v.MinVersion, v.Format, v.NoSigning, !v.NoPublish, v.KeepChroot)
+	b := newBuilder(*config)
+	openBuildLog(b, b.Mixver)
+	err := b.BuildUpdate(v.MinVersion, v.Format, v.NoSigning, !v.NoPublish, v.KeepChroot)
 	if err != nil {
 		os.Exit(-1)
 	}
 
 	if v.Increment {
-		b.UpdateMixVer()
+		if err = b.UpdateMixVer(); err != nil {
+			helpers.PrintError(err)
+			os.Exit(1)
+		}
 	}
 }
 
@@ -180,8 +222,276 @@ func cmdBuildImage(args []string) {
 
 	imagecmd.Parse(args)
 
-	b := builder.NewFromConfig(*conf)
-	b.BuildImage(*imageformat, *imagetemplate)
+	b := newBuilder(*conf)
+	openBuildLog(b, b.Mixver)
+	if err := b.BuildImage(*imageformat, *imagetemplate); err != nil {
+		helpers.PrintError(err)
+		os.Exit(1)
+	}
+}
+
+func cmdBuildPacks(args []string) {
+	fs := flag.NewFlagSet("build-packs", flag.ExitOnError)
+	config := fs.String("config", "", "Supply a specific builder.conf to use for mixing")
+	to := fs.String("to", "", "Create packs for the given version, defaults to the mix version")
+	from := fs.String("from", "", "Comma-separated list of versions to create delta packs from")
+	zero := fs.Bool("zero", false, "Create zero packs. If -from is not given, this is the default")
+	force := fs.Bool("force", false, "Recreate packs if they already exist")
+	fs.Parse(args)
+
+	b := newBuilder(*config)
+	if *to == "" {
+		*to = b.Mixver
+	}
+	openBuildLog(b, *to)
+	var froms []string
+	if *from != "" {
+		froms = strings.Split(*from, ",")
+	} else {
+		*zero = true
+	}
+
+	if err := b.BuildPacks(*to, froms, *zero, *force); err != nil {
+		os.Exit(1)
+	}
+}
+
+func cmdBuildSuperpacks(args []string) {
+	fs := flag.NewFlagSet("build-superpacks", flag.ExitOnError)
+	config := fs.String("config", "", "Supply a specific builder.conf to use for mixing")
+	to := fs.String("to", "", "Create superpacks for the given version, defaults to the mix version")
+	count := fs.Int("count", 0, "Number of previous versions whose delta packs are merged")
+	keep := fs.Int("keep", 0, "Number of most recent delta packs to keep as they are")
+	fs.Parse(args)
+
+	if *count <= 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	b := newBuilder(*config)
+	if *to == "" {
+		*to = b.Mixver
+	}
+	openBuildLog(b, *to)
+	if err := b.BuildSuperpacks(*to, *count, *keep); err != nil {
+		os.Exit(1)
+	}
+}
+
+func cmdPrune(args []string) {
+	fs := flag.NewFlagSet("prune", flag.ExitOnError)
+	config := fs.String("config", "", "Supply a specific builder.conf to use for mixing")
+	keep := fs.Int("keep", 0, "Number of most recent versions to keep, the latest published versions are always kept")
+	dryRun := fs.Bool("dry-run", false, "Only list what would be removed")
+	fs.Parse(args)
+
+	if *keep <= 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	b := newBuilder(*config)
+	info, err := b.Prune(*keep, *dryRun)
+	if err != nil {
+		helpers.PrintError(err)
+		os.Exit(1)
+	}
+	verb := "Reclaimed"
+	if *dryRun {
+		verb = "Would reclaim"
+	}
+	events.Result(fmt.Sprintf("%s %d kB from %d versions, %d files removed",
+		verb, info.Bytes/1024, len(info.Versions), info.Files),
+		map[string]interface{}{"prune": info, "dry_run": *dryRun})
+}
+
+func cmdPublish(args []string) {
+	fs := flag.NewFlagSet("publish", flag.ExitOnError)
+	config := fs.String("config", "", "Supply a specific builder.conf to use for mixing")
+	fs.Usage = func() {
+		fmt.Println("usage: mixer publish [-config FILE] <version>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	b := newBuilder(*config)
+	if err := b.Publish(fs.Arg(0)); err != nil {
+		os.Exit(-1)
+	}
+}
+
+func cmdServe(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	config := fs.String("config", "", "Supply a specific builder.conf to use for mixing")
+	addr := fs.String("addr", "localhost:8080", "Address to listen on")
+	useTLS := fs.Bool("tls", false, "Serve over HTTPS with a generated self-signed certificate")
+	fs.Parse(args)
+
+	b := newBuilder(*config)
+	if err := b.Serve(*addr, *useTLS); err != nil {
+		helpers.PrintError(err)
+		os.Exit(1)
+	}
+}
+
+func cmdVerifySignature(args []string) {
+	fs := flag.NewFlagSet("verify-signature", flag.ExitOnError)
+	config := fs.String("config", "", "Supply a specific builder.conf to use for mixing")
+	version := fs.String("version", "", "Verify the Manifest.MoM of the given version, defaults to the mix version")
+	fs.Parse(args)
+
+	b := newBuilder(*config)
+	if *version == "" {
+		*version = b.Mixver
+	}
+	if err := b.VerifyManifestMOM(*version); err != nil {
+		helpers.PrintError(err)
+		os.Exit(1)
+	}
+	events.Result("Signature of Manifest.MoM for version "+*version+" is valid",
+		map[string]interface{}{"version": *version, "valid": true})
+}
+
+func cmdVerifyContent(args []string) {
+	fs := flag.NewFlagSet("verify-content", flag.ExitOnError)
+	config := fs.String("config", "", "Supply a specific builder.conf to use for mixing")
+	version := fs.String("version", "", "Verify the content of the given version, defaults to the mix version")
+	fs.Parse(args)
+
+	b := newBuilder(*config)
+	if *version == "" {
+		*version = b.Mixver
+	}
+	if err := b.VerifyContent(*version); err != nil {
+		os.Exit(1)
+	}
+	events.Result("Content of version "+*version+" is valid",
+		map[string]interface{}{"version": *version, "valid": true})
+}
+
+func cmdCert(args []string) {
+	usage := func() {
+		fmt.Println("usage: mixer cert <show|renew|rotate> [args]")
+		fmt.Printf("\t%-20s\t%s\n", "show", "Show the signing certificate")
+		fmt.Printf("\t%-20s\t%s\n", "renew", "Renew the signing certificate with the same key")
+		fmt.Printf("\t%-20s\t%s\n", "rotate", "Rotate the signing certificate to a new key")
+	}
+	if len(args) == 0 {
+		usage()
+		os.Exit(1)
+	}
+
+	fs := flag.NewFlagSet("cert "+args[0], flag.ExitOnError)
+	config := fs.String("config", "", "Supply a specific builder.conf to use for mixing")
+	var finish *bool
+	if args[0] == "rotate" {
+		finish = fs.Bool("finish", false, "Finish a pending rotation and sign with the new key")
+	}
+	fs.Parse(args[1:])
+
+	b := newBuilder(*config)
+	var err error
+	switch args[0] {
+	case "show":
+		err = b.ShowCertificate()
+	case "renew":
+		err = b.RenewCertificate()
+	case "rotate":
+		err = b.RotateCertificate(*finish)
+	default:
+		usage()
+		os.Exit(1)
+	}
+	if err != nil {
+		helpers.PrintError(err)
+		os.Exit(1)
+	}
+}
+
+func cmdConfig(args []string) {
+	usage := func() {
+		fmt.Println("usage: mixer config <show|set|validate> [args]")
+		fmt.Printf("\t%-20s\t%s\n", "show", "Show the effective configuration and where it comes from")
+		fmt.Printf("\t%-20s\t%s\n", "set KEY VALUE", "Set KEY to VALUE in builder.conf")
+		fmt.Printf("\t%-20s\t%s\n", "validate", "Check the configured paths and values")
+	}
+	if len(args) == 0 {
+		usage()
+		os.Exit(1)
+	}
+
+	fs := flag.NewFlagSet("config "+args[0], flag.ExitOnError)
+	config := fs.String("config", "", "Supply a specific builder.conf to use for mixing")
+	fs.Parse(args[1:])
+
+	b := builder.New()
+	if err := b.LoadBuilderConf(*config); err != nil {
+		helpers.PrintError(err)
+		os.Exit(1)
+	}
+	var err error
+	switch args[0] {
+	case "show":
+		if err = b.ReadBuilderConf(); err == nil {
+			err = b.ShowConfig()
+		}
+	case "set":
+		if fs.NArg() != 2 {
+			usage()
+			os.Exit(1)
+		}
+		err = b.SetConfig(fs.Arg(0), fs.Arg(1))
+	case "validate":
+		errs := b.ValidateConfig()
+		for _, e := range errs {
+			helpers.PrintError(e)
+		}
+		if len(errs) > 0 {
+			os.Exit(1)
+		}
+		events.Result(b.Buildconf+" is valid", map[string]interface{}{"file": b.Buildconf, "valid": true})
+	default:
+		usage()
+		os.Exit(1)
+	}
+	if err != nil {
+		helpers.PrintError(err)
+		os.Exit(1)
+	}
+}
+
+func cmdVersions(args []string) {
+	usage := func() {
+		fmt.Println("usage: mixer versions <list> [args]")
+		fmt.Printf("\t%-20s\t%s\n", "list", "List the versions in the www directory and whether they are complete")
+	}
+	if len(args) == 0 || args[0] != "list" {
+		usage()
+		os.Exit(1)
+	}
+
+	fs := flag.NewFlagSet("versions "+args[0], flag.ExitOnError)
+	config := fs.String("config", "", "Supply a specific builder.conf to use for mixing")
+	fs.Parse(args[1:])
+
+	b := builder.New()
+	err := b.LoadBuilderConf(*config)
+	if err == nil {
+		err = b.ReadBuilderConf()
+	}
+	if err == nil {
+		err = b.ShowVersions()
+	}
+	if err != nil {
+		helpers.PrintError(err)
+		os.Exit(1)
+	}
 }
 
 func cmdAddRPMs(args []string) {
@@ -189,21 +499,28 @@ func cmdAddRPMs(args []string) {
 	conf := flags.String("config", "", "Supply a specific builder.conf to use for mixing")
 	flags.Parse(args)
 
-	b := builder.NewFromConfig(*conf)
+	b := newBuilder(*conf)
 	rpms, err := ioutil.ReadDir(b.Rpmdir)
 	if err != nil {
-		fmt.Printf("ERROR: cannot read %s\n", b.Rpmdir)
+		helpers.PrintError(fmt.Errorf("cannot read %s: %v", b.Rpmdir, err))
+		os.Exit(1)
+	}
+	if err = b.AddRPMList(rpms); err != nil {
+		helpers.PrintError(err)
+		os.Exit(1)
 	}
-	b.AddRPMList(rpms)
 }
 
 func cmdGetBundles(args []string) {
 	bundlescmd := flag.NewFlagSet("get-bundles", flag.ExitOnError)
 	bundleconf := bundlescmd.String("config", "", "Supply a specific builder.conf to use for mixing")
 	bundlescmd.Parse(args)
-	b := builder.NewFromConfig(*bundleconf)
-	fmt.Println("Getting clr-bundles for version " + b.Clearver)
-	b.UpdateRepo(b.Clearver, false)
+	b := newBuilder(*bundleconf)
+	events.Info("Getting clr-bundles for version %s", b.Clearver)
+	if err := b.UpdateRepo(b.Clearver, false); err != nil {
+		helpers.PrintError(err)
+		os.Exit(1)
+	}
 }
 
 func cmdAddBundles(args []string) {
@@ -219,9 +536,12 @@ func cmdAddBundles(args []string) {
 		os.Exit(1)
 	}
 
-	b := builder.NewFromConfig(*conf)
+	b := newBuilder(*conf)
 	bundles := strings.Split(*bundlesarg, ",")
-	b.AddBundles(bundles, *force, *git)
+	if _, err := b.AddBundles(bundles, *force, *git); err != nil {
+		helpers.PrintError(err)
+		os.Exit(1)
+	}
 }
 
 func cmdInitMix(args []string) {
@@ -232,9 +552,36 @@ func cmdInitMix(args []string) {
 	initconf := initcmd.String("config", "", "Supply a specific builder.conf to use for mixing")
 	initcmd.Parse(args)
 	b := builder.New()
-	b.LoadBuilderConf(*initconf)
-	b.ReadBuilderConf()
-	b.InitMix(strconv.Itoa(*clearflag), strconv.Itoa(*mixflag), *allflag)
+	err := b.LoadBuilderConf(*initconf)
+	if err == nil {
+		err = b.ReadBuilderConf()
+	}
+	if err == nil {
+		err = b.InitMix(strconv.Itoa(*clearflag), strconv.Itoa(*mixflag), *allflag)
+	}
+	if err != nil {
+		helpers.PrintError(err)
+		os.Exit(1)
+	}
+}
+
+// openBuildLog keeps the log of the build of version, exiting on failure
+func openBuildLog(b *builder.Builder, version string) {
+	if err := b.OpenBuildLog(version); err != nil {
+		helpers.PrintError(err)
+		os.Exit(1)
+	}
+	logger.Debug("Running %s", strings.Join(os.Args, " "))
+}
+
+// newBuilder loads the configuration of the mix, exiting on failure
+func newBuilder(config string) *builder.Builder {
+	b, err := builder.NewFromConfig(config)
+	if err != nil {
+		helpers.PrintError(err)
+		os.Exit(1)
+	}
+	return b
 }
 
 func cmdHelp(args []string) {
@@ -244,12 +591,17 @@ func cmdHelp(args []string) {
 func BuildChroots(builder *builder.Builder, signflag bool) {
 	// Create the signing and validation key/cert
 	if _, err := os.Stat(builder.Cert); os.IsNotExist(err) {
-		fmt.Println("Generating certificate for signature validation...")
-		privkey, err := helpers.CreateKeyPair()
+		events.Info("Generating certificate for signature validation...")
+		privkey, err := builder.NewKeyPair()
+		if err != nil {
+			helpers.PrintError(err)
+			os.Exit(1)
+		}
+		template, err := builder.NewCertTemplate()
 		if err != nil {
+			helpers.PrintError(err)
 			os.Exit(1)
 		}
-		template := helpers.CreateCertTemplate()
 
 		err = builder.BuildChroots(template, privkey, signflag)
 		if err != nil {
@@ -0,0 +1,154 @@
+package swupd
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+
+	"logger"
+)
+
+// xzWriter compresses everything written to it with the xz program
+type xzWriter struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+}
+
+// newXzWriter returns a writer that xz compresses its input into out. Close
+// must be called to wait for the compression to finish.
+func newXzWriter(out io.Writer) (*xzWriter, error) {
+	cmd := exec.Command("xz", "--stdout", "--threads=1", "-")
+	cmd.Stdout = out
+	cmd.Stderr = logger.Stderr()
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to run xz: %v", err)
+	}
+	return &xzWriter{cmd: cmd, stdin: stdin}, nil
+}
+
+func (x *xzWriter) Write(p []byte) (int, error) {
+	return x.stdin.Write(p)
+}
+
+func (x *xzWriter) Close() error {
+	err := x.stdin.Close()
+	if werr := x.cmd.Wait(); werr != nil {
+		return fmt.Errorf("xz failed: %v", werr)
+	}
+	return err
+}
+
+// compressor writes a compressed copy of in to out
+type compressor struct {
+	name     string
+	compress func(in io.Reader, out io.Writer) error
+}
+
+func gzipCompress(in io.Reader, out io.Writer) error {
+	w, err := gzip.NewWriterLevel(out, gzip.BestCompression)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(w, in); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// externalCompressor returns a compressor that runs program, or nil when the
+// program is not installed
+func externalCompressor(program string, args ...string) *compressor {
+	if _, err := exec.LookPath(program); err != nil {
+		return nil
+	}
+	return &compressor{
+		name: program,
+		compress: func(in io.Reader, out io.Writer) error {
+			var stderr bytes.Buffer
+			cmd := exec.Command(program, args...)
+			cmd.Stdin = in
+			cmd.Stdout = out
+			cmd.Stderr = &stderr
+			if err := cmd.Run(); err != nil {
+				return fmt.Errorf("%s failed: %v: %s", program, err, stderr.String())
+			}
+			return nil
+		},
+	}
+}
+
+// availableCompressors returns the compressors to try for fullfiles, like
+// swupd-server these are gzip, bzip2 and xz. Compressors whose program is
+// missing on the system are left out.
+func availableCompressors() []*compressor {
+	compressors := []*compressor{{name: "gzip", compress: gzipCompress}}
+	for _, c := range []*compressor{
+		externalCompressor("bzip2", "--stdout", "-9"),
+		externalCompressor("xz", "--stdout", "--threads=1", "-9"),
+	} {
+		if c != nil {
+			compressors = append(compressors, c)
+		}
+	}
+	return compressors
+}
+
+// compressedReader wraps a decompressing reader and the resources it holds
+type compressedReader struct {
+	io.Reader
+	close func() error
+}
+
+func (c *compressedReader) Close() error {
+	if c.close == nil {
+		return nil
+	}
+	return c.close()
+}
+
+// openCompressed returns a reader that decompresses r, which may be gzip,
+// bzip2 or xz compressed or not compressed at all.
+func openCompressed(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(6)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return gz, nil
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		return &compressedReader{Reader: bzip2.NewReader(br)}, nil
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		cmd := exec.Command("xz", "--decompress", "--stdout", "-")
+		cmd.Stdin = br
+		cmd.Stderr = ioutil.Discard
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err = cmd.Start(); err != nil {
+			return nil, fmt.Errorf("failed to run xz: %v", err)
+		}
+		return &compressedReader{Reader: out, close: func() error {
+			// Drain the output so xz does not block on a full pipe.
+			io.Copy(ioutil.Discard, out)
+			return cmd.Wait()
+		}}, nil
+	}
+	return &compressedReader{Reader: br}, nil
+}
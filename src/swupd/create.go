@@ -0,0 +1,557 @@
+package swupd
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"logger"
+)
+
+// MoMName is the name of the manifest of manifests
+const MoMName = "MoM"
+
+// FullName is the name of the manifest describing the full chroot
+const FullName = "full"
+
+// Paths that get a special modifier flag in the manifests. The lists mirror
+// the heuristics used by swupd-server.
+var configPrefixes = []string{"/etc/"}
+
+var statePrefixes = []string{
+	"/data",
+	"/dev/",
+	"/home/",
+	"/lost+found",
+	"/proc/",
+	"/root/",
+	"/run/",
+	"/sys/",
+	"/tmp/",
+	"/var/",
+	"/usr/src/debug",
+}
+
+var bootPrefixes = []string{
+	"/boot/",
+	"/usr/lib/modules/",
+	"/usr/lib/kernel/",
+	"/usr/lib/gummiboot",
+	"/usr/bin/gummiboot",
+	"/usr/lib/systemd/boot",
+}
+
+func hasAnyPrefix(name string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyHeuristics sets the modifier flag on f based on its path
+func (f *File) applyHeuristics() {
+	switch {
+	case hasAnyPrefix(f.Name, configPrefixes):
+		f.Modifier = modifierConfig
+	case hasAnyPrefix(f.Name, statePrefixes):
+		f.Modifier = modifierState
+	case hasAnyPrefix(f.Name, bootPrefixes):
+		f.Modifier = modifierBoot
+	}
+}
+
+// readLastVersion returns the version stored in image/LAST_VER, or zero when
+// no version was built before.
+func readLastVersion(statedir string) (uint32, error) {
+	data, err := ioutil.ReadFile(filepath.Join(statedir, "image", "LAST_VER"))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	parsed, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LAST_VER: %v", err)
+	}
+	return uint32(parsed), nil
+}
+
+// readBundleNames returns the bundles to create manifests for. The list comes
+// from the groups.ini file in the state directory when it exists, otherwise
+// every chroot in the image directory is considered a bundle.
+func readBundleNames(statedir, imageBase string) ([]string, error) {
+	var bundles []string
+
+	groups, err := os.Open(filepath.Join(statedir, "groups.ini"))
+	if err == nil {
+		defer groups.Close()
+		input := bufio.NewScanner(groups)
+		for input.Scan() {
+			line := strings.TrimSpace(input.Text())
+			if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+				bundles = append(bundles, strings.TrimSpace(line[1:len(line)-1]))
+			}
+		}
+		if err = input.Err(); err != nil {
+			return nil, err
+		}
+		sort.Strings(bundles)
+		return bundles, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	entries, err := ioutil.ReadDir(imageBase)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if !e.IsDir() || e.Name() == FullName || e.Name() == "noship" {
+			continue
+		}
+		bundles = append(bundles, e.Name())
+	}
+	return bundles, nil
+}
+
+// readIncludes returns the bundles included by bundle, as recorded by the
+// chroot builder in noship/<bundle>-includes. Every bundle but os-core
+// implicitly includes os-core.
+func readIncludes(imageBase, bundle string) ([]string, error) {
+	var includes []string
+	if bundle != "os-core" {
+		includes = append(includes, "os-core")
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(imageBase, "noship", bundle+"-includes"))
+	if os.IsNotExist(err) {
+		return includes, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line == "os-core" {
+			continue
+		}
+		includes = append(includes, line)
+	}
+	return includes, nil
+}
+
+// addFilesFromChroot walks the chroot at root and adds an entry for every file,
+// directory and symlink found to m, hashed and marked with version.
+func (m *Manifest) addFilesFromChroot(root string, version uint32) error {
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return fmt.Errorf("chroot %s does not exist", root)
+	}
+
+	return filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+
+		file := &File{
+			Name:    "/" + strings.TrimPrefix(path, root+"/"),
+			Version: version,
+			Info:    fi,
+		}
+
+		switch {
+		case fi.Mode().IsRegular():
+			file.Type = typeFile
+		case fi.IsDir():
+			file.Type = typeDirectory
+		case fi.Mode()&os.ModeSymlink != 0:
+			file.Type = typeLink
+		default:
+			return fmt.Errorf("%s is not a file, directory or symlink", path)
+		}
+
+		if file.Hash, err = GetHashForFile(path); err != nil {
+			return err
+		}
+
+		file.applyHeuristics()
+		m.Files = append(m.Files, file)
+		return nil
+	})
+}
+
+// subtractManifests removes every file that is also present in one of the
+// given manifests from m.
+func (m *Manifest) subtractManifests(others ...*Manifest) {
+	provided := make(map[string]bool)
+	for _, o := range others {
+		for _, f := range o.Files {
+			if f.Status != statusDeleted {
+				provided[f.Name] = true
+			}
+		}
+	}
+
+	files := m.Files[:0]
+	for _, f := range m.Files {
+		if !provided[f.Name] {
+			files = append(files, f)
+		}
+	}
+	m.Files = files
+}
+
+// includeClosure returns every bundle included by bundle, directly or
+// through other included bundles.
+func includeClosure(bundle string, includes map[string][]string) []string {
+	var result []string
+	seen := map[string]bool{bundle: true}
+	queue := append([]string(nil), includes[bundle]...)
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		result = append(result, name)
+		queue = append(queue, includes[name]...)
+	}
+	return result
+}
+
+// linkToPrevious compares the files in m against the previous version of the
+// manifest. Unchanged files keep the version they were last changed in, files
+// gone since the previous version get a deleted entry and renamed files get
+// flagged. The result reports whether anything changed compared to old.
+func (m *Manifest) linkToPrevious(old *Manifest, minVersion uint32) bool {
+	changed := false
+
+	oldFiles := make(map[string]*File)
+	if old != nil {
+		for _, f := range old.Files {
+			oldFiles[f.Name] = f
+		}
+	}
+
+	present := make(map[string]bool)
+	for _, f := range m.Files {
+		present[f.Name] = true
+		if of, ok := oldFiles[f.Name]; ok && of.Status != statusDeleted &&
+			of.Type == f.Type && of.Modifier == f.Modifier && HashEquals(of.Hash, f.Hash) {
+			f.Version = of.Version
+		} else {
+			changed = true
+		}
+		if f.Version < minVersion {
+			f.Version = minVersion
+			changed = true
+		}
+	}
+
+	if old != nil {
+		for _, of := range old.Files {
+			if present[of.Name] {
+				continue
+			}
+			if of.Status == statusDeleted {
+				// Deleted entries older than the minimum version are
+				// dropped, clients that old need a full update anyway.
+				if of.Version >= minVersion {
+					m.Files = append(m.Files, &File{
+						Name:    of.Name,
+						Version: of.Version,
+						Status:  statusDeleted,
+					})
+				} else {
+					changed = true
+				}
+				continue
+			}
+			m.Files = append(m.Files, &File{
+				Name:    of.Name,
+				Version: m.Header.Version,
+				Status:  statusDeleted,
+			})
+			changed = true
+		}
+	}
+
+	if old == nil {
+		return true
+	}
+	if len(old.Files) != len(m.Files) {
+		changed = true
+	}
+
+	// Flag the files that replace a file deleted in this version.
+	if changed {
+		DiffManifests(old, m)
+	}
+	return changed
+}
+
+// sortFiles sorts the entries of m by file name, which is the order used in
+// manifest files.
+func (m *Manifest) sortFiles() {
+	sort.Slice(m.Files, func(i, j int) bool {
+		return m.Files[i].Name < m.Files[j].Name
+	})
+}
+
+// updateHeaderCounts sets the filecount and contentsize headers from the
+// entries of m.
+func (m *Manifest) updateHeaderCounts() {
+	m.Header.FileCount = uint32(len(m.Files))
+	m.Header.ContentSize = 0
+	for _, f := range m.Files {
+		if f.Info != nil && f.Status != statusDeleted {
+			m.Header.ContentSize += uint64(f.Info.Size())
+		}
+	}
+}
+
+// readPreviousManifest reads Manifest.<name> at version ver from the www
+// directory, returning nil if there is no such manifest.
+func readPreviousManifest(wwwDir string, ver uint32, name string) (*Manifest, error) {
+	if ver == 0 {
+		return nil, nil
+	}
+	path := filepath.Join(wwwDir, fmt.Sprint(ver), "Manifest."+name)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	m := &Manifest{}
+	if err := m.ReadManifestFromFile(path); err != nil {
+		return nil, fmt.Errorf("failed to read previous manifest %s: %v", path, err)
+	}
+	return m, nil
+}
+
+// writeManifestTar writes the manifest file at path into path.tar, which is
+// what swupd clients download.
+func writeManifestTar(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(path + ".tar")
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	tw := tar.NewWriter(out)
+	hdr, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return err
+	}
+	hdr.Uname = ""
+	hdr.Gname = ""
+	if err = tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err = io.Copy(tw, in); err != nil {
+		return err
+	}
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// writeManifest writes m to Manifest.<name> in outputDir along with the tar
+// archive clients download, and returns the hash of the written manifest.
+func (m *Manifest) writeManifest(outputDir string) (hashval, error) {
+	path := filepath.Join(outputDir, "Manifest."+m.Name)
+	if err := m.WriteManifestFile(path); err != nil {
+		return 0, err
+	}
+	if err := writeManifestTar(path); err != nil {
+		return 0, err
+	}
+
+	return GetHashForFile(path)
+}
+
+// CreateManifests creates the manifests for version from the bundle chroots
+// in <statedir>/image/<version> and writes them to <statedir>/www/<version>.
+// Each bundle manifest is compared to its previous version, as recorded in
+// image/LAST_VER, so only bundles that changed get a new manifest. Files older
+// than minVersion are bumped to minVersion. The resulting MoM is returned.
+func CreateManifests(version uint32, minVersion uint32, format uint, statedir string) (*MoM, error) {
+	if version == 0 {
+		return nil, fmt.Errorf("invalid version %d", version)
+	}
+
+	imageBase := filepath.Join(statedir, "image", fmt.Sprint(version))
+	wwwDir := filepath.Join(statedir, "www")
+	outputDir := filepath.Join(wwwDir, fmt.Sprint(version))
+
+	lastVersion, err := readLastVersion(statedir)
+	if err != nil {
+		return nil, err
+	}
+	if lastVersion >= version {
+		return nil, fmt.Errorf("version %d must be greater than the last version %d", version, lastVersion)
+	}
+
+	oldVersions := make(map[string]uint32)
+	if lastVersion > 0 {
+		oldMoM := &MoM{}
+		path := filepath.Join(wwwDir, fmt.Sprint(lastVersion), "Manifest."+MoMName)
+		err = oldMoM.ReadMoMFromFile(path)
+		if err == nil {
+			oldVersions = oldMoM.Versions()
+		} else if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read previous MoM %s: %v", path, err)
+		}
+	}
+
+	bundles, err := readBundleNames(statedir, imageBase)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.MkdirAll(outputDir, 0755); err != nil {
+		return nil, err
+	}
+
+	timestamp := time.Now()
+	newHeader := func(name string) ManifestHeader {
+		return ManifestHeader{
+			Format:    format,
+			Version:   version,
+			Previous:  oldVersions[name],
+			TimeStamp: timestamp,
+		}
+	}
+
+	// Read every bundle chroot first, included bundles are subtracted from
+	// the bundles that include them.
+	manifests := make(map[string]*Manifest)
+	for _, bundle := range bundles {
+		m := &Manifest{Name: bundle, Header: newHeader(bundle)}
+		if err = m.addFilesFromChroot(filepath.Join(imageBase, bundle), version); err != nil {
+			return nil, err
+		}
+		manifests[bundle] = m
+	}
+
+	mom := &MoM{
+		Header: ManifestHeader{
+			Format:    format,
+			Version:   version,
+			Previous:  lastVersion,
+			TimeStamp: timestamp,
+		},
+	}
+
+	includes := make(map[string][]string)
+	for _, bundle := range bundles {
+		if includes[bundle], err = readIncludes(imageBase, bundle); err != nil {
+			return nil, err
+		}
+		for _, name := range includes[bundle] {
+			if _, ok := manifests[name]; !ok {
+				return nil, fmt.Errorf("bundle %s includes unknown bundle %s", bundle, name)
+			}
+			manifests[bundle].Header.Includes = append(manifests[bundle].Header.Includes, &Manifest{Name: name})
+		}
+	}
+
+	// Subtract against copies of the chroot contents, so that the order in
+	// which bundles are processed does not matter.
+	chroots := make(map[string]*Manifest)
+	for name, m := range manifests {
+		chroots[name] = &Manifest{Files: append([]*File(nil), m.Files...)}
+	}
+	for _, bundle := range bundles {
+		var included []*Manifest
+		for _, name := range includeClosure(bundle, includes) {
+			included = append(included, chroots[name])
+		}
+		manifests[bundle].subtractManifests(included...)
+	}
+
+	for _, bundle := range bundles {
+		m := manifests[bundle]
+		old, err := readPreviousManifest(wwwDir, oldVersions[bundle], bundle)
+		if err != nil {
+			return nil, err
+		}
+
+		if m.linkToPrevious(old, minVersion) {
+			m.sortFiles()
+			m.updateHeaderCounts()
+			if m.Hash, err = m.writeManifest(outputDir); err != nil {
+				return nil, fmt.Errorf("failed to write manifest for %s: %v", bundle, err)
+			}
+			logger.Debug("Wrote manifest for bundle %s with %d files", bundle, len(m.Files))
+		} else {
+			// Nothing changed, the MoM keeps pointing at the old manifest.
+			old.Hash, err = GetHashForFile(filepath.Join(wwwDir, fmt.Sprint(old.Header.Version), "Manifest."+bundle))
+			if err != nil {
+				return nil, err
+			}
+			old.Name = bundle
+			m = old
+			logger.Debug("Bundle %s did not change since version %d", bundle, old.Header.Version)
+		}
+
+		mom.SubManifests = append(mom.SubManifests, m)
+		mom.Header.ContentSize += m.Header.ContentSize
+	}
+
+	full := &Manifest{Name: FullName, Header: newHeader(FullName)}
+	full.Header.Previous = lastVersion
+	if err = full.addFilesFromChroot(filepath.Join(imageBase, FullName), version); err != nil {
+		return nil, err
+	}
+	oldFull, err := readPreviousManifest(wwwDir, lastVersion, FullName)
+	if err != nil {
+		return nil, err
+	}
+	full.linkToPrevious(oldFull, minVersion)
+	full.sortFiles()
+	full.updateHeaderCounts()
+	if _, err = full.writeManifest(outputDir); err != nil {
+		return nil, fmt.Errorf("failed to write full manifest: %v", err)
+	}
+
+	mom.Header.FileCount = uint32(len(mom.SubManifests))
+	momPath := filepath.Join(outputDir, "Manifest."+MoMName)
+	if err = mom.WriteMoMFile(momPath); err != nil {
+		return nil, fmt.Errorf("failed to write MoM: %v", err)
+	}
+	if err = writeManifestTar(momPath); err != nil {
+		return nil, fmt.Errorf("failed to write MoM: %v", err)
+	}
+	mom.wwwDir = wwwDir
+
+	return mom, nil
+}
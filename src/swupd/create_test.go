@@ -0,0 +1,128 @@
+package swupd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// mustWriteChrootFile creates a file with content inside a chroot for
+// version, creating parent directories as needed.
+func mustWriteChrootFile(t *testing.T, statedir, version, bundle, name, content string) {
+	path := filepath.Join(statedir, "image", version, bundle, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// findFile returns the entry named name in m or nil
+func findFile(m *Manifest, name string) *File {
+	for _, f := range m.Files {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+func mustReadManifest(t *testing.T, path string) *Manifest {
+	m := &Manifest{}
+	if err := m.ReadManifestFromFile(path); err != nil {
+		t.Fatalf("failed to read %s: %v", path, err)
+	}
+	return m
+}
+
+func TestCreateManifests(t *testing.T) {
+	statedir, err := ioutil.TempDir("", "swupd-create-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(statedir)
+
+	for _, bundle := range []string{"os-core", "full"} {
+		mustWriteChrootFile(t, statedir, "10", bundle, "usr/bin/core", "core")
+	}
+	for _, bundle := range []string{"test-bundle", "full"} {
+		mustWriteChrootFile(t, statedir, "10", bundle, "usr/bin/core", "core")
+		mustWriteChrootFile(t, statedir, "10", bundle, "usr/bin/test", "test 10")
+		mustWriteChrootFile(t, statedir, "10", bundle, "usr/share/test/data", "data")
+		mustWriteChrootFile(t, statedir, "10", bundle, "etc/test.conf", "conf")
+	}
+
+	mom, err := CreateManifests(10, 0, 1, statedir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mom.SubManifests) != 2 {
+		t.Fatalf("expected 2 bundles in the MoM, got %d", len(mom.SubManifests))
+	}
+
+	www10 := filepath.Join(statedir, "www", "10")
+	bundle := mustReadManifest(t, filepath.Join(www10, "Manifest.test-bundle"))
+	if f := findFile(bundle, "/usr/bin/core"); f != nil {
+		t.Error("file provided by os-core was not subtracted from test-bundle")
+	}
+	if f := findFile(bundle, "/usr/bin/test"); f == nil || f.Version != 10 || f.Type != typeFile {
+		t.Errorf("unexpected entry for /usr/bin/test: %+v", f)
+	}
+	if f := findFile(bundle, "/etc/test.conf"); f == nil || f.Modifier != modifierConfig {
+		t.Errorf("config modifier not set on /etc/test.conf: %+v", f)
+	}
+	if len(bundle.Header.Includes) != 1 || bundle.Header.Includes[0].Name != "os-core" {
+		t.Errorf("test-bundle does not include os-core: %v", bundle.Header.Includes)
+	}
+	for _, name := range []string{"Manifest.MoM", "Manifest.full", "Manifest.os-core.tar"} {
+		if _, err := os.Stat(filepath.Join(www10, name)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Build version 20 where only test-bundle changes.
+	if err = ioutil.WriteFile(filepath.Join(statedir, "image", "LAST_VER"), []byte("10"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, bundle := range []string{"os-core", "full"} {
+		mustWriteChrootFile(t, statedir, "20", bundle, "usr/bin/core", "core")
+	}
+	for _, bundle := range []string{"test-bundle", "full"} {
+		mustWriteChrootFile(t, statedir, "20", bundle, "usr/bin/core", "core")
+		mustWriteChrootFile(t, statedir, "20", bundle, "usr/bin/test", "test 20")
+		mustWriteChrootFile(t, statedir, "20", bundle, "usr/share/test/data", "data")
+	}
+
+	if _, err = CreateManifests(20, 0, 1, statedir); err != nil {
+		t.Fatal(err)
+	}
+
+	www20 := filepath.Join(statedir, "www", "20")
+	if _, err = os.Stat(filepath.Join(www20, "Manifest.os-core")); !os.IsNotExist(err) {
+		t.Error("unchanged os-core manifest was written again")
+	}
+
+	momFile := mustReadManifest(t, filepath.Join(www20, "Manifest.MoM"))
+	if f := findFile(momFile, "os-core"); f == nil || f.Version != 10 {
+		t.Errorf("os-core MoM entry does not point at version 10: %+v", f)
+	}
+	if f := findFile(momFile, "test-bundle"); f == nil || f.Version != 20 {
+		t.Errorf("test-bundle MoM entry does not point at version 20: %+v", f)
+	}
+	if momFile.Header.Previous != 10 {
+		t.Errorf("MoM previous is %d, expected 10", momFile.Header.Previous)
+	}
+
+	bundle = mustReadManifest(t, filepath.Join(www20, "Manifest.test-bundle"))
+	if f := findFile(bundle, "/usr/bin/test"); f == nil || f.Version != 20 {
+		t.Errorf("changed file /usr/bin/test not at version 20: %+v", f)
+	}
+	if f := findFile(bundle, "/usr/share/test/data"); f == nil || f.Version != 10 {
+		t.Errorf("unchanged file /usr/share/test/data not at version 10: %+v", f)
+	}
+	if f := findFile(bundle, "/etc/test.conf"); f == nil || f.Status != statusDeleted || f.Version != 20 {
+		t.Errorf("removed file /etc/test.conf not marked deleted: %+v", f)
+	}
+}
@@ -0,0 +1,186 @@
+package swupd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"logger"
+)
+
+// Files outside of these sizes do not get delta files. Small files are cheap
+// to download in full and bsdiff needs memory proportional to the file size.
+const (
+	minDeltaFileSize = 200
+	maxDeltaFileSize = 512 * 1024 * 1024
+)
+
+// DeltasInfo summarizes the creation of delta files between two versions
+type DeltasInfo struct {
+	// Created is the number of delta files written
+	Created uint32
+	// Existing is the number of delta files that were already there
+	Existing uint32
+	// Skipped is the number of changed files that do not get a delta file,
+	// either because of their size or because the delta was not smaller
+	// than the fullfile
+	Skipped uint32
+}
+
+// deltaPath returns where the delta file for f is stored, next to the
+// fullfile of the new version of the file
+func deltaPath(statedir string, f *File) string {
+	return filepath.Join(statedir, "www", fmt.Sprint(f.Version), "delta", deltaName(f))
+}
+
+// fullfileSize returns the size of the fullfile for f, falling back to the
+// size of the file itself when there is no fullfile yet.
+func fullfileSize(statedir string, f *File, path string) (int64, error) {
+	fi, err := os.Stat(filepath.Join(statedir, "www", fmt.Sprint(f.Version), "files", f.Hash.String()+".tar"))
+	if err != nil {
+		fi, err = os.Lstat(path)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// createDelta runs bsdiff to create the delta file from oldPath to newPath.
+// The result reports whether the delta is worth keeping.
+func createDelta(statedir string, f *File, oldPath, newPath string) (bool, error) {
+	oldInfo, err := os.Lstat(oldPath)
+	if err != nil {
+		return false, err
+	}
+	newInfo, err := os.Lstat(newPath)
+	if err != nil {
+		return false, err
+	}
+	for _, fi := range []os.FileInfo{oldInfo, newInfo} {
+		if !fi.Mode().IsRegular() || fi.Size() < minDeltaFileSize || fi.Size() > maxDeltaFileSize {
+			return false, nil
+		}
+	}
+
+	out := deltaPath(statedir, f)
+	if err = os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+		return false, err
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("bsdiff", oldPath, newPath, out)
+	cmd.Stderr = &stderr
+	if err = cmd.Run(); err != nil {
+		os.Remove(out)
+		return false, fmt.Errorf("bsdiff failed: %v: %s", err, stderr.String())
+	}
+
+	deltaInfo, err := os.Stat(out)
+	if err != nil {
+		return false, err
+	}
+	limit, err := fullfileSize(statedir, f, newPath)
+	if err != nil {
+		return false, err
+	}
+	if deltaInfo.Size() >= limit {
+		// Downloading the fullfile is cheaper, clients fall back to it.
+		return false, os.Remove(out)
+	}
+	return true, nil
+}
+
+// CreateDeltas creates the delta files for every regular file that changed or
+// got renamed between the full manifests of versions from and to. The files
+// are read from the full chroots of both versions. Delta files are stored in
+// the delta directory of the version the new file appeared in, named
+// <from>-<to>-<old hash>-<new hash>, where they get picked up when creating
+// delta packs. Up to workers delta files are created in parallel.
+func CreateDeltas(statedir string, from uint32, to uint32, workers int) (*DeltasInfo, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	if _, err := exec.LookPath("bsdiff"); err != nil {
+		return nil, fmt.Errorf("cannot create delta files: %v", err)
+	}
+
+	oldFull, err := readBundleManifest(statedir, from, FullName)
+	if err != nil {
+		return nil, err
+	}
+	newFull, err := readBundleManifest(statedir, to, FullName)
+	if err != nil {
+		return nil, err
+	}
+
+	oldChroot := filepath.Join(statedir, "image", fmt.Sprint(from), FullName)
+	newChroot := filepath.Join(statedir, "image", fmt.Sprint(to), FullName)
+	for _, dir := range []string{oldChroot, newChroot} {
+		if _, err = os.Stat(dir); err != nil {
+			return nil, fmt.Errorf("cannot create delta files without the full chroot: %v", err)
+		}
+	}
+
+	c := DiffManifests(oldFull, newFull)
+	changed := append(append([]*File(nil), c.Modified...), c.Renamed...)
+
+	info := &DeltasInfo{}
+	queue := make(chan *File)
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var failures []string
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range queue {
+				oldPath := filepath.Join(oldChroot, strings.TrimPrefix(f.DeltaPeer.Name, "/"))
+				newPath := filepath.Join(newChroot, strings.TrimPrefix(f.Name, "/"))
+				created, err := createDelta(statedir, f, oldPath, newPath)
+
+				mutex.Lock()
+				switch {
+				case err != nil:
+					failures = append(failures, fmt.Sprintf("%s: %v", f.Name, err))
+				case created:
+					logger.Debug("Created delta file for %s", f.Name)
+					info.Created++
+				default:
+					info.Skipped++
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	done := make(map[string]bool)
+	for _, f := range changed {
+		if f.Type != typeFile || f.DeltaPeer.Type != typeFile {
+			continue
+		}
+		name := deltaName(f)
+		if done[name] {
+			continue
+		}
+		done[name] = true
+
+		if _, err := os.Stat(deltaPath(statedir, f)); err == nil {
+			info.Existing++
+			continue
+		}
+		queue <- f
+	}
+	close(queue)
+	wg.Wait()
+
+	if len(failures) > 0 {
+		return info, fmt.Errorf("failed to create %d delta files:\n%s", len(failures), strings.Join(failures, "\n"))
+	}
+	return info, nil
+}
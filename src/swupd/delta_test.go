@@ -0,0 +1,97 @@
+package swupd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeBsdiff is a stand-in for bsdiff producing a small delta, except for
+// files named "bad" where the delta is larger than the file itself.
+const fakeBsdiff = `#!/bin/sh
+case "$2" in
+*bad) cat "$2" "$2" > "$3" ;;
+*) head -c 16 "$2" > "$3" ;;
+esac
+`
+
+func TestCreateDeltas(t *testing.T) {
+	statedir, err := ioutil.TempDir("", "swupd-delta-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(statedir)
+
+	bin := filepath.Join(statedir, "bin")
+	if err = os.Mkdir(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(bin, "bsdiff"), []byte(fakeBsdiff), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+
+	large := strings.Repeat("a", 1000)
+	for _, bundle := range []string{"os-core", "full"} {
+		mustWriteChrootFile(t, statedir, "10", bundle, "usr/bin/good", large+"good 10")
+		mustWriteChrootFile(t, statedir, "10", bundle, "usr/bin/bad", large+"bad 10")
+		mustWriteChrootFile(t, statedir, "10", bundle, "usr/bin/small", "10")
+		mustWriteChrootFile(t, statedir, "10", bundle, "usr/lib64/libfoo.so.1", large+"libfoo 10")
+		mustWriteChrootFile(t, statedir, "20", bundle, "usr/bin/good", large+"good 20")
+		mustWriteChrootFile(t, statedir, "20", bundle, "usr/bin/bad", large+"bad 20")
+		mustWriteChrootFile(t, statedir, "20", bundle, "usr/bin/small", "20")
+		mustWriteChrootFile(t, statedir, "20", bundle, "usr/lib64/libfoo.so.2", large+"libfoo 20")
+	}
+	if _, err = CreateManifests(10, 0, 1, statedir); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(statedir, "image", "LAST_VER"), []byte("10"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = CreateManifests(20, 0, 1, statedir); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := CreateDeltas(statedir, 10, 20, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Created != 2 || info.Skipped != 2 {
+		t.Errorf("created %d and skipped %d delta files, expected 2 and 2", info.Created, info.Skipped)
+	}
+
+	deltas, err := ioutil.ReadDir(filepath.Join(statedir, "www", "20", "delta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deltas) != 2 {
+		t.Fatalf("expected 2 delta files, got %d", len(deltas))
+	}
+	for _, d := range deltas {
+		if !strings.HasPrefix(d.Name(), "10-20-") {
+			t.Errorf("unexpected delta file name %s", d.Name())
+		}
+	}
+
+	if info, err = CreateDeltas(statedir, 10, 20, 1); err != nil {
+		t.Fatal(err)
+	}
+	if info.Created != 0 || info.Existing != 2 {
+		t.Errorf("second run created %d delta files and found %d", info.Created, info.Existing)
+	}
+
+	// The delta pack picks up the delta files instead of the full files.
+	packs, err := DeltaPacks(statedir, 10, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = CreatePacks(statedir, packs, false, 1); err != nil {
+		t.Skipf("cannot create packs: %v", err)
+	}
+	if packs[0].DeltaCount != 2 {
+		t.Errorf("delta pack contains %d delta files, expected 2", packs[0].DeltaCount)
+	}
+}
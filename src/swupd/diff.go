@@ -0,0 +1,75 @@
+package swupd
+
+// ChangeSet lists the differences between two versions of a manifest. Entries
+// are taken from the new manifest, except for Deleted which lists the entries
+// of the old manifest that are gone.
+type ChangeSet struct {
+	// Added are files that did not exist in the old manifest
+	Added []*File
+	// Modified are files whose contents changed, DeltaPeer points at the
+	// old entry
+	Modified []*File
+	// Deleted are files that no longer exist in the new manifest
+	Deleted []*File
+	// TypeChanged are files that changed type, e.g. from file to symlink
+	TypeChanged []*File
+	// Renamed are new files that replace a deleted file, RenamePeer and
+	// DeltaPeer point at the old entry and RenameScore tells how similar
+	// the two are
+	Renamed []*File
+}
+
+// IsEmpty reports whether the change set contains no changes at all
+func (c *ChangeSet) IsEmpty() bool {
+	return len(c.Added) == 0 && len(c.Modified) == 0 && len(c.Deleted) == 0 &&
+		len(c.TypeChanged) == 0 && len(c.Renamed) == 0
+}
+
+// present reports whether the entry describes an existing file
+func (f *File) present() bool {
+	return f.Status != statusDeleted && f.Status != statusGhosted
+}
+
+// DiffManifests compares the file lists of oldManifest and newManifest and
+// returns the changes between the two. Modified files get their DeltaPeer set
+// to the old entry, and added files that replace a deleted file are reported
+// as renames.
+func DiffManifests(oldManifest, newManifest *Manifest) *ChangeSet {
+	c := &ChangeSet{}
+
+	oldFiles := make(map[string]*File)
+	for _, f := range oldManifest.Files {
+		if f.present() {
+			oldFiles[f.Name] = f
+		}
+	}
+
+	newFiles := make(map[string]*File)
+	for _, f := range newManifest.Files {
+		if !f.present() {
+			continue
+		}
+		newFiles[f.Name] = f
+
+		of, ok := oldFiles[f.Name]
+		switch {
+		case !ok:
+			c.Added = append(c.Added, f)
+		case of.Type != f.Type:
+			c.TypeChanged = append(c.TypeChanged, f)
+		case !HashEquals(of.Hash, f.Hash):
+			f.DeltaPeer = of
+			of.DeltaPeer = f
+			c.Modified = append(c.Modified, f)
+		}
+	}
+
+	for _, f := range oldManifest.Files {
+		if f.present() && newFiles[f.Name] == nil {
+			c.Deleted = append(c.Deleted, f)
+		}
+	}
+
+	c.detectRenames(newManifest)
+	return c
+}
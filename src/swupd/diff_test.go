@@ -0,0 +1,85 @@
+package swupd
+
+import "testing"
+
+// newTestFile returns a file entry with the given hash, interned on the fly
+func newTestFile(name string, ftype ftype, hash string) *File {
+	return &File{Name: name, Type: ftype, Hash: internHash(hash)}
+}
+
+func fileNames(files []*File) []string {
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name)
+	}
+	return names
+}
+
+func TestDiffManifests(t *testing.T) {
+	hashA := "1111111111111111111111111111111111111111111111111111111111111111"
+	hashB := "2222222222222222222222222222222222222222222222222222222222222222"
+	hashC := "3333333333333333333333333333333333333333333333333333333333333333"
+	hashD := "4444444444444444444444444444444444444444444444444444444444444444"
+
+	oldManifest := &Manifest{Files: []*File{
+		newTestFile("/usr/bin/modified", typeFile, hashA),
+		newTestFile("/usr/bin/same", typeFile, hashB),
+		newTestFile("/usr/bin/deleted", typeFile, hashC),
+		newTestFile("/usr/bin/totype", typeFile, hashA),
+		newTestFile("/usr/lib/libfoo.so.1", typeFile, hashD),
+		{Name: "/usr/bin/gone", Status: statusDeleted},
+	}}
+	newManifest := &Manifest{Files: []*File{
+		newTestFile("/usr/bin/modified", typeFile, hashC),
+		newTestFile("/usr/bin/same", typeFile, hashB),
+		newTestFile("/usr/bin/added", typeFile, hashA),
+		newTestFile("/usr/bin/totype", typeLink, hashB),
+		newTestFile("/usr/lib/libfoo.so.2", typeFile, hashD),
+		{Name: "/usr/bin/deleted", Status: statusDeleted},
+		{Name: "/usr/bin/gone", Status: statusDeleted},
+	}}
+
+	c := DiffManifests(oldManifest, newManifest)
+
+	tests := []struct {
+		name     string
+		files    []*File
+		expected []string
+	}{
+		{"added", c.Added, []string{"/usr/bin/added"}},
+		{"modified", c.Modified, []string{"/usr/bin/modified"}},
+		{"deleted", c.Deleted, []string{"/usr/bin/deleted"}},
+		{"type changed", c.TypeChanged, []string{"/usr/bin/totype"}},
+		{"renamed", c.Renamed, []string{"/usr/lib/libfoo.so.2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			names := fileNames(tt.files)
+			if len(names) != len(tt.expected) {
+				t.Fatalf("got %v, expected %v", names, tt.expected)
+			}
+			for i := range names {
+				if names[i] != tt.expected[i] {
+					t.Errorf("got %v, expected %v", names, tt.expected)
+				}
+			}
+		})
+	}
+
+	if peer := c.Modified[0].DeltaPeer; peer != oldManifest.Files[0] {
+		t.Errorf("modified file has delta peer %v", peer)
+	}
+	renamed := c.Renamed[0]
+	if renamed.RenamePeer != oldManifest.Files[4] || renamed.RenameScore != MaxRenameScore {
+		t.Errorf("renamed file has peer %v and score %d", renamed.RenamePeer, renamed.RenameScore)
+	}
+}
+
+func TestDiffManifestsIdentical(t *testing.T) {
+	m := &Manifest{Files: []*File{
+		newTestFile("/usr/bin/same", typeFile, "5555555555555555555555555555555555555555555555555555555555555555"),
+	}}
+	if c := DiffManifests(m, m); !c.IsEmpty() {
+		t.Errorf("identical manifests produced changes: %+v", c)
+	}
+}
@@ -185,7 +185,7 @@ func (f *File) setHashZero() {
 }
 
 func (f *File) getHashString() string {
-	return *Hashes[f.Hash]
+	return f.Hash.String()
 }
 
 func (f *File) getFlagString() (string, error) {
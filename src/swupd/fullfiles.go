@@ -0,0 +1,223 @@
+package swupd
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"logger"
+)
+
+// FullfilesInfo summarizes the creation of the fullfiles for a version
+type FullfilesInfo struct {
+	// Created is the number of fullfiles written
+	Created uint32
+	// Skipped is the number of fullfiles that already existed
+	Skipped uint32
+	// Size is the total size of the fullfiles written
+	Size int64
+	// Compressions counts which compression was chosen for the fullfiles
+	Compressions map[string]uint32
+}
+
+// hashInfoFromTarHeader returns the hash metadata for a tar entry, so that
+// the contents of fullfiles and packs can be hashed.
+func hashInfoFromTarHeader(hdr *tar.Header) (*HashInfo, error) {
+	info := &HashInfo{
+		Mode: uint32(hdr.Mode) &^ syscall.S_IFMT,
+		UID:  uint32(hdr.Uid),
+		GID:  uint32(hdr.Gid),
+		Size: hdr.Size,
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeRegA:
+		info.Mode |= syscall.S_IFREG
+	case tar.TypeDir:
+		info.Mode |= syscall.S_IFDIR
+	case tar.TypeSymlink:
+		info.Mode |= syscall.S_IFLNK
+		info.Size = int64(len(hdr.Linkname))
+	default:
+		return nil, fmt.Errorf("%s is not a file, directory or symlink", hdr.Name)
+	}
+
+	for k, v := range hdr.PAXRecords {
+		if strings.HasPrefix(k, "SCHILY.xattr.") {
+			if info.Xattrs == nil {
+				info.Xattrs = make(map[string][]byte)
+			}
+			info.Xattrs[strings.TrimPrefix(k, "SCHILY.xattr.")] = []byte(v)
+		}
+	}
+	return info, nil
+}
+
+// createFullfile writes the fullfile for the file at path to
+// <outputDir>/<hash>.tar. The tar archive is compressed with whichever of the
+// compressors gives the smallest result, it is left uncompressed if none of
+// them helps. The name of the chosen compression and the size are returned.
+func createFullfile(path string, hash string, outputDir string, compressors []*compressor) (string, int64, error) {
+	uncompressed, err := ioutil.TempFile(outputDir, hash+".tar.")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(uncompressed.Name())
+	defer uncompressed.Close()
+
+	tw := tar.NewWriter(uncompressed)
+	if err = addFileToTar(tw, path, hash); err != nil {
+		return "", 0, err
+	}
+	if err = tw.Close(); err != nil {
+		return "", 0, err
+	}
+
+	best := uncompressed.Name()
+	bestName := "none"
+	fi, err := uncompressed.Stat()
+	if err != nil {
+		return "", 0, err
+	}
+	bestSize := fi.Size()
+
+	for _, c := range compressors {
+		if _, err = uncompressed.Seek(0, io.SeekStart); err != nil {
+			return "", 0, err
+		}
+		out, err := os.Create(uncompressed.Name() + "." + c.name)
+		if err != nil {
+			return "", 0, err
+		}
+		defer os.Remove(out.Name())
+
+		err = c.compress(uncompressed, out)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return "", 0, err
+		}
+
+		if fi, err = os.Stat(out.Name()); err != nil {
+			return "", 0, err
+		}
+		if fi.Size() < bestSize {
+			best, bestName, bestSize = out.Name(), c.name, fi.Size()
+		}
+	}
+
+	if err = os.Rename(best, filepath.Join(outputDir, hash+".tar")); err != nil {
+		return "", 0, err
+	}
+	return bestName, bestSize, nil
+}
+
+// CreateFullfiles creates files/<hash>.tar in the www directory of version
+// for every file that changed in version, as listed in its full manifest.
+// Fullfiles for hashes produced in earlier versions are not created again.
+// Up to workers fullfiles are created in parallel. All files are attempted,
+// the returned error lists every file that failed.
+func CreateFullfiles(statedir string, version uint32, workers int) (*FullfilesInfo, error) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	versionDir := filepath.Join(statedir, "www", fmt.Sprint(version))
+	full := &Manifest{}
+	if err := full.ReadManifestFromFile(filepath.Join(versionDir, "Manifest."+FullName)); err != nil {
+		return nil, err
+	}
+
+	outputDir := filepath.Join(versionDir, "files")
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return nil, err
+	}
+
+	info := &FullfilesInfo{Compressions: make(map[string]uint32)}
+	chroot := filepath.Join(statedir, "image", fmt.Sprint(version), FullName)
+	compressors := availableCompressors()
+
+	queue := make(chan *File)
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var failures []string
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range queue {
+				path := filepath.Join(chroot, strings.TrimPrefix(f.Name, "/"))
+				name, size, err := createFullfile(path, f.Hash.String(), outputDir, compressors)
+
+				mutex.Lock()
+				if err != nil {
+					failures = append(failures, fmt.Sprintf("%s (%s): %v", f.Hash, f.Name, err))
+				} else {
+					logger.Debug("Created fullfile %s for %s with %s", f.Hash, f.Name, name)
+					info.Created++
+					info.Size += size
+					info.Compressions[name]++
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	done := make(map[hashval]bool)
+	for _, f := range full.Files {
+		if f.Version != version || !f.present() || done[f.Hash] {
+			continue
+		}
+		done[f.Hash] = true
+
+		if _, err := os.Stat(filepath.Join(outputDir, f.Hash.String()+".tar")); err == nil {
+			info.Skipped++
+			continue
+		}
+		queue <- f
+	}
+	close(queue)
+	wg.Wait()
+
+	if len(failures) > 0 {
+		sort.Strings(failures)
+		return info, fmt.Errorf("failed to create %d fullfiles:\n%s", len(failures), strings.Join(failures, "\n"))
+	}
+	return info, nil
+}
+
+// MissingFullfiles returns the hashes of the files that changed in version
+// and have no fullfile in its www directory, sorted
+func MissingFullfiles(statedir string, version uint32) ([]string, error) {
+	versionDir := filepath.Join(statedir, "www", fmt.Sprint(version))
+	full := &Manifest{}
+	if err := full.ReadManifestFromFile(filepath.Join(versionDir, "Manifest."+FullName)); err != nil {
+		return nil, err
+	}
+
+	var missing []string
+	done := make(map[hashval]bool)
+	for _, f := range full.Files {
+		if f.Version != version || !f.present() || done[f.Hash] {
+			continue
+		}
+		done[f.Hash] = true
+
+		if _, err := os.Stat(filepath.Join(versionDir, "files", f.Hash.String()+".tar")); os.IsNotExist(err) {
+			missing = append(missing, f.Hash.String())
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(missing)
+	return missing, nil
+}
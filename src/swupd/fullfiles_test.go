@@ -0,0 +1,103 @@
+package swupd
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCreateFullfiles(t *testing.T) {
+	statedir, err := ioutil.TempDir("", "swupd-fullfiles-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(statedir)
+
+	for _, bundle := range []string{"os-core", "full"} {
+		mustWriteChrootFile(t, statedir, "10", bundle, "usr/bin/small", "x")
+		mustWriteChrootFile(t, statedir, "10", bundle, "usr/share/large", strings.Repeat("compressible ", 1000))
+		if err = os.Symlink("small", filepath.Join(statedir, "image", "10", bundle, "usr/bin/link")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = CreateManifests(10, 0, 1, statedir); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := CreateFullfiles(statedir, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	full := mustReadManifest(t, filepath.Join(statedir, "www", "10", "Manifest.full"))
+	hashes := make(map[hashval]bool)
+	for _, f := range full.Files {
+		hashes[f.Hash] = true
+	}
+	if info.Created != uint32(len(hashes)) || info.Skipped != 0 {
+		t.Errorf("created %d and skipped %d fullfiles for %d hashes", info.Created, info.Skipped, len(hashes))
+	}
+	if info.Compressions["none"] == uint32(len(hashes)) {
+		t.Error("no fullfile was compressed")
+	}
+
+	for hash := range hashes {
+		path := filepath.Join(statedir, "www", "10", "files", hash.String()+".tar")
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := openCompressed(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr := tar.NewReader(r)
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", path, err)
+		}
+		if hdr.Name != hash.String() {
+			t.Errorf("fullfile %s contains %s", path, hdr.Name)
+		}
+
+		hinfo, err := hashInfoFromTarHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var content io.Reader = tr
+		if hdr.Typeflag == tar.TypeSymlink {
+			content = strings.NewReader(hdr.Linkname)
+		}
+		if got, err := GetHashForReader(content, hinfo); err != nil || got != hash {
+			t.Errorf("fullfile %s hashes to %v: %v", path, got, err)
+		}
+		r.Close()
+		f.Close()
+	}
+
+	// A second run finds everything in place.
+	if info, err = CreateFullfiles(statedir, 10, 1); err != nil {
+		t.Fatal(err)
+	}
+	if info.Created != 0 || info.Skipped != uint32(len(hashes)) {
+		t.Errorf("second run created %d and skipped %d fullfiles", info.Created, info.Skipped)
+	}
+
+	missing, err := MissingFullfiles(statedir, 10)
+	if err != nil || len(missing) != 0 {
+		t.Errorf("expected no missing fullfiles, got %v: %v", missing, err)
+	}
+	for hash := range hashes {
+		if err = os.Remove(filepath.Join(statedir, "www", "10", "files", hash.String()+".tar")); err != nil {
+			t.Fatal(err)
+		}
+		if missing, err = MissingFullfiles(statedir, 10); err != nil || len(missing) != 1 || missing[0] != hash.String() {
+			t.Errorf("expected %s to be missing, got %v: %v", hash, missing, err)
+		}
+		break
+	}
+}
@@ -1,5 +1,20 @@
 package swupd
 
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
 type hashval int
 
 var AllZeroHash = "0000000000000000000000000000000000000000000000000000000000000000"
@@ -8,9 +23,15 @@ var AllZeroHash = "0000000000000000000000000000000000000000000000000000000000000
 var Hashes = []*string{&AllZeroHash}
 var invHash = map[string]hashval{AllZeroHash: 0}
 
+// hashesLock guards Hashes and invHash, hashes are computed concurrently
+var hashesLock sync.RWMutex
+
 // internHash adds only new hashes to the Hashes slice and returns the index at
 // which they are located
 func internHash(hash string) hashval {
+	hashesLock.Lock()
+	defer hashesLock.Unlock()
+
 	if key, ok := invHash[hash]; ok {
 		return key
 	}
@@ -21,6 +42,8 @@ func internHash(hash string) hashval {
 }
 
 func (h hashval) String() string {
+	hashesLock.RLock()
+	defer hashesLock.RUnlock()
 	return *Hashes[int(h)]
 }
 
@@ -28,3 +51,205 @@ func (h hashval) String() string {
 func HashEquals(h1 hashval, h2 hashval) bool {
 	return h1 == h2
 }
+
+// HashInfo contains the file metadata that is part of a swupd hash, next to
+// the file contents.
+type HashInfo struct {
+	// Mode is the st_mode of the file, including the file type bits.
+	Mode uint32
+	UID  uint32
+	GID  uint32
+	Size int64
+	// Xattrs maps extended attribute names to their values. Only the
+	// attributes in the security namespace are part of the hash.
+	Xattrs map[string][]byte
+}
+
+// hashedXattr reports whether the extended attribute name is part of the
+// hash. IMA signatures are excluded, they are derived from the file contents
+// and get regenerated on the target system.
+func hashedXattr(name string) bool {
+	return strings.HasPrefix(name, "security.") && name != "security.ima"
+}
+
+// xattrsBlob serializes the hashed extended attributes the same way
+// swupd-server does: sorted by name, each name NUL terminated and followed by
+// its value.
+func xattrsBlob(xattrs map[string][]byte) []byte {
+	var names []string
+	for name := range xattrs {
+		if hashedXattr(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var blob []byte
+	for _, name := range names {
+		blob = append(blob, name...)
+		blob = append(blob, 0)
+		blob = append(blob, xattrs[name]...)
+	}
+	return blob
+}
+
+// GetHashForReader computes the swupd hash of the file described by info with
+// its contents read from r. For symlinks r provides the link target, for
+// directories r is not read at all. The hash is added to the Hashes table.
+func GetHashForReader(r io.Reader, info *HashInfo) (hashval, error) {
+	mode := info.Mode
+	size := info.Size
+
+	var data io.Reader
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFREG:
+		data = r
+	case syscall.S_IFDIR:
+		size = 0
+		data = strings.NewReader("DIRECTORY") // fixed magic string
+	case syscall.S_IFLNK:
+		mode = 0
+		data = r
+	default:
+		return 0, fmt.Errorf("mode %o is not a file, directory or symlink", mode&syscall.S_IFMT)
+	}
+
+	// The key is the HMAC of a struct update_stat as laid out by the C
+	// implementation: mode, uid, gid, rdev (always zero) and size, each as a
+	// little endian 64 bit value. The extended attributes are the data.
+	var updatestat [40]byte
+	binary.LittleEndian.PutUint64(updatestat[0:8], uint64(mode))
+	binary.LittleEndian.PutUint64(updatestat[8:16], uint64(info.UID))
+	binary.LittleEndian.PutUint64(updatestat[16:24], uint64(info.GID))
+	binary.LittleEndian.PutUint64(updatestat[24:32], 0)
+	binary.LittleEndian.PutUint64(updatestat[32:40], uint64(size))
+
+	keyMac := hmac.New(sha256.New, updatestat[:])
+	keyMac.Write(xattrsBlob(info.Xattrs))
+	key := make([]byte, hex.EncodedLen(sha256.Size))
+	hex.Encode(key, keyMac.Sum(nil))
+
+	mac := hmac.New(sha256.New, key)
+	if _, err := io.Copy(mac, data); err != nil {
+		return 0, err
+	}
+
+	return internHash(hex.EncodeToString(mac.Sum(nil))), nil
+}
+
+// llistxattr is listxattr(2) without following symlinks
+func llistxattr(path string, dest []byte) (int, error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var buf unsafe.Pointer
+	if len(dest) > 0 {
+		buf = unsafe.Pointer(&dest[0])
+	}
+	n, _, errno := syscall.Syscall(syscall.SYS_LLISTXATTR, uintptr(unsafe.Pointer(p)), uintptr(buf), uintptr(len(dest)))
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(n), nil
+}
+
+// lgetxattr is getxattr(2) without following symlinks
+func lgetxattr(path string, name string, dest []byte) (int, error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	a, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return 0, err
+	}
+	var buf unsafe.Pointer
+	if len(dest) > 0 {
+		buf = unsafe.Pointer(&dest[0])
+	}
+	n, _, errno := syscall.Syscall6(syscall.SYS_LGETXATTR, uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(a)), uintptr(buf), uintptr(len(dest)), 0, 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(n), nil
+}
+
+// readXattrs returns all extended attributes of path, without following
+// symlinks.
+func readXattrs(path string) (map[string][]byte, error) {
+	size, err := llistxattr(path, nil)
+	if err == syscall.ENOTSUP {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list xattrs of %s: %v", path, err)
+	}
+	if size == 0 {
+		return nil, nil
+	}
+
+	buf := make([]byte, size)
+	if size, err = llistxattr(path, buf); err != nil {
+		return nil, fmt.Errorf("failed to list xattrs of %s: %v", path, err)
+	}
+
+	xattrs := make(map[string][]byte)
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		if !hashedXattr(name) {
+			continue
+		}
+		vsize, err := lgetxattr(path, name, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read xattr %s of %s: %v", name, path, err)
+		}
+		value := make([]byte, vsize)
+		if vsize, err = lgetxattr(path, name, value); err != nil {
+			return nil, fmt.Errorf("failed to read xattr %s of %s: %v", name, path, err)
+		}
+		xattrs[name] = value[:vsize]
+	}
+	return xattrs, nil
+}
+
+// GetHashForFile computes the swupd hash of the file, directory or symlink at
+// path, including its security extended attributes. The result matches the
+// hash computed by swupd-server and is added to the Hashes table.
+func GetHashForFile(path string) (hashval, error) {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(path, &st); err != nil {
+		return 0, err
+	}
+
+	info := &HashInfo{
+		Mode: st.Mode,
+		UID:  st.Uid,
+		GID:  st.Gid,
+		Size: st.Size,
+	}
+
+	var err error
+	if info.Xattrs, err = readXattrs(path); err != nil {
+		return 0, err
+	}
+
+	switch st.Mode & syscall.S_IFMT {
+	case syscall.S_IFREG:
+		f, err := os.Open(path)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		return GetHashForReader(f, info)
+	case syscall.S_IFLNK:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return 0, err
+		}
+		return GetHashForReader(strings.NewReader(target), info)
+	case syscall.S_IFDIR:
+		return GetHashForReader(nil, info)
+	default:
+		return 0, fmt.Errorf("%s is not a file, directory or symlink %o", path, st.Mode&syscall.S_IFMT)
+	}
+}
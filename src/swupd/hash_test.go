@@ -2,6 +2,11 @@ package swupd
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
 )
 
@@ -85,5 +90,91 @@ func TestHashEqual(t *testing.T) {
 	}
 }
 
+func TestGetHashForReaderDirectory(t *testing.T) {
+	// Well known hash of a root owned directory with mode 0755
+	expected := "6c27df6efcd6fc401ff1bc67c970b83eef115f6473db4fb9d57e5de317eba96e"
+	info := &HashInfo{Mode: syscall.S_IFDIR | 0755, Size: 4096}
+	hash, err := GetHashForReader(nil, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash.String() != expected {
+		t.Errorf("directory hash %v did not match expected %v", hash, expected)
+	}
+}
+
+func TestGetHashForReaderXattrs(t *testing.T) {
+	info := &HashInfo{Mode: syscall.S_IFREG | 0644, Size: 4}
+	plain, err := GetHashForReader(strings.NewReader("data"), info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info.Xattrs = map[string][]byte{"user.comment": []byte("ignored")}
+	ignored, err := GetHashForReader(strings.NewReader("data"), info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !HashEquals(plain, ignored) {
+		t.Error("xattr outside the security namespace changed the hash")
+	}
+
+	info.Xattrs["security.SMACK64"] = []byte("_")
+	labeled, err := GetHashForReader(strings.NewReader("data"), info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if HashEquals(plain, labeled) {
+		t.Error("security xattr did not change the hash")
+	}
+}
+
+func TestGetHashForFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "swupd-hash-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "file")
+	if err = ioutil.WriteFile(path, []byte("some content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link")
+	if err = os.Symlink("file", link); err != nil {
+		t.Fatal(err)
+	}
+
+	var st syscall.Stat_t
+	if err = syscall.Lstat(path, &st); err != nil {
+		t.Fatal(err)
+	}
+	info := &HashInfo{Mode: st.Mode, UID: st.Uid, GID: st.Gid, Size: st.Size}
+
+	fileHash, err := GetHashForFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readerHash, err := GetHashForReader(strings.NewReader("some content"), info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !HashEquals(fileHash, readerHash) {
+		t.Errorf("file hash %v does not match reader hash %v", fileHash, readerHash)
+	}
+
+	linkHash, err := GetHashForFile(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if HashEquals(fileHash, linkHash) {
+		t.Error("symlink was followed when hashing")
+	}
+
+	if _, err = GetHashForFile(filepath.Join(dir, "missing")); err == nil {
+		t.Error("GetHashForFile did not fail for a missing file")
+	}
+}
+
 // Tip, to generate random hash values use this.
 // hexdump -n32 -e '32 "%02x" "\n"' /dev/random
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"strconv"
 	"strings"
@@ -28,12 +29,56 @@ type Manifest struct {
 	Name   string
 	Header ManifestHeader
 	Files  []*File
+
+	// Hash is the hash of the manifest file, as listed in the MoM
+	Hash hashval
+}
+
+// ParseError is returned when a manifest cannot be read. It records where in
+// the manifest the problem was found.
+type ParseError struct {
+	// File is the name of the manifest file, empty when reading from a
+	// reader without a name
+	File string
+	// Line is the line number starting at 1, zero when the error is not
+	// about a single line
+	Line int
+	// Field is the header entry or entry field that could not be parsed,
+	// empty when the whole line is wrong
+	Field string
+	// Raw is the text of the line
+	Raw string
+	Err error
+}
+
+func (e *ParseError) Error() string {
+	name := e.File
+	if name == "" {
+		name = "manifest"
+	}
+	msg := name
+	if e.Line > 0 {
+		msg += fmt.Sprintf(":%d", e.Line)
+	}
+	if e.Field != "" {
+		msg += ": " + e.Field
+	}
+	msg += fmt.Sprintf(": %v", e.Err)
+	if e.Raw != "" {
+		msg += fmt.Sprintf(" in %q", e.Raw)
+	}
+	return msg
 }
 
-// MoM is a manifest of manifests with the same header information
-type MoM struct {
-	Header       ManifestHeader
-	SubManifests []*Manifest
+// ErrorCode returns the code identifying the error in the events of mixer
+func (e *ParseError) ErrorCode() string {
+	return "invalid-manifest"
+}
+
+// fieldError returns a ParseError for field, the location is filled in by
+// the caller
+func fieldError(field string, err error) error {
+	return &ParseError{Field: field, Err: err}
 }
 
 // readManifestFileHeaderLine Read a header line from a manifest
@@ -41,6 +86,10 @@ func readManifestFileHeaderLine(fields []string, m *Manifest) error {
 	var err error
 	var parsed uint64
 
+	if len(fields) < 2 {
+		return errors.New("missing value")
+	}
+
 	// Only search for defined fields
 	switch fields[0] {
 	case "MANIFEST":
@@ -86,6 +135,9 @@ func readManifestFileHeaderLine(fields []string, m *Manifest) error {
 // readManifestFileEntry
 // fields: "<fflags, 4 chars>", "<hash, 64 chars>", "<version>", "<filename>"
 func readManifestFileEntry(fields []string, m *Manifest) error {
+	if len(fields) != 4 {
+		return fmt.Errorf("expected 4 fields, found %d", len(fields))
+	}
 	fflags := fields[0]
 	fhash := fields[1]
 	fver := fields[2]
@@ -93,14 +145,14 @@ func readManifestFileEntry(fields []string, m *Manifest) error {
 
 	// check length of fflags and fhash
 	if len(fflags) != 4 {
-		return fmt.Errorf("invalid number of flags: %v", fflags)
+		return fieldError("flags", fmt.Errorf("invalid number of flags: %v", fflags))
 	}
 
 	var parsed uint64
 	var err error
 	// fver must be a valid uint32
 	if parsed, err = strconv.ParseUint(fver, 10, 32); err != nil {
-		return fmt.Errorf("invalid version: %v", err)
+		return fieldError("version", err)
 	}
 	ver := uint32(parsed)
 
@@ -110,12 +162,12 @@ func readManifestFileEntry(fields []string, m *Manifest) error {
 
 	// set the file hash
 	if err = file.setHash(fhash); err != nil {
-		return fmt.Errorf("invalid hash: %v", err)
+		return fieldError("hash", err)
 	}
 
 	// Set the flags using fflags
 	if err = file.setFlags(fflags); err != nil {
-		return fmt.Errorf("invalid flags: %v", err)
+		return fieldError("flags", err)
 	}
 
 	// add file to manifest
@@ -179,21 +231,41 @@ func (m *Manifest) ReadManifestFromFile(f string) error {
 		}
 	}()
 
-	fstat, err := manifestFile.Stat()
-	if err != nil {
-		return err
-	}
+	err = m.readManifest(manifestFile, f)
+	// return err so the deferred close can modify it
+	return err
+}
 
-	if fstat.Size() == 0 {
-		return fmt.Errorf("%v is an empty file", f)
-	}
+// ReadManifest reads a manifest from r into memory. Errors in the contents
+// of the manifest are returned as a *ParseError.
+func (m *Manifest) ReadManifest(r io.Reader) error {
+	return m.readManifest(r, "")
+}
 
-	input := bufio.NewScanner(manifestFile)
+// readManifest reads a manifest from r, name is used in the errors
+func (m *Manifest) readManifest(r io.Reader, name string) error {
+	input := bufio.NewScanner(r)
+	line := 0
+	text := ""
+
+	// parseError places err at the current line, keeping the field of
+	// errors coming from the entry parsers.
+	parseError := func(err error) error {
+		perr, ok := err.(*ParseError)
+		if !ok {
+			perr = &ParseError{Err: err}
+		}
+		perr.File = name
+		perr.Line = line
+		perr.Raw = text
+		return perr
+	}
 
 	// Read the header.
 	parsedEntries := make(map[string]uint)
 	for input.Scan() {
-		text := input.Text()
+		line++
+		text = input.Text()
 		if text == "" {
 			// Empty line means end of the header.
 			break
@@ -202,45 +274,55 @@ func (m *Manifest) ReadManifestFromFile(f string) error {
 		fields := strings.Split(text, manifestFieldDelim)
 		entry := fields[0]
 		if entry != "includes:" && parsedEntries[entry] > 0 {
-			return fmt.Errorf("invalid manifest, duplicate entry %q in header", entry)
+			return parseError(fmt.Errorf("invalid manifest, duplicate entry %q in header", entry))
 		}
 		parsedEntries[entry]++
 
-		if err = readManifestFileHeaderLine(fields, m); err != nil {
-			return err
+		if err := readManifestFileHeaderLine(fields, m); err != nil {
+			return parseError(fieldError(strings.TrimSuffix(entry, ":"), err))
 		}
 	}
+	if err := input.Err(); err != nil {
+		return parseError(err)
+	}
+	if line == 0 {
+		return &ParseError{File: name, Err: errors.New("empty manifest")}
+	}
 
-	// Validate the header.
+	// Validate the header, errors are reported at the end of the header.
+	text = ""
 	for _, e := range requiredManifestHeaderEntries {
 		if parsedEntries[e] == 0 {
-			return fmt.Errorf("invalid manifest, missing entry %q in header", e)
+			return parseError(fmt.Errorf("invalid manifest, missing entry %q in header", e))
 		}
 	}
-	err = m.CheckHeaderIsValid()
-	if err != nil {
-		return err
+	if err := m.CheckHeaderIsValid(); err != nil {
+		return parseError(err)
 	}
 
 	// Read the body.
 	for input.Scan() {
-		text := input.Text()
+		line++
+		text = input.Text()
 		if text == "" {
-			return errors.New("extra blank line in manifest")
+			return parseError(errors.New("extra blank line in manifest"))
 		}
 
 		fields := strings.Split(text, manifestFieldDelim)
-		if err = readManifestFileEntry(fields, m); err != nil {
-			return err
+		if err := readManifestFileEntry(fields, m); err != nil {
+			return parseError(err)
 		}
 	}
+	if err := input.Err(); err != nil {
+		return parseError(err)
+	}
 
 	if len(m.Files) == 0 {
-		return errors.New("manifest does not have any file entries")
+		text = ""
+		return parseError(errors.New("manifest does not have any file entries"))
 	}
 
-	// return err so the deferred close can modify it
-	return err
+	return nil
 }
 
 // writeManifestFileHeader writes the header of a manifest to the file
@@ -10,6 +10,7 @@ import (
 	"path"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -377,3 +378,51 @@ func TestWriteManifestFileBadHeader(t *testing.T) {
 		t.Error("unable to remove file, did it not close properly?")
 	}
 }
+
+func TestReadManifestParseErrors(t *testing.T) {
+	header := "MANIFEST\t21\nversion:\t20\nprevious:\t10\nfilecount:\t1\ntimestamp:\t1000\ncontentsize:\t10\n\n"
+	validHash := "1234567890abcdef1234567890abcdef1234567890abcdef1234567890abcdef"
+	tests := []struct {
+		name    string
+		content string
+		line    int
+		field   string
+	}{
+		{"bad header value", strings.Replace(header, "previous:\t10", "previous:\tx", 1), 3, "previous"},
+		{"missing header value", strings.Replace(header, "filecount:\t1", "filecount:", 1), 4, "filecount"},
+		{"bad flags", header + "F.x.\t" + validHash + "\t10\t/foo\n", 8, "flags"},
+		{"bad version", header + "F...\t" + validHash + "\tx\t/foo\n", 8, "version"},
+		{"bad hash", header + "F...\tabc\t10\t/foo\n", 8, "hash"},
+		{"missing field", header + "F...\t" + validHash + "\t10\n", 8, ""},
+		{"extra blank line", header + "F...\t" + validHash + "\t10\t/foo\n\n", 9, ""},
+		{"no entries", header, 7, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m Manifest
+			err := m.ReadManifest(strings.NewReader(tt.content))
+			perr, ok := err.(*ParseError)
+			if !ok {
+				t.Fatalf("expected a ParseError, got %v", err)
+			}
+			if perr.Line != tt.line || perr.Field != tt.field {
+				t.Errorf("error at line %d field %q, expected line %d field %q: %v", perr.Line, perr.Field, tt.line, tt.field, err)
+			}
+		})
+	}
+
+	var m Manifest
+	if err := m.ReadManifest(strings.NewReader(header + "F...\t" + validHash + "\t10\t/foo\n")); err != nil {
+		t.Errorf("failed to read valid manifest: %v", err)
+	}
+}
+
+func TestReadManifestFromFileParseError(t *testing.T) {
+	name := "testdata/invalid_manifests/manifest.missingFiles"
+	var m Manifest
+	err := m.ReadManifestFromFile(name)
+	if perr, ok := err.(*ParseError); !ok || perr.File != name {
+		t.Errorf("expected a ParseError for %s, got %v", name, err)
+	}
+}
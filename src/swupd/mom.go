@@ -0,0 +1,124 @@
+package swupd
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// MoM is a manifest of manifests with the same header information
+type MoM struct {
+	Header       ManifestHeader
+	SubManifests []*Manifest
+
+	// wwwDir is the directory holding the version directories, the sub
+	// manifests are loaded from there
+	wwwDir string
+}
+
+// ReadMoMFromFile reads the manifest of manifests at path. Each entry becomes
+// a sub manifest with its name, version and hash set. The files of the sub
+// manifests are not read, see LoadSubManifest. The path is expected to be
+// <www>/<version>/Manifest.MoM, so that the sub manifests can be found in the
+// version directories next to it.
+func (mom *MoM) ReadMoMFromFile(path string) error {
+	m := &Manifest{Name: MoMName}
+	if err := m.ReadManifestFromFile(path); err != nil {
+		return err
+	}
+
+	mom.Header = m.Header
+	mom.SubManifests = nil
+	mom.wwwDir = filepath.Dir(filepath.Dir(path))
+	for _, f := range m.Files {
+		if f.Type != typeManifest {
+			return fmt.Errorf("invalid MoM entry %s, not a manifest", f.Name)
+		}
+		mom.SubManifests = append(mom.SubManifests, &Manifest{
+			Name:   f.Name,
+			Header: ManifestHeader{Version: f.Version},
+			Hash:   f.Hash,
+		})
+	}
+	return nil
+}
+
+// WriteMoMFile writes mom to a new file at path, with one entry per sub
+// manifest sorted by name. The header is written as is, so the filecount and
+// contentsize must already be set.
+func (mom *MoM) WriteMoMFile(path string) error {
+	m := &Manifest{Name: MoMName, Header: mom.Header}
+	for _, sub := range mom.SubManifests {
+		m.Files = append(m.Files, &File{
+			Name:    sub.Name,
+			Hash:    sub.Hash,
+			Version: sub.Header.Version,
+			Type:    typeManifest,
+		})
+	}
+	m.sortFiles()
+	return m.WriteManifestFile(path)
+}
+
+// Versions returns the version of each sub manifest by name
+func (mom *MoM) Versions() map[string]uint32 {
+	versions := make(map[string]uint32)
+	for _, sub := range mom.SubManifests {
+		versions[sub.Name] = sub.Header.Version
+	}
+	return versions
+}
+
+// LoadSubManifest returns the sub manifest called name, reading its files from
+// Manifest.<name> in the version directory it was last changed in. The
+// manifest is only read the first time. It is not safe to load sub manifests
+// of the same MoM concurrently.
+func (mom *MoM) LoadSubManifest(name string) (*Manifest, error) {
+	var sub *Manifest
+	for _, m := range mom.SubManifests {
+		if m.Name == name {
+			sub = m
+			break
+		}
+	}
+	if sub == nil {
+		return nil, fmt.Errorf("no manifest %s in the MoM", name)
+	}
+	if sub.Files != nil {
+		return sub, nil
+	}
+	if mom.wwwDir == "" {
+		return nil, fmt.Errorf("cannot load manifest %s, the MoM was not read from a file", name)
+	}
+
+	path := filepath.Join(mom.wwwDir, fmt.Sprint(sub.Header.Version), "Manifest."+name)
+	m := &Manifest{Name: name}
+	if err := m.ReadManifestFromFile(path); err != nil {
+		return nil, err
+	}
+	if m.Header.Version != sub.Header.Version {
+		return nil, fmt.Errorf("%s has version %d, the MoM lists version %d", path, m.Header.Version, sub.Header.Version)
+	}
+	sub.Header = m.Header
+	sub.Files = m.Files
+	return sub, nil
+}
+
+// LoadSubManifests loads the files of every sub manifest
+func (mom *MoM) LoadSubManifests() error {
+	for _, sub := range mom.SubManifests {
+		if _, err := mom.LoadSubManifest(sub.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readMoM reads the Manifest.MoM of version from the www directory of statedir
+func readMoM(statedir string, version uint32) (*MoM, error) {
+	mom := &MoM{}
+	path := filepath.Join(statedir, "www", fmt.Sprint(version), "Manifest."+MoMName)
+	if err := mom.ReadMoMFromFile(path); err != nil {
+		return nil, err
+	}
+	return mom, nil
+}
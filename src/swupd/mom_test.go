@@ -0,0 +1,92 @@
+package swupd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadWriteMoM(t *testing.T) {
+	statedir, err := ioutil.TempDir("", "swupd-mom-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(statedir)
+
+	for _, bundle := range []string{"os-core", "full"} {
+		mustWriteChrootFile(t, statedir, "10", bundle, "usr/bin/core", "core")
+	}
+	for _, bundle := range []string{"test-bundle", "full"} {
+		mustWriteChrootFile(t, statedir, "10", bundle, "usr/bin/test", "test 10")
+	}
+	if _, err = CreateManifests(10, 0, 1, statedir); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(statedir, "image", "LAST_VER"), []byte("10\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, bundle := range []string{"os-core", "full"} {
+		mustWriteChrootFile(t, statedir, "20", bundle, "usr/bin/core", "core")
+	}
+	for _, bundle := range []string{"test-bundle", "full"} {
+		mustWriteChrootFile(t, statedir, "20", bundle, "usr/bin/test", "test 20")
+	}
+	created, err := CreateManifests(20, 0, 1, statedir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(statedir, "www", "20", "Manifest.MoM")
+	mom := &MoM{}
+	if err = mom.ReadMoMFromFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if mom.Header.Version != 20 || mom.Header.Previous != 10 || mom.Header.FileCount != 2 {
+		t.Errorf("unexpected MoM header %+v", mom.Header)
+	}
+
+	expected := map[string]uint32{"os-core": 10, "test-bundle": 20}
+	versions := mom.Versions()
+	for name, ver := range expected {
+		if versions[name] != ver {
+			t.Errorf("%s has version %d in the MoM, expected %d", name, versions[name], ver)
+		}
+	}
+	for i, sub := range mom.SubManifests {
+		if sub.Files != nil {
+			t.Errorf("%s was loaded before LoadSubManifest", sub.Name)
+		}
+		if sub.Hash != created.SubManifests[i].Hash {
+			t.Errorf("%s has hash %s, created with %s", sub.Name, sub.Hash, created.SubManifests[i].Hash)
+		}
+	}
+
+	core, err := mom.LoadSubManifest("os-core")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if core.Header.Version != 10 || findFile(core, "/usr/bin/core") == nil {
+		t.Errorf("os-core was not loaded from version 10: %+v", core.Header)
+	}
+	if _, err = mom.LoadSubManifest("missing"); err == nil {
+		t.Error("LoadSubManifest did not fail for a missing bundle")
+	}
+
+	// Writing the MoM again produces the same entries.
+	rewritten := filepath.Join(statedir, "Manifest.MoM")
+	if err = mom.WriteMoMFile(rewritten); err != nil {
+		t.Fatal(err)
+	}
+	original, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	written, err := ioutil.ReadFile(rewritten)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(original) != string(written) {
+		t.Errorf("rewritten MoM differs:\n%s\nexpected:\n%s", written, original)
+	}
+}
@@ -1,10 +1,321 @@
 package swupd
 
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"logger"
+)
+
 // Pack is an object containing delta files and full files for downloads
 type Pack struct {
 	Bundle        string
 	FromVersion   uint32
 	ToVersion     uint32
 	FullFileCount uint32
+	DeltaCount    uint32
 	Manifest      *Manifest
+
+	// Skipped is set when the pack already existed and was not recreated
+	Skipped bool
+}
+
+// Path returns the location of the pack file below the www directory of the
+// state directory
+func (p *Pack) Path(statedir string) string {
+	return filepath.Join(statedir, "www", fmt.Sprint(p.ToVersion), p.FileName())
+}
+
+// FileName returns the name of the pack file
+func (p *Pack) FileName() string {
+	return fmt.Sprintf("pack-%s-from-%d.tar", p.Bundle, p.FromVersion)
+}
+
+// deltaName returns the name of the delta file that turns the contents of
+// f.DeltaPeer into f
+func deltaName(f *File) string {
+	return fmt.Sprintf("%d-%d-%s-%s", f.DeltaPeer.Version, f.Version, f.DeltaPeer.Hash, f.Hash)
+}
+
+// tarHeaderForPath returns a tar header named name for the file at path,
+// keeping the numeric ownership and security extended attributes.
+func tarHeaderForPath(path string, name string) (*tar.Header, error) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var link string
+	if fi.Mode()&os.ModeSymlink != 0 {
+		if link, err = os.Readlink(path); err != nil {
+			return nil, err
+		}
+	}
+
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return nil, err
+	}
+	hdr.Name = name
+	hdr.Uname = ""
+	hdr.Gname = ""
+
+	xattrs, err := readXattrs(path)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range xattrs {
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string)
+		}
+		hdr.PAXRecords["SCHILY.xattr."+k] = string(v)
+	}
+	if hdr.PAXRecords != nil {
+		hdr.Format = tar.FormatPAX
+	}
+	return hdr, nil
+}
+
+// addFileToTar adds the file at path to tw as name
+func addFileToTar(tw *tar.Writer, path string, name string) error {
+	hdr, err := tarHeaderForPath(path, name)
+	if err != nil {
+		return err
+	}
+	if err = tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// addDirToTar adds a directory entry to tw
+func addDirToTar(tw *tar.Writer, name string) error {
+	return tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeDir,
+		Mode:     0700,
+	})
+}
+
+// readManifestVersions returns the bundle versions listed in the MoM of
+// version
+func readManifestVersions(statedir string, version uint32) (map[string]uint32, error) {
+	mom, err := readMoM(statedir, version)
+	if err != nil {
+		return nil, err
+	}
+	return mom.Versions(), nil
+}
+
+// ZeroPacks returns the zero packs, containing the full contents of every
+// bundle, for the bundles in the MoM of version to.
+func ZeroPacks(statedir string, to uint32) ([]*Pack, error) {
+	versions, err := readManifestVersions(statedir, to)
+	if err != nil {
+		return nil, err
+	}
+
+	var packs []*Pack
+	for bundle, ver := range versions {
+		packs = append(packs, &Pack{Bundle: bundle, FromVersion: 0, ToVersion: ver})
+	}
+	sortPacks(packs)
+	return packs, nil
+}
+
+// DeltaPacks returns the delta packs needed to update the bundles of version
+// from to version to. Bundles that did not change or no longer exist in to are
+// left out.
+func DeltaPacks(statedir string, from uint32, to uint32) ([]*Pack, error) {
+	fromVersions, err := readManifestVersions(statedir, from)
+	if err != nil {
+		return nil, err
+	}
+	toVersions, err := readManifestVersions(statedir, to)
+	if err != nil {
+		return nil, err
+	}
+
+	var packs []*Pack
+	for bundle, fromVer := range fromVersions {
+		toVer, ok := toVersions[bundle]
+		if !ok || toVer == fromVer {
+			continue
+		}
+		packs = append(packs, &Pack{Bundle: bundle, FromVersion: fromVer, ToVersion: toVer})
+	}
+	sortPacks(packs)
+	return packs, nil
+}
+
+func sortPacks(packs []*Pack) {
+	sort.Slice(packs, func(i, j int) bool {
+		if packs[i].Bundle != packs[j].Bundle {
+			return packs[i].Bundle < packs[j].Bundle
+		}
+		return packs[i].FromVersion < packs[j].FromVersion
+	})
+}
+
+// readBundleManifest reads Manifest.<bundle> of version
+func readBundleManifest(statedir string, version uint32, bundle string) (*Manifest, error) {
+	m := &Manifest{Name: bundle}
+	path := filepath.Join(statedir, "www", fmt.Sprint(version), "Manifest."+bundle)
+	if err := m.ReadManifestFromFile(path); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Create writes the pack file for p. Files changed since FromVersion are
+// taken from the full chroot of ToVersion, unless a delta file from the
+// previous version was created with CreateDeltas. Existing packs are only
+// recreated when force is set.
+func (p *Pack) Create(statedir string, force bool) error {
+	path := p.Path(statedir)
+	p.Skipped = false
+	if fi, err := os.Stat(path); err == nil && fi.Size() > 0 && !force {
+		p.Skipped = true
+		return nil
+	}
+
+	var err error
+	if p.Manifest, err = readBundleManifest(statedir, p.ToVersion, p.Bundle); err != nil {
+		return err
+	}
+
+	if p.FromVersion > 0 {
+		old, err := readBundleManifest(statedir, p.FromVersion, p.Bundle)
+		if err != nil {
+			return err
+		}
+		DiffManifests(old, p.Manifest)
+	}
+	logger.Debug("Creating pack %d/%s", p.ToVersion, p.FileName())
+
+	tmp := path + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer out.Close()
+
+	xz, err := newXzWriter(out)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(xz)
+
+	if err = p.writeContents(tw, statedir); err != nil {
+		xz.Close()
+		return err
+	}
+	if err = tw.Close(); err != nil {
+		xz.Close()
+		return err
+	}
+	if err = xz.Close(); err != nil {
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// writeContents adds the staged and delta files of the pack to tw
+func (p *Pack) writeContents(tw *tar.Writer, statedir string) error {
+	chroot := filepath.Join(statedir, "image", fmt.Sprint(p.ToVersion), FullName)
+
+	if err := addDirToTar(tw, "delta/"); err != nil {
+		return err
+	}
+	if err := addDirToTar(tw, "staged/"); err != nil {
+		return err
+	}
+
+	p.FullFileCount = 0
+	p.DeltaCount = 0
+	done := make(map[hashval]bool)
+	for _, f := range p.Manifest.Files {
+		if f.Version <= p.FromVersion || !f.present() || done[f.Hash] {
+			continue
+		}
+		done[f.Hash] = true
+
+		if f.DeltaPeer != nil && f.Type == typeFile {
+			delta := deltaPath(statedir, f)
+			if _, err := os.Stat(delta); err == nil {
+				if err = addFileToTar(tw, delta, "delta/"+deltaName(f)); err != nil {
+					return err
+				}
+				p.DeltaCount++
+				continue
+			}
+		}
+
+		source := filepath.Join(chroot, strings.TrimPrefix(f.Name, "/"))
+		if err := addFileToTar(tw, source, "staged/"+f.Hash.String()); err != nil {
+			return fmt.Errorf("failed to add %s to %s: %v", f.Name, p.FileName(), err)
+		}
+		p.FullFileCount++
+	}
+	return nil
+}
+
+// CreatePacks creates the given packs, running up to workers pack creations
+// in parallel. All packs are attempted, the returned error lists every pack
+// that failed.
+func CreatePacks(statedir string, packs []*Pack, force bool, workers int) error {
+	if workers < 1 {
+		workers = 1
+	}
+
+	queue := make(chan *Pack)
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var failures []string
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range queue {
+				if err := p.Create(statedir, force); err != nil {
+					mutex.Lock()
+					failures = append(failures, fmt.Sprintf("%s: %v", p.FileName(), err))
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+
+	for _, p := range packs {
+		queue <- p
+	}
+	close(queue)
+	wg.Wait()
+
+	if len(failures) > 0 {
+		sort.Strings(failures)
+		return fmt.Errorf("failed to create %d packs:\n%s", len(failures), strings.Join(failures, "\n"))
+	}
+	return nil
 }
@@ -0,0 +1,110 @@
+package swupd
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// listPack returns the names of the entries in an xz compressed pack
+func listPack(t *testing.T, path string) map[string]bool {
+	out, err := exec.Command("xz", "-dc", path).Output()
+	if err != nil {
+		t.Fatalf("failed to decompress %s: %v", path, err)
+	}
+
+	entries := make(map[string]bool)
+	tr := tar.NewReader(bytes.NewReader(out))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[hdr.Name] = true
+	}
+	return entries
+}
+
+func TestCreatePacks(t *testing.T) {
+	if _, err := exec.LookPath("xz"); err != nil {
+		t.Skip("xz not available")
+	}
+
+	statedir, err := ioutil.TempDir("", "swupd-packs-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(statedir)
+
+	for _, bundle := range []string{"os-core", "full"} {
+		mustWriteChrootFile(t, statedir, "10", bundle, "usr/bin/core", "core 10")
+		mustWriteChrootFile(t, statedir, "20", bundle, "usr/bin/core", "core 20")
+		mustWriteChrootFile(t, statedir, "20", bundle, "usr/bin/new", "new")
+	}
+	if _, err = CreateManifests(10, 0, 1, statedir); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(statedir, "image", "LAST_VER"), []byte("10"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = CreateManifests(20, 0, 1, statedir); err != nil {
+		t.Fatal(err)
+	}
+
+	zero, err := ZeroPacks(statedir, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delta, err := DeltaPacks(statedir, 10, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zero) != 1 || len(delta) != 1 || delta[0].FromVersion != 10 {
+		t.Fatalf("unexpected pack lists %+v %+v", zero, delta)
+	}
+
+	if err = CreatePacks(statedir, append(zero, delta...), false, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	m := mustReadManifest(t, filepath.Join(statedir, "www", "20", "Manifest.os-core"))
+	zeroEntries := listPack(t, zero[0].Path(statedir))
+	deltaEntries := listPack(t, delta[0].Path(statedir))
+	hashes := make(map[hashval]bool)
+	for _, f := range m.Files {
+		hashes[f.Hash] = true
+		name := "staged/" + f.Hash.String()
+		if !zeroEntries[name] {
+			t.Errorf("zero pack is missing %s for %s", name, f.Name)
+		}
+		if deltaEntries[name] != (f.Version > 10) {
+			t.Errorf("delta pack has %s for %s at version %d: %v", name, f.Name, f.Version, deltaEntries[name])
+		}
+	}
+	if zero[0].FullFileCount != uint32(len(hashes)) {
+		t.Errorf("zero pack has %d full files, expected %d", zero[0].FullFileCount, len(hashes))
+	}
+
+	// Existing packs are kept unless forced.
+	again, _ := ZeroPacks(statedir, 20)
+	if err = CreatePacks(statedir, again, false, 1); err != nil {
+		t.Fatal(err)
+	}
+	if !again[0].Skipped {
+		t.Error("existing pack was created again without force")
+	}
+	if err = CreatePacks(statedir, again, true, 1); err != nil {
+		t.Fatal(err)
+	}
+	if again[0].Skipped {
+		t.Error("existing pack was skipped with force")
+	}
+}
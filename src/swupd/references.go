@@ -0,0 +1,130 @@
+package swupd
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// References records the files in the www directory that are still needed
+// by some versions: their manifests, zero packs, fullfiles, the delta packs
+// updating a bundle between the versions added and the delta files producing
+// their files. Files of a version that are not referenced by any version kept
+// can be removed.
+type References struct {
+	// paths are relative to the www directory
+	paths map[string]bool
+	// hashes are the hashes of the files referenced by version they were
+	// changed in, delta files resulting in them are referenced too
+	hashes map[uint32]map[string]bool
+	// bundles are the versions of each bundle in the versions added
+	bundles map[string]map[uint32]bool
+}
+
+// NewReferences returns References with no version added
+func NewReferences() *References {
+	return &References{
+		paths:   make(map[string]bool),
+		hashes:  make(map[uint32]map[string]bool),
+		bundles: make(map[string]map[uint32]bool),
+	}
+}
+
+// addBundle references the delta packs between version of bundle and the
+// versions of the bundle already added, the pack lives in the newer one
+func (r *References) addBundle(bundle string, version uint32) {
+	versions := r.bundles[bundle]
+	if versions == nil {
+		versions = make(map[uint32]bool)
+		r.bundles[bundle] = versions
+	}
+	if versions[version] {
+		return
+	}
+	for other := range versions {
+		p := &Pack{Bundle: bundle, FromVersion: other, ToVersion: version}
+		if other > version {
+			p.FromVersion, p.ToVersion = version, other
+		}
+		r.addPath(p.ToVersion, p.FileName())
+	}
+	versions[version] = true
+}
+
+func (r *References) addPath(version uint32, name string) {
+	r.paths[filepath.Join(fmt.Sprint(version), name)] = true
+}
+
+// AddVersion adds the files needed by version, read from its MoM and full
+// manifest in statedir
+func (r *References) AddVersion(statedir string, version uint32) error {
+	mom, err := readMoM(statedir, version)
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{"Manifest." + MoMName, "Manifest." + MoMName + ".tar", "Manifest." + MoMName + ".sig"} {
+		r.addPath(version, name)
+	}
+	for _, sub := range mom.SubManifests {
+		r.addPath(sub.Header.Version, "Manifest."+sub.Name)
+		r.addPath(sub.Header.Version, "Manifest."+sub.Name+".tar")
+		r.addPath(sub.Header.Version, (&Pack{Bundle: sub.Name, ToVersion: sub.Header.Version}).FileName())
+		r.addBundle(sub.Name, sub.Header.Version)
+	}
+
+	full, err := readBundleManifest(statedir, version, FullName)
+	if err != nil {
+		return err
+	}
+	r.addPath(version, "Manifest."+FullName)
+	r.addPath(version, "Manifest."+FullName+".tar")
+	for _, f := range full.Files {
+		if !f.present() {
+			continue
+		}
+		r.addPath(f.Version, filepath.Join("files", f.Hash.String()+".tar"))
+		if r.hashes[f.Version] == nil {
+			r.hashes[f.Version] = make(map[string]bool)
+		}
+		r.hashes[f.Version][f.Hash.String()] = true
+	}
+	return nil
+}
+
+// Paths returns the manifests, packs and fullfiles referenced by the
+// versions added, relative to the www directory and sorted. Delta files are
+// not listed since they are only found by their name.
+func (r *References) Paths() []string {
+	paths := make([]string, 0, len(r.paths))
+	for p := range r.paths {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Referenced returns whether the file at path, relative to the www
+// directory, is needed by a version added
+func (r *References) Referenced(path string) bool {
+	path = filepath.Clean(path)
+	if r.paths[path] {
+		return true
+	}
+
+	// Delta files are named after the hash they result in, see deltaName.
+	parts := strings.Split(path, string(filepath.Separator))
+	if len(parts) != 3 || parts[1] != "delta" {
+		return false
+	}
+	version, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return false
+	}
+	i := strings.LastIndex(parts[2], "-")
+	if i < 0 {
+		return false
+	}
+	return r.hashes[uint32(version)][parts[2][i+1:]]
+}
@@ -0,0 +1,98 @@
+package swupd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReferences(t *testing.T) {
+	statedir, err := ioutil.TempDir("", "swupd-references-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(statedir)
+
+	// Version 20 changes os-core and keeps editors as it was in 10.
+	for _, ver := range []string{"10", "20"} {
+		for _, bundle := range []string{"os-core", "editors", "full"} {
+			if bundle != "editors" {
+				mustWriteChrootFile(t, statedir, ver, bundle, "usr/bin/core", "core "+ver)
+			}
+			if bundle != "os-core" {
+				mustWriteChrootFile(t, statedir, ver, bundle, "usr/bin/editor", "editor")
+			}
+		}
+	}
+	for _, ver := range []uint32{10, 20} {
+		if ver == 20 {
+			if err = ioutil.WriteFile(filepath.Join(statedir, "image", "LAST_VER"), []byte("10"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err = CreateManifests(ver, 0, 1, statedir); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := NewReferences()
+	if err = r.AddVersion(statedir, 20); err != nil {
+		t.Fatal(err)
+	}
+
+	full10 := mustReadManifest(t, filepath.Join(statedir, "www", "10", "Manifest.full"))
+	full20 := mustReadManifest(t, filepath.Join(statedir, "www", "20", "Manifest.full"))
+	oldCore := findFile(full10, "/usr/bin/core").Hash.String()
+	newCore := findFile(full20, "/usr/bin/core").Hash.String()
+	editor := findFile(full20, "/usr/bin/editor")
+	if editor.Version != 10 {
+		t.Fatalf("expected the editor to be from version 10, got %d", editor.Version)
+	}
+
+	tests := []struct {
+		path       string
+		referenced bool
+	}{
+		{"20/Manifest.MoM", true},
+		{"20/Manifest.os-core", true},
+		{"10/Manifest.editors", true},
+		{"10/pack-editors-from-0.tar", true},
+		{"10/Manifest.os-core", false},
+		{"10/pack-os-core-from-0.tar", false},
+		{"10/Manifest.MoM", false},
+		{"10/files/" + editor.Hash.String() + ".tar", true},
+		{"10/files/" + oldCore + ".tar", false},
+		{"20/files/" + newCore + ".tar", true},
+		{"20/delta/10-20-" + oldCore + "-" + newCore, true},
+		{"10/delta/0-10-" + oldCore + "-" + oldCore, false},
+	}
+	paths := make(map[string]bool)
+	for _, p := range r.Paths() {
+		paths[filepath.ToSlash(p)] = true
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := r.Referenced(tt.path); got != tt.referenced {
+				t.Errorf("Referenced(%q) is %v, expected %v", tt.path, got, tt.referenced)
+			}
+			// Delta files are only matched by name.
+			if listed := paths[tt.path]; listed != (tt.referenced && !strings.Contains(tt.path, "/delta/")) {
+				t.Errorf("%s listed in Paths is %v", tt.path, listed)
+			}
+		})
+	}
+
+	// With both versions added, the pack updating os-core from 10 to 20 is
+	// needed, editors is the same in both.
+	if err = r.AddVersion(statedir, 10); err != nil {
+		t.Fatal(err)
+	}
+	if !r.Referenced("20/pack-os-core-from-10.tar") {
+		t.Error("expected the os-core pack from 10 to 20 to be referenced")
+	}
+	if r.Referenced("10/pack-editors-from-10.tar") {
+		t.Error("unexpected editors pack referenced")
+	}
+}
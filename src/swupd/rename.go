@@ -0,0 +1,149 @@
+package swupd
+
+import (
+	"regexp"
+	"sort"
+)
+
+// MaxRenameScore is the score of a rename where old and new file have the same
+// contents.
+const MaxRenameScore uint16 = 100
+
+// renameScorePath is the score of a rename detected from the file names alone,
+// where the paths only differ in version numbers, e.g. a bumped library soname
+// or a kernel module directory. Files that merely share their base name are
+// not paired, in different directories they are rarely the same file and
+// their deltas are of no use.
+const (
+	renameScorePath uint16 = 80
+	minRenameScore         = renameScorePath
+)
+
+// versionRegexp matches the version number components of a path
+var versionRegexp = regexp.MustCompile(`[0-9]+`)
+
+// normalizePath replaces every number in name so that paths only differing in
+// version numbers compare equal
+func normalizePath(name string) string {
+	return versionRegexp.ReplaceAllString(name, "#")
+}
+
+// renameScore returns how likely it is that newFile replaces oldFile, from
+// zero up to MaxRenameScore.
+func renameScore(newFile, oldFile *File) uint16 {
+	if newFile.Type != typeFile || oldFile.Type != typeFile {
+		return 0
+	}
+
+	switch {
+	case HashEquals(newFile.Hash, oldFile.Hash):
+		return MaxRenameScore
+	case normalizePath(newFile.Name) == normalizePath(oldFile.Name):
+		return renameScorePath
+	}
+	return 0
+}
+
+// linkRename records that newFile replaces the deleted oldFile
+func linkRename(newFile, oldFile *File, score uint16) {
+	newFile.Rename = renameSet
+	newFile.RenamePeer = oldFile
+	newFile.RenameScore = score
+	newFile.DeltaPeer = oldFile
+	oldFile.RenamePeer = newFile
+	oldFile.RenameScore = score
+	oldFile.DeltaPeer = newFile
+}
+
+// detectRenames pairs the added and deleted files in c that are most likely
+// the same file under a new name and moves them to Renamed. The rename flag is
+// set on the new file and on the deleted entry of the old name in
+// newManifest.
+func (c *ChangeSet) detectRenames(newManifest *Manifest) {
+	type candidate struct {
+		newFile, oldFile *File
+		score            uint16
+	}
+
+	// Index the deleted files so that not every pair has to be scored.
+	byHash := make(map[hashval][]*File)
+	byPath := make(map[string][]*File)
+	for _, f := range c.Deleted {
+		if f.Type != typeFile {
+			continue
+		}
+		byHash[f.Hash] = append(byHash[f.Hash], f)
+		name := normalizePath(f.Name)
+		byPath[name] = append(byPath[name], f)
+	}
+
+	var candidates []candidate
+	for _, nf := range c.Added {
+		if nf.Type != typeFile {
+			continue
+		}
+		seen := make(map[*File]bool)
+		olds := append([]*File(nil), byHash[nf.Hash]...)
+		olds = append(olds, byPath[normalizePath(nf.Name)]...)
+		for _, of := range olds {
+			if seen[of] {
+				continue
+			}
+			seen[of] = true
+			if score := renameScore(nf, of); score >= minRenameScore {
+				candidates = append(candidates, candidate{nf, of, score})
+			}
+		}
+	}
+
+	// Best matches first, ties are broken by name to keep results stable.
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.score != b.score {
+			return a.score > b.score
+		}
+		if a.newFile.Name != b.newFile.Name {
+			return a.newFile.Name < b.newFile.Name
+		}
+		return a.oldFile.Name < b.oldFile.Name
+	})
+
+	deletedEntries := make(map[string]*File)
+	for _, f := range newManifest.Files {
+		if f.Status == statusDeleted {
+			deletedEntries[f.Name] = f
+		}
+	}
+
+	paired := make(map[*File]bool)
+	for _, cand := range candidates {
+		if paired[cand.newFile] || paired[cand.oldFile] {
+			continue
+		}
+		paired[cand.newFile] = true
+		paired[cand.oldFile] = true
+		linkRename(cand.newFile, cand.oldFile, cand.score)
+		if d, ok := deletedEntries[cand.oldFile.Name]; ok {
+			d.Rename = renameSet
+		}
+		c.Renamed = append(c.Renamed, cand.newFile)
+	}
+
+	var added, deleted []*File
+	for _, f := range c.Added {
+		if !paired[f] {
+			added = append(added, f)
+		}
+	}
+	for _, f := range c.Deleted {
+		if !paired[f] {
+			deleted = append(deleted, f)
+		}
+	}
+	c.Added = added
+	c.Deleted = deleted
+
+	sort.Slice(c.Renamed, func(i, j int) bool {
+		return c.Renamed[i].Name < c.Renamed[j].Name
+	})
+}
@@ -0,0 +1,108 @@
+package swupd
+
+import "testing"
+
+func TestRenameScore(t *testing.T) {
+	hashA := "6666666666666666666666666666666666666666666666666666666666666666"
+	hashB := "7777777777777777777777777777777777777777777777777777777777777777"
+
+	tests := []struct {
+		name     string
+		newFile  *File
+		oldFile  *File
+		expected uint16
+	}{
+		{
+			"same contents",
+			newTestFile("/usr/bin/new", typeFile, hashA),
+			newTestFile("/usr/bin/old", typeFile, hashA),
+			MaxRenameScore,
+		},
+		{
+			"soname bump",
+			newTestFile("/usr/lib64/libfoo.so.2.1.0", typeFile, hashA),
+			newTestFile("/usr/lib64/libfoo.so.1.9.3", typeFile, hashB),
+			renameScorePath,
+		},
+		{
+			"kernel module directory",
+			newTestFile("/usr/lib/modules/4.14.4-350.native/kernel/fs/ext4.ko", typeFile, hashA),
+			newTestFile("/usr/lib/modules/4.14.3-349.native/kernel/fs/ext4.ko", typeFile, hashB),
+			renameScorePath,
+		},
+		{
+			"moved directory",
+			newTestFile("/usr/share/foo/data.bin", typeFile, hashA),
+			newTestFile("/usr/share/bar/data.bin", typeFile, hashB),
+			0,
+		},
+		{
+			"unrelated",
+			newTestFile("/usr/bin/foo", typeFile, hashA),
+			newTestFile("/usr/bin/bar", typeFile, hashB),
+			0,
+		},
+		{
+			"not a regular file",
+			newTestFile("/usr/lib64/libfoo.so.2", typeLink, hashA),
+			newTestFile("/usr/lib64/libfoo.so.1", typeLink, hashA),
+			0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if score := renameScore(tt.newFile, tt.oldFile); score != tt.expected {
+				t.Errorf("rename score %d, expected %d", score, tt.expected)
+			}
+		})
+	}
+}
+
+func TestDetectRenames(t *testing.T) {
+	hashA := "8888888888888888888888888888888888888888888888888888888888888888"
+	hashB := "9999999999999999999999999999999999999999999999999999999999999999"
+	hashC := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	hashD := "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+	hashE := "cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc"
+	hashF := "dddddddddddddddddddddddddddddddddddddddddddddddddddddddddddddddd"
+
+	oldSo := newTestFile("/usr/lib64/libbar.so.1", typeFile, hashA)
+	oldManifest := &Manifest{Files: []*File{
+		oldSo,
+		newTestFile("/usr/bin/unrelated", typeFile, hashC),
+		newTestFile("/usr/lib/a/config", typeFile, hashE),
+	}}
+	newSo := newTestFile("/usr/lib64/libbar.so.2", typeFile, hashB)
+	deletedSo := &File{Name: "/usr/lib64/libbar.so.1", Status: statusDeleted}
+	newManifest := &Manifest{Files: []*File{
+		newSo,
+		newTestFile("/usr/bin/other", typeFile, hashD),
+		deletedSo,
+		newTestFile("/etc/b/config", typeFile, hashF),
+		{Name: "/usr/bin/unrelated", Status: statusDeleted},
+		{Name: "/usr/lib/a/config", Status: statusDeleted},
+	}}
+
+	c := DiffManifests(oldManifest, newManifest)
+
+	if len(c.Renamed) != 1 || c.Renamed[0] != newSo {
+		t.Fatalf("expected libbar.so.2 to be renamed, got %v", fileNames(c.Renamed))
+	}
+	if newSo.RenamePeer != oldSo || newSo.DeltaPeer != oldSo || newSo.RenameScore != renameScorePath {
+		t.Errorf("rename peer fields not set: %+v", newSo)
+	}
+	if !newSo.Rename || !deletedSo.Rename {
+		t.Error("rename flag not set on the new and deleted entries")
+	}
+	if flags, _ := newSo.getFlagString(); flags != "F..r" {
+		t.Errorf("renamed file has flags %q", flags)
+	}
+	// Files in different directories are not paired for their base name.
+	if names := fileNames(c.Added); len(names) != 2 || names[0] != "/usr/bin/other" || names[1] != "/etc/b/config" {
+		t.Errorf("unexpected added files %v", names)
+	}
+	if names := fileNames(c.Deleted); len(names) != 2 || names[0] != "/usr/bin/unrelated" || names[1] != "/usr/lib/a/config" {
+		t.Errorf("unexpected deleted files %v", names)
+	}
+}
@@ -0,0 +1,228 @@
+package swupd
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// SuperpackInfo summarizes the creation of the superpacks for a version
+type SuperpackInfo struct {
+	// Superpacks is the number of superpacks written
+	Superpacks uint32
+	// Linked is the number of delta packs replaced by a link to a superpack
+	Linked uint32
+	// SizeBefore and SizeAfter are the total size of the packs of the
+	// version before and after creating the superpacks
+	SizeBefore int64
+	SizeAfter  int64
+}
+
+// packsSize returns the total size of the pack files in dir, links are
+// counted with their own size
+func packsSize(dir string) (int64, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "pack-*.tar"))
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, m := range matches {
+		fi, err := os.Lstat(m)
+		if err != nil {
+			return 0, err
+		}
+		size += fi.Size()
+	}
+	return size, nil
+}
+
+// previousVersions follows the previous versions recorded in the MoM headers
+// starting at version, returning up to count versions before it.
+func previousVersions(statedir string, version uint32, count int) ([]uint32, error) {
+	var versions []uint32
+	for len(versions) < count {
+		mom, err := readMoM(statedir, version)
+		if err != nil {
+			return nil, err
+		}
+		if mom.Header.Previous == 0 || mom.Header.Previous >= version {
+			break
+		}
+		version = mom.Header.Previous
+		versions = append(versions, version)
+	}
+	return versions, nil
+}
+
+// mergePacks writes the delta and staged files of all packs into a single xz
+// compressed pack at out. Full files that appear in more than one pack are
+// only stored once, which is where the space is saved.
+func mergePacks(out string, packs []string) error {
+	tmp := out + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	xz, err := newXzWriter(f)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(xz)
+
+	seen := make(map[string]bool)
+	for _, p := range packs {
+		if err = copyPackEntries(tw, p, seen); err != nil {
+			xz.Close()
+			return fmt.Errorf("failed to read %s: %v", p, err)
+		}
+	}
+	if err = tw.Close(); err != nil {
+		xz.Close()
+		return err
+	}
+	if err = xz.Close(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, out)
+}
+
+// copyPackEntries adds the entries of the pack at path to tw, skipping the
+// names in seen
+func copyPackEntries(tw *tar.Writer, path string, seen map[string]bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := openCompressed(f)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if seen[hdr.Name] {
+			continue
+		}
+		seen[hdr.Name] = true
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err = io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// CreateSuperpacks merges the delta packs of the bundles changed in version
+// to into superpacks. The delta packs considered are the ones from the count
+// versions before to, following the previous versions in the MoMs. For each
+// bundle the superpack replaces the oldest delta pack, the most recent keep
+// delta packs stay as they are and the others are replaced by a symlink to
+// the superpack.
+func CreateSuperpacks(statedir string, to uint32, count int, keep int) (*SuperpackInfo, error) {
+	if count < 1 || keep < 0 {
+		return nil, fmt.Errorf("invalid pack count %d or number of packs to keep %d", count, keep)
+	}
+
+	dir := filepath.Join(statedir, "www", fmt.Sprint(to))
+	info := &SuperpackInfo{}
+	var err error
+	if info.SizeBefore, err = packsSize(dir); err != nil {
+		return nil, err
+	}
+
+	toVersions, err := readManifestVersions(statedir, to)
+	if err != nil {
+		return nil, err
+	}
+	previous, err := previousVersions(statedir, to, count)
+	if err != nil {
+		return nil, err
+	}
+
+	// The delta packs are named after the bundle version in each of the
+	// previous versions.
+	fromVersions := make(map[string]map[uint32]bool)
+	for _, v := range previous {
+		versions, err := readManifestVersions(statedir, v)
+		if err != nil {
+			return nil, err
+		}
+		for bundle, ver := range versions {
+			if toVersions[bundle] != to || ver == to {
+				continue
+			}
+			if fromVersions[bundle] == nil {
+				fromVersions[bundle] = make(map[uint32]bool)
+			}
+			fromVersions[bundle][ver] = true
+		}
+	}
+
+	var bundles []string
+	for bundle := range fromVersions {
+		bundles = append(bundles, bundle)
+	}
+	sort.Strings(bundles)
+
+	for _, bundle := range bundles {
+		var packs []*Pack
+		for ver := range fromVersions[bundle] {
+			p := &Pack{Bundle: bundle, FromVersion: ver, ToVersion: to}
+			if fi, err := os.Lstat(p.Path(statedir)); err == nil && fi.Mode().IsRegular() {
+				packs = append(packs, p)
+			}
+		}
+		if len(packs) == 0 {
+			continue
+		}
+		sortPacks(packs)
+
+		var paths []string
+		for _, p := range packs {
+			paths = append(paths, p.Path(statedir))
+		}
+		superpack := packs[0]
+		if err = mergePacks(superpack.Path(statedir), paths); err != nil {
+			return nil, err
+		}
+		info.Superpacks++
+
+		// Replace everything but the superpack and the most recent delta
+		// packs with links to the superpack.
+		for i := 1; i < len(packs)-keep; i++ {
+			path := packs[i].Path(statedir)
+			if err = os.Remove(path); err != nil {
+				return nil, err
+			}
+			if err = os.Symlink(superpack.FileName(), path); err != nil {
+				return nil, err
+			}
+			info.Linked++
+		}
+	}
+
+	if info.SizeAfter, err = packsSize(dir); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
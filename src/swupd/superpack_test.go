@@ -0,0 +1,75 @@
+package swupd
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestCreateSuperpacks(t *testing.T) {
+	if _, err := exec.LookPath("xz"); err != nil {
+		t.Skip("xz not available")
+	}
+
+	statedir, err := ioutil.TempDir("", "swupd-superpack-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(statedir)
+
+	versions := []string{"10", "20", "30"}
+	for i, ver := range versions {
+		for _, bundle := range []string{"os-core", "full"} {
+			mustWriteChrootFile(t, statedir, ver, bundle, "usr/bin/core", "core "+ver)
+			mustWriteChrootFile(t, statedir, ver, bundle, "usr/bin/tool-"+ver, "tool "+ver)
+		}
+		if i > 0 {
+			if err = ioutil.WriteFile(filepath.Join(statedir, "image", "LAST_VER"), []byte(versions[i-1]), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err = CreateManifests(uint32(10*(i+1)), 0, 1, statedir); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var packs []*Pack
+	for _, from := range []uint32{10, 20} {
+		deltas, err := DeltaPacks(statedir, from, 30)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packs = append(packs, deltas...)
+	}
+	if err = CreatePacks(statedir, packs, false, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := CreateSuperpacks(statedir, 30, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Superpacks != 1 || info.Linked != 1 {
+		t.Errorf("created %d superpacks and %d links, expected 1 and 1", info.Superpacks, info.Linked)
+	}
+	if info.SizeBefore == 0 || info.SizeAfter == 0 {
+		t.Errorf("pack sizes not reported: %+v", info)
+	}
+
+	dir := filepath.Join(statedir, "www", "30")
+	target, err := os.Readlink(filepath.Join(dir, "pack-os-core-from-20.tar"))
+	if err != nil || target != "pack-os-core-from-10.tar" {
+		t.Errorf("pack from 20 is not a link to the superpack: %q %v", target, err)
+	}
+
+	// The superpack has everything needed to update from either version.
+	entries := listPack(t, filepath.Join(dir, "pack-os-core-from-10.tar"))
+	m := mustReadManifest(t, filepath.Join(dir, "Manifest.os-core"))
+	for _, f := range m.Files {
+		if f.Version > 10 && f.present() && !entries["staged/"+f.Hash.String()] {
+			t.Errorf("superpack is missing %s", f.Name)
+		}
+	}
+}
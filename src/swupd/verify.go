@@ -0,0 +1,348 @@
+package swupd
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// VerifyInfo summarizes the verification of the content of a version
+type VerifyInfo struct {
+	// Manifests, Fullfiles and Packs are the number of each checked
+	Manifests uint32
+	Fullfiles uint32
+	Packs     uint32
+	// BoundedSizes is the number of manifests with directories, whose
+	// contentsize is only checked to be at least the size of their files
+	BoundedSizes uint32
+	// Problems lists every inconsistency found, the content is valid when
+	// it is empty
+	Problems []string
+}
+
+// verifier collects the problems found while checking a version
+type verifier struct {
+	statedir string
+	info     *VerifyInfo
+	mutex    sync.Mutex
+	// sizes are the sizes of the files and links found in the fullfiles,
+	// by hash
+	sizes map[hashval]int64
+}
+
+func (v *verifier) problem(format string, args ...interface{}) {
+	v.mutex.Lock()
+	v.info.Problems = append(v.info.Problems, fmt.Sprintf(format, args...))
+	v.mutex.Unlock()
+}
+
+// readTarEntry returns the hash of the content of the current entry of tr
+// along with its size
+func readTarEntry(tr *tar.Reader, hdr *tar.Header) (hashval, int64, error) {
+	info, err := hashInfoFromTarHeader(hdr)
+	if err != nil {
+		return 0, 0, err
+	}
+	var content io.Reader = tr
+	if hdr.Typeflag == tar.TypeSymlink {
+		content = strings.NewReader(hdr.Linkname)
+	}
+	hash, err := GetHashForReader(content, info)
+	return hash, info.Size, err
+}
+
+// verifyFullfile checks that the fullfile of f holds a single entry named
+// after its hash, with content producing that hash
+func (v *verifier) verifyFullfile(f *File) error {
+	path := filepath.Join(v.statedir, "www", fmt.Sprint(f.Version), "files", f.Hash.String()+".tar")
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	r, err := openCompressed(file)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err != nil {
+		return err
+	}
+	if hdr.Name != f.Hash.String() {
+		return fmt.Errorf("contains %s", hdr.Name)
+	}
+	hash, size, err := readTarEntry(tr, hdr)
+	if err != nil {
+		return err
+	}
+	if hash != f.Hash {
+		return fmt.Errorf("content hashes to %s", hash)
+	}
+	if f.Type != typeDirectory {
+		v.mutex.Lock()
+		v.sizes[f.Hash] = size
+		v.mutex.Unlock()
+	}
+	return nil
+}
+
+// verifyFullfiles checks the fullfile of every file present in manifests,
+// running up to workers checks in parallel
+func (v *verifier) verifyFullfiles(manifests []*Manifest, workers int) {
+	queue := make(chan *File)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range queue {
+				if err := v.verifyFullfile(f); err != nil {
+					v.problem("fullfile %d/files/%s.tar of %s: %v", f.Version, f.Hash, f.Name, err)
+				}
+			}
+		}()
+	}
+
+	done := make(map[hashval]bool)
+	for _, m := range manifests {
+		for _, f := range m.Files {
+			if !f.present() || done[f.Hash] {
+				continue
+			}
+			done[f.Hash] = true
+			v.info.Fullfiles++
+			queue <- f
+		}
+	}
+	close(queue)
+	wg.Wait()
+}
+
+// verifyHeader checks the filecount and contentsize of m. The size of the
+// directories on the build system is part of the contentsize but not of the
+// content, so with directories the files and links only need to fit.
+func (v *verifier) verifyHeader(m *Manifest) {
+	if int(m.Header.FileCount) != len(m.Files) {
+		v.problem("Manifest.%s of version %d has filecount %d but %d entries",
+			m.Name, m.Header.Version, m.Header.FileCount, len(m.Files))
+	}
+
+	var size uint64
+	// Files without a valid fullfile are reported already.
+	dirs, complete := false, true
+	for _, f := range m.Files {
+		switch {
+		case f.Status == statusDeleted:
+		case f.Type == typeDirectory:
+			dirs = true
+		default:
+			s, ok := v.sizes[f.Hash]
+			complete = complete && ok
+			size += uint64(s)
+		}
+	}
+	if dirs {
+		v.info.BoundedSizes++
+	}
+	if (!dirs && complete && size != m.Header.ContentSize) || size > m.Header.ContentSize {
+		v.problem("Manifest.%s of version %d has contentsize %d but its files add up to %d",
+			m.Name, m.Header.Version, m.Header.ContentSize, size)
+	}
+}
+
+// verifyPack checks that the staged files of the pack at path hash to their
+// names and, unless the pack is a link to a superpack, that it holds the
+// files of m changed since from and nothing else
+func (v *verifier) verifyPack(path string, m *Manifest, from uint32) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	superpack := fi.Mode()&os.ModeSymlink != 0
+
+	needed := make(map[string]bool)
+	for _, f := range m.Files {
+		if f.Version > from && f.present() {
+			needed[f.Hash.String()] = true
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	r, err := openCompressed(file)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	found := make(map[string]bool)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(hdr.Name, "/")
+		var hash string
+		switch {
+		case name == "staged" || name == "delta":
+			continue
+		case strings.HasPrefix(name, "staged/"):
+			hash = strings.TrimPrefix(name, "staged/")
+			got, _, err := readTarEntry(tr, hdr)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			if got.String() != hash {
+				return fmt.Errorf("%s hashes to %s", name, got)
+			}
+		case strings.HasPrefix(name, "delta/"):
+			// Delta files are named after the hash they result in, see
+			// deltaName.
+			hash = name[strings.LastIndex(name, "-")+1:]
+		default:
+			return fmt.Errorf("unexpected entry %s", name)
+		}
+		if !superpack && !needed[hash] {
+			return fmt.Errorf("%s is not a file of the bundle changed since version %d", name, from)
+		}
+		found[hash] = true
+	}
+
+	var missing []string
+	for hash := range needed {
+		if !found[hash] {
+			missing = append(missing, hash)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("%d files missing: %s", len(missing), strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// parsePackName returns the bundle and the version updated from of a pack
+// file named like Pack.FileName
+func parsePackName(name string) (string, uint32, bool) {
+	if !strings.HasPrefix(name, "pack-") || !strings.HasSuffix(name, ".tar") {
+		return "", 0, false
+	}
+	name = strings.TrimSuffix(strings.TrimPrefix(name, "pack-"), ".tar")
+	i := strings.LastIndex(name, "-from-")
+	if i < 0 {
+		return "", 0, false
+	}
+	from, err := strconv.ParseUint(name[i+len("-from-"):], 10, 32)
+	if err != nil {
+		return "", 0, false
+	}
+	return name[:i], uint32(from), true
+}
+
+// VerifyContent checks that the content of version in the www directory of
+// statedir is consistent: the MoM lists the bundle manifests by their hash,
+// the headers of the manifests match their entries, every file has a
+// fullfile whose content produces its hash, and the zero packs of the
+// bundles and the delta packs of version hold the files the manifests list.
+// Up to workers fullfiles are checked in parallel. The problems found are
+// listed in the result, an error is only returned if the MoM cannot be read.
+func VerifyContent(statedir string, version uint32, workers int) (*VerifyInfo, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	mom, err := readMoM(statedir, version)
+	if err != nil {
+		return nil, err
+	}
+	v := &verifier{statedir: statedir, info: &VerifyInfo{}, sizes: make(map[hashval]int64)}
+
+	if int(mom.Header.FileCount) != len(mom.SubManifests) {
+		v.problem("Manifest.MoM of version %d has filecount %d but %d entries",
+			version, mom.Header.FileCount, len(mom.SubManifests))
+	}
+	var manifests []*Manifest
+	for _, sub := range mom.SubManifests {
+		path := filepath.Join(statedir, "www", fmt.Sprint(sub.Header.Version), "Manifest."+sub.Name)
+		hash, err := GetHashForFile(path)
+		if err != nil {
+			v.problem("Manifest.%s of version %d: %v", sub.Name, sub.Header.Version, err)
+			continue
+		}
+		if hash != sub.Hash {
+			v.problem("Manifest.%s of version %d hashes to %s, the MoM lists %s", sub.Name, sub.Header.Version, hash, sub.Hash)
+		}
+		m, err := mom.LoadSubManifest(sub.Name)
+		if err != nil {
+			v.problem("%v", err)
+			continue
+		}
+		manifests = append(manifests, m)
+	}
+	v.info.Manifests = uint32(len(manifests))
+
+	v.verifyFullfiles(manifests, workers)
+	var contentSize uint64
+	for _, m := range manifests {
+		v.verifyHeader(m)
+		contentSize += m.Header.ContentSize
+	}
+	if len(manifests) == len(mom.SubManifests) && contentSize != mom.Header.ContentSize {
+		v.problem("Manifest.MoM of version %d has contentsize %d but its bundles add up to %d",
+			version, mom.Header.ContentSize, contentSize)
+	}
+
+	// The zero packs of bundles that did not change are in the version they
+	// were last changed in, the delta packs are all in the version.
+	type packCheck struct {
+		path string
+		m    *Manifest
+		from uint32
+	}
+	var packs []packCheck
+	byName := make(map[string]*Manifest)
+	for _, m := range manifests {
+		byName[m.Name] = m
+		p := &Pack{Bundle: m.Name, ToVersion: m.Header.Version}
+		packs = append(packs, packCheck{p.Path(statedir), m, 0})
+	}
+	matches, err := filepath.Glob(filepath.Join(statedir, "www", fmt.Sprint(version), "pack-*.tar"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range matches {
+		bundle, from, ok := parsePackName(filepath.Base(path))
+		if !ok || from == 0 {
+			continue
+		}
+		if m := byName[bundle]; m != nil {
+			packs = append(packs, packCheck{path, m, from})
+		} else {
+			v.problem("%d/%s is a pack of no bundle of the version", version, filepath.Base(path))
+		}
+	}
+	for _, p := range packs {
+		v.info.Packs++
+		if err = v.verifyPack(p.path, p.m, p.from); err != nil {
+			rel, _ := filepath.Rel(filepath.Join(statedir, "www"), p.path)
+			v.problem("pack %s: %v", rel, err)
+		}
+	}
+
+	sort.Strings(v.info.Problems)
+	return v.info, nil
+}
@@ -0,0 +1,183 @@
+package swupd
+
+import (
+	"archive/tar"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestVerifyContent(t *testing.T) {
+	if _, err := exec.LookPath("xz"); err != nil {
+		t.Skip("xz not available")
+	}
+
+	statedir, err := ioutil.TempDir("", "swupd-verify-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(statedir)
+
+	for _, bundle := range []string{"os-core", "full"} {
+		mustWriteChrootFile(t, statedir, "10", bundle, "usr/bin/core", "core 10")
+		mustWriteChrootFile(t, statedir, "20", bundle, "usr/bin/core", "core 20")
+		mustWriteChrootFile(t, statedir, "20", bundle, "usr/share/large", strings.Repeat("large ", 1000))
+		if err = os.Symlink("core", filepath.Join(statedir, "image", "20", bundle, "usr/bin/link")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, ver := range []uint32{10, 20} {
+		if _, err = CreateManifests(ver, 0, 1, statedir); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = CreateFullfiles(statedir, ver, 2); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(filepath.Join(statedir, "image", "LAST_VER"), []byte("10"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	zero, err := ZeroPacks(statedir, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delta, err := DeltaPacks(statedir, 10, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = CreatePacks(statedir, append(zero, delta...), false, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := VerifyContent(statedir, 20, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Problems) != 0 {
+		t.Fatalf("unexpected problems in valid content:\n%s", strings.Join(info.Problems, "\n"))
+	}
+	if info.Manifests != 1 || info.Packs != 2 || info.Fullfiles == 0 {
+		t.Errorf("unexpected verification summary %+v", info)
+	}
+
+	m := mustReadManifest(t, filepath.Join(statedir, "www", "20", "Manifest.os-core"))
+	core := findFile(m, "/usr/bin/core")
+	large := findFile(m, "/usr/share/large")
+	changed := 0
+	for _, f := range m.Files {
+		if f.Version > 10 && f.present() {
+			changed++
+		}
+	}
+	extra, err := GetHashForReader(strings.NewReader("extra"), &HashInfo{Mode: syscall.S_IFREG | 0644, Size: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		corrupt  func(www string) error
+		problems []string
+	}{
+		{"swapped fullfile", func(www string) error {
+			files := filepath.Join(www, "20", "files")
+			return os.Rename(filepath.Join(files, large.Hash.String()+".tar"), filepath.Join(files, core.Hash.String()+".tar"))
+		}, []string{"fullfile 20/files/" + core.Hash.String() + ".tar of /usr/bin/core: contains " + large.Hash.String()}},
+		{"missing fullfile", func(www string) error {
+			return os.Remove(filepath.Join(www, "20", "files", core.Hash.String()+".tar"))
+		}, []string{"fullfile 20/files/" + core.Hash.String() + ".tar of /usr/bin/core: open"}},
+		{"missing pack", func(www string) error {
+			return os.Remove(filepath.Join(www, "20", "pack-os-core-from-0.tar"))
+		}, []string{"pack 20/pack-os-core-from-0.tar: lstat"}},
+		{"modified manifest", func(www string) error {
+			return replaceInFile(filepath.Join(www, "20", "Manifest.os-core"), "filecount:\t", "filecount:\t1")
+		}, []string{"Manifest.os-core of version 20 hashes to", "Manifest.os-core of version 20 has filecount 1"}},
+		{"contentsize too small", func(www string) error {
+			return replaceInFile(filepath.Join(www, "20", "Manifest.os-core"),
+				fmt.Sprintf("contentsize:\t%d\n", m.Header.ContentSize), "contentsize:\t1\n")
+		}, []string{
+			"Manifest.os-core of version 20 has contentsize 1 but its files add up to",
+			"Manifest.MoM of version 20 has contentsize",
+		}},
+		{"pack with a wrong file", func(www string) error {
+			return writeTestPack(filepath.Join(www, "20", "pack-os-core-from-0.tar"), map[string]string{core.Hash.String(): "not core"})
+		}, []string{"pack 20/pack-os-core-from-0.tar: staged/" + core.Hash.String() + " hashes to"}},
+		{"pack with an extra file", func(www string) error {
+			return writeTestPack(filepath.Join(www, "20", "pack-os-core-from-10.tar"), map[string]string{extra.String(): "extra"})
+		}, []string{"pack 20/pack-os-core-from-10.tar: staged/" + extra.String() + " is not a file of the bundle changed since version 10"}},
+		{"pack missing a file", func(www string) error {
+			return writeTestPack(filepath.Join(www, "20", "pack-os-core-from-10.tar"), nil)
+		}, []string{fmt.Sprintf("pack 20/pack-os-core-from-10.tar: %d files missing", changed)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Every case corrupts its own copy of the content.
+			dir, err := ioutil.TempDir("", "swupd-verify-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			if out, err := exec.Command("cp", "-a", filepath.Join(statedir, "www"), dir).CombinedOutput(); err != nil {
+				t.Fatalf("%v: %s", err, out)
+			}
+			if err = tt.corrupt(filepath.Join(dir, "www")); err != nil {
+				t.Fatal(err)
+			}
+
+			info, err := VerifyContent(dir, 20, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, expected := range tt.problems {
+				found := false
+				for _, p := range info.Problems {
+					found = found || strings.HasPrefix(p, expected)
+				}
+				if !found {
+					t.Errorf("expected a problem starting with %q, got:\n%s", expected, strings.Join(info.Problems, "\n"))
+				}
+			}
+		})
+	}
+}
+
+// replaceInFile replaces the first old in the file at path with new
+func replaceInFile(path string, old string, new string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(string(content), old) {
+		return fmt.Errorf("%q not found in %s", old, path)
+	}
+	return ioutil.WriteFile(path, []byte(strings.Replace(string(content), old, new, 1)), 0644)
+}
+
+// writeTestPack writes an uncompressed pack holding the given staged files,
+// by name
+func writeTestPack(path string, files map[string]string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	if err = tw.WriteHeader(&tar.Header{Name: "staged/", Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+		return err
+	}
+	for name, content := range files {
+		hdr := &tar.Header{Name: "staged/" + name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err = tw.Write([]byte(content)); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}